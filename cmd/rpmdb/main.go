@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -21,28 +22,26 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	pkgList, err := db.ListPackages()
-	if err != nil {
-		return err
-	}
+	defer db.Close()
 
-	fmt.Println("Packages:")
-	for _, pkg := range pkgList {
-		// Suppress output
-		pkg.BaseNames = nil
-		pkg.DirIndexes = nil
-		pkg.DirNames = nil
-		pkg.FileSizes = nil
-		pkg.FileDigests = nil
-		pkg.FileModes = nil
-		pkg.FileFlags = nil
-		pkg.UserNames = nil
-		pkg.GroupNames = nil
-		pkg.RawHeader = nil
+	// the file lists and raw headers are left out, as they would flood the
+	// printed packages
+	it := db.PackagesWithOptions(context.Background(), rpmdb.ListOptions{
+		Fields: rpmdb.FieldAll &^ (rpmdb.FieldFiles | rpmdb.FieldRawHeader),
+	})
+	defer it.Close()
 
+	fmt.Println("Packages:")
+	var total int
+	for it.Next() {
+		pkg := it.Package()
 		fmt.Printf("\t%+v\n", *pkg)
+		total++
+	}
+	if err := it.Err(); err != nil {
+		return err
 	}
-	fmt.Printf("[Total Packages: %d]\n", len(pkgList))
+	fmt.Printf("[Total Packages: %d]\n", total)
 
 	return nil
 }
@@ -61,8 +60,9 @@ func detectDB() (*rpmdb.RpmDB, error) {
 	}
 	result = multierror.Append(result, err)
 
-	db, err = rpmdb.Open("/var/lib/rpm/Packages")
+	db, discovery, err := rpmdb.OpenRoot("/")
 	if err == nil {
+		log.Printf("using %s: %s", discovery.Resolved, discovery.Reason)
 		return db, nil
 	}
 	result = multierror.Append(result, err)
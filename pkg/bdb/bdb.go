@@ -1,8 +1,13 @@
 package bdb
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
 
 	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
 	"golang.org/x/xerrors"
@@ -20,10 +25,27 @@ var validPageSizes = map[uint32]struct{}{
 }
 
 type BerkeleyDB struct {
-	file         *os.File
-	HashMetadata *HashMetadataPage
-	pgSize       uint32
-	lastPgNo     uint32
+	file   io.ReaderAt
+	closer io.Closer
+	// exactly one of HashMetadata and BtreeMetadata is set, depending on the
+	// access method of the database
+	HashMetadata  *HashMetadataPage
+	BtreeMetadata *BtreeMetadataPage
+	pgSize        uint32
+	lastPgNo      uint32
+	swapped       bool
+
+	// Limits must be set before the database is read.
+	Limits dbi.Limits
+	// OpenIndexFile opens the index databases next to Packages by name, and
+	// must be set before they are used. By default they are opened from the
+	// directory of Packages, and symlinks are refused.
+	OpenIndexFile func(name string) (*os.File, error)
+
+	// directory of the database, where the index databases are found
+	dir     string
+	mu      sync.Mutex
+	indexes map[dbi.Index]*BerkeleyDB
 }
 
 func Open(path string) (*BerkeleyDB, error) {
@@ -32,19 +54,51 @@ func Open(path string) (*BerkeleyDB, error) {
 		return nil, err
 	}
 
+	db, err := openFile(file)
+	if err != nil {
+		return nil, err
+	}
+	db.dir = filepath.Dir(path)
+
+	return db, nil
+}
+
+// openFile opens the database in file, and closes it with the database.
+func openFile(file *os.File) (*BerkeleyDB, error) {
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	// pages are sliced straight from the mapped file
+	source := dbi.MapFile(file, info.Size())
+	db, err := OpenReaderAt(source, info.Size())
+	if err != nil {
+		_ = source.Close()
+		return nil, err
+	}
+	db.closer = source
+
+	return db, nil
+}
+
+// OpenReaderAt parses a Berkeley DB hash or btree database of the given size
+// from r. Pages are read lazily as the database is walked. Closing the
+// returned database does not close r.
+func OpenReaderAt(r io.ReaderAt, size int64) (*BerkeleyDB, error) {
 	// read just a bit in to parse at least the metadata...
 	metadataBuff := make([]byte, 512)
-	_, err = file.Read(metadataBuff)
-	if err != nil {
+	n, err := r.ReadAt(metadataBuff, 0)
+	if err != nil && err != io.EOF {
 		return nil, xerrors.Errorf("failed to read metadata: %w", err)
 	}
 
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to seek db file: %w", err)
+	if metadata, err := ParseMetadata(metadataBuff[:n]); err == nil && metadata.IsBtree() {
+		return openBtree(r, size, metadataBuff[:n])
 	}
 
-	hashMetadata, err := ParseHashMetadataPage(metadataBuff)
+	hashMetadata, err := ParseHashMetadataPage(metadataBuff[:n])
 	if err != nil {
 		return nil, err
 	}
@@ -52,15 +106,50 @@ func Open(path string) (*BerkeleyDB, error) {
 	if _, ok := validPageSizes[hashMetadata.PageSize]; !ok {
 		return nil, xerrors.Errorf("unexpected page size: %+v", hashMetadata.PageSize)
 	}
+	if err := checkLastPgNo(hashMetadata.LastPageNo, hashMetadata.PageSize, size); err != nil {
+		return nil, err
+	}
 
 	return &BerkeleyDB{
-		file:         file,
+		file:         r,
 		HashMetadata: hashMetadata,
 		pgSize:       hashMetadata.PageSize,
 		lastPgNo:     hashMetadata.LastPageNo,
+		swapped:      hashMetadata.Swapped,
 	}, nil
 }
 
+func openBtree(r io.ReaderAt, size int64, metadataBuff []byte) (*BerkeleyDB, error) {
+	btreeMetadata, err := ParseBtreeMetadataPage(metadataBuff)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := validPageSizes[btreeMetadata.PageSize]; !ok {
+		return nil, xerrors.Errorf("unexpected page size: %+v", btreeMetadata.PageSize)
+	}
+	if err := checkLastPgNo(btreeMetadata.LastPageNo, btreeMetadata.PageSize, size); err != nil {
+		return nil, err
+	}
+
+	return &BerkeleyDB{
+		file:          r,
+		BtreeMetadata: btreeMetadata,
+		pgSize:        btreeMetadata.PageSize,
+		lastPgNo:      btreeMetadata.LastPageNo,
+		swapped:       btreeMetadata.Swapped,
+	}, nil
+}
+
+// checkLastPgNo checks that the last page of the metadata is in the file, as
+// the pages up to it are walked and tracked without further checks.
+func checkLastPgNo(lastPgNo, pgSize uint32, size int64) error {
+	if (int64(lastPgNo)+1)*int64(pgSize) > size {
+		return xerrors.Errorf("last page %d of %d bytes exceeds the file of %d bytes", lastPgNo, pgSize, size)
+	}
+	return nil
+}
+
 func (db *BerkeleyDB) GetPgSize() uint32 {
 	return db.pgSize
 }
@@ -70,37 +159,87 @@ func (db *BerkeleyDB) GetLastPgNo() uint32 {
 }
 
 func (db *BerkeleyDB) Close() error {
-	return db.file.Close()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var err error
+	for _, idx := range db.indexes {
+		if cerr := idx.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	db.indexes = nil
+
+	if db.closer != nil {
+		if cerr := db.closer.Close(); cerr != nil {
+			return cerr
+		}
+	}
+	return err
 }
 
 func (db *BerkeleyDB) Read() <-chan dbi.Entry {
+	return db.ReadContext(context.Background())
+}
+
+func (db *BerkeleyDB) ReadContext(ctx context.Context) <-chan dbi.Entry {
+	return db.read(ctx, false)
+}
+
+var _ dbi.Salvager = (*BerkeleyDB)(nil)
+
+// SalvageContext implements dbi.Salvager. Pages and items that cannot be read
+// are reported and skipped. Btree databases are read by scanning every page
+// for leaf pages, rather than by following the links between them.
+func (db *BerkeleyDB) SalvageContext(ctx context.Context) <-chan dbi.Entry {
+	return db.read(ctx, true)
+}
+
+func (db *BerkeleyDB) read(ctx context.Context, salvage bool) <-chan dbi.Entry {
 	entries := make(chan dbi.Entry)
 
 	go func() {
 		defer close(entries)
 
+		budget := dbi.NewBudget(db.Limits)
+		if db.BtreeMetadata != nil {
+			if salvage {
+				db.salvageBtree(ctx, entries, budget)
+			} else {
+				db.readBtree(ctx, entries, budget)
+			}
+			return
+		}
+
+		// fail reports err, and whether to go on with the next page or item
+		fail := func(pageNum uint32, err error) bool {
+			return dbi.Send(ctx, entries, dbi.Entry{
+				Err:      err,
+				Location: pageLocation(pageNum),
+			}) && salvage && !dbi.LimitExceeded(err)
+		}
+
 		for pageNum := uint32(0); pageNum <= db.HashMetadata.LastPageNo; pageNum++ {
-			pageData, err := slice(db.file, int(db.HashMetadata.PageSize))
-			if err != nil {
-				entries <- dbi.Entry{
-					Err: err,
-				}
+			if ctx.Err() != nil {
+				return
+			}
+			if err := budget.Page(); err != nil {
+				fail(pageNum, err)
 				return
 			}
 
-			// keep track of the start of the next page for the next iteration...
-			endOfPageOffset, err := db.file.Seek(0, io.SeekCurrent)
+			pageData, err := readPage(db.file, pageNum, db.HashMetadata.PageSize)
 			if err != nil {
-				entries <- dbi.Entry{
-					Err: err,
+				if fail(pageNum, err) {
+					continue
 				}
 				return
 			}
 
 			hashPageHeader, err := ParseHashPage(pageData, db.HashMetadata.Swapped)
 			if err != nil {
-				entries <- dbi.Entry{
-					Err: err,
+				if fail(pageNum, err) {
+					continue
 				}
 				return
 			}
@@ -111,53 +250,77 @@ func (db *BerkeleyDB) Read() <-chan dbi.Entry {
 				continue
 			}
 
-			hashPageIndexes, err := HashPageValueIndexes(pageData, hashPageHeader.NumEntries, db.HashMetadata.Swapped)
+			hashPageKeyIndexes, err := HashPageKeyIndexes(pageData, hashPageHeader.NumEntries, db.HashMetadata.Swapped)
 			if err != nil {
-				entries <- dbi.Entry{
-					Err: err,
+				if fail(pageNum, err) {
+					continue
 				}
 				return
 			}
 
-			for _, hashPageIndex := range hashPageIndexes {
-				// the first byte is the page type, so we can peek at it first before parsing further...
-				valuePageType := pageData[hashPageIndex]
-
-				// Only Overflow pages contain package data, skip anything else.
-				if valuePageType != HashOffIndexPageType {
-					continue
+			for i, hashPageKeyIndex := range hashPageKeyIndexes {
+				instance, err := HashPageKeyInstance(pageData, hashPageKeyIndex, db.HashMetadata.Swapped)
+				var raw []byte
+				if err == nil {
+					raw, err = HashPageItem(pageData, hashPageHeader.NumEntries, 2*i+1, db.HashMetadata.Swapped)
 				}
-
-				// Traverse the page to concatenate the data that may span multiple pages.
-				pgNo, valueContent, err := HashPageValueContent(
-					db.file,
-					pageData,
-					hashPageIndex,
-					db.HashMetadata.PageSize,
-					db.HashMetadata.Swapped,
-				)
-
-				entries <- dbi.Entry{
-					Value:                valueContent,
-					Err:                  err,
-					BdbFirstOverflowPgNo: pgNo,
+				var value item
+				if err == nil {
+					value, err = hashItem(raw, db.HashMetadata.Swapped)
 				}
-
-				if err != nil {
+				if err == nil {
+					err = db.packageEntries(instance, value, budget, func(entry dbi.Entry) error {
+						entry.Location = pageLocation(pageNum)
+						if !dbi.Send(ctx, entries, entry) {
+							return errStopWalk
+						}
+						return nil
+					})
+				}
+				if err == errStopWalk {
 					return
 				}
-			}
-
-			// go back to the start of the next page for reading...
-			_, err = db.file.Seek(endOfPageOffset, io.SeekStart)
-			if err != nil {
-				entries <- dbi.Entry{
-					Err: err,
+				if err != nil {
+					if fail(pageNum, err) {
+						continue
+					}
+					return
 				}
-				return
 			}
 		}
 	}()
 
 	return entries
 }
+
+// packageEntries calls fn with a package for every value of the Packages pair
+// of instance, which are charged to budget.
+func (db *BerkeleyDB) packageEntries(instance uint32, value item, budget *dbi.Budget, fn func(entry dbi.Entry) error) error {
+	if instance == 0 {
+		// key 0 holds the next free instance rather than a header
+		return nil
+	}
+
+	err := db.itemValues(value, budget, func(data []byte, overflow uint32) error {
+		if overflow == 0 {
+			if err := budget.Header(int64(len(data))); err != nil {
+				return err
+			}
+			// on-page values alias the mapping of the database
+			data = bytes.Clone(data)
+		}
+		return fn(dbi.Entry{
+			Value:                data,
+			Instance:             instance,
+			BdbFirstOverflowPgNo: overflow,
+		})
+	})
+	if err != nil && err != errStopWalk {
+		return xerrors.Errorf("failed to read package %d: %w", instance, err)
+	}
+	return err
+}
+
+func pageLocation(pgNo uint32) string {
+	return fmt.Sprintf("page %d", pgNo)
+}
@@ -0,0 +1,335 @@
+package bdb
+
+import (
+	"bytes"
+	"context"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* A btree database keeps its pairs sorted by key on leaf pages, which are
+   linked in key order. Internal pages hold the first key of each of their
+   children next to its page number; the key of the first child is left out,
+   as it sorts before every other key. Like hash pages, both start with an
+   array of item offsets, and the items of leaf pages alternate between keys
+   and values.
+
+   Items that do not fit on a page are stored on overflow pages, like
+   H_OFFPAGE items of hash databases.
+
+   https://github.com/berkeleydb/libdb/blob/v5.3.28/src/dbinc/db_page.h#L640-L760
+*/
+
+// maxBtreeLevel is the deepest btree Berkeley DB creates, see MAXBTREELEVEL.
+const maxBtreeLevel = 255
+
+// readBtree sends the packages stored on the leaf pages, in key order.
+func (db *BerkeleyDB) readBtree(ctx context.Context, entries chan<- dbi.Entry, budget *dbi.Budget) {
+	err := db.walkBtree(ctx, budget, func(key, value item) error {
+		return db.btreeEntries(key, value, budget, func(entry dbi.Entry) error {
+			if !dbi.Send(ctx, entries, entry) {
+				return errStopWalk
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errStopWalk && ctx.Err() == nil {
+		dbi.Send(ctx, entries, dbi.Entry{
+			Err: err,
+		})
+	}
+}
+
+// salvageBtree sends the packages of every leaf page in page order, rather
+// than following the links between them, so that a damaged page only loses
+// its own packages.
+func (db *BerkeleyDB) salvageBtree(ctx context.Context, entries chan<- dbi.Entry, budget *dbi.Budget) {
+	for pgNo := uint32(1); pgNo <= db.lastPgNo; pgNo++ {
+		if ctx.Err() != nil {
+			return
+		}
+		err := budget.Page()
+		if err == nil {
+			err = db.salvageLeaf(ctx, entries, pgNo, budget)
+		}
+		if err == errStopWalk {
+			return
+		}
+		if err != nil && (!dbi.Send(ctx, entries, dbi.Entry{Err: err, Location: pageLocation(pgNo)}) || dbi.LimitExceeded(err)) {
+			return
+		}
+	}
+}
+
+// salvageLeaf sends the packages of page pgNo if it is a leaf page, and an
+// entry with Err for each of them that cannot be read.
+func (db *BerkeleyDB) salvageLeaf(ctx context.Context, entries chan<- dbi.Entry, pgNo uint32, budget *dbi.Budget) error {
+	pageData, err := readPage(db.file, pgNo, db.pgSize)
+	if err != nil {
+		return err
+	}
+	page, err := ParseHashPage(pageData, db.swapped)
+	if err != nil {
+		return err
+	}
+	if page.PageType != BtreeLeafPageType {
+		return nil
+	}
+	if PageHeaderSize+HashIndexEntrySize*int(page.NumEntries) > len(pageData) {
+		return xerrors.Errorf("too many entries on btree page %d: %d", pgNo, page.NumEntries)
+	}
+
+	send := func(entry dbi.Entry) error {
+		entry.Location = pageLocation(pgNo)
+		if !dbi.Send(ctx, entries, entry) {
+			return errStopWalk
+		}
+		return nil
+	}
+	return db.leafPairs(pgNo, pageData, page, func(key, value item) error {
+		err := db.btreeEntries(key, value, budget, send)
+		if err == nil || err == errStopWalk || dbi.LimitExceeded(err) {
+			return err
+		}
+		return send(dbi.Entry{Err: err})
+	})
+}
+
+// btreeEntries calls fn with the packages of a leaf pair.
+func (db *BerkeleyDB) btreeEntries(key, value item, budget *dbi.Budget, fn func(entry dbi.Entry) error) error {
+	if key.typ != BtreeKeyDataType || len(key.data) != 4 {
+		return xerrors.Errorf("unexpected Packages key of type %d and %d bytes", key.typ, len(key.data))
+	}
+	return db.packageEntries(byteOrder(db.swapped).Uint32(key.data), value, budget, fn)
+}
+
+// walkBtree calls fn with the key and value items of every pair on the leaf
+// pages, in key order. The leaf pages are charged to budget.
+func (db *BerkeleyDB) walkBtree(ctx context.Context, budget *dbi.Budget, fn func(key, value item) error) error {
+	pgNo, err := db.btreeLeaf(db.BtreeMetadata.Root, nil)
+	if err != nil {
+		return err
+	}
+	return db.walkLeaves(ctx, pgNo, budget, fn)
+}
+
+// searchBtree calls fn with the value items of the pairs whose key is key.
+func (db *BerkeleyDB) searchBtree(ctx context.Context, key []byte, fn func(value item) error) error {
+	pgNo, err := db.btreeLeaf(db.BtreeMetadata.Root, key)
+	if err != nil {
+		return err
+	}
+
+	err = db.walkLeaves(ctx, pgNo, nil, func(keyItem, valueItem item) error {
+		k, err := db.itemData(keyItem, nil)
+		if err != nil {
+			return err
+		}
+		switch c := bytes.Compare(k, key); {
+		case c < 0:
+			return nil
+		case c > 0:
+			return errStopWalk
+		}
+		return fn(valueItem)
+	})
+	if err == errStopWalk {
+		return nil
+	}
+	return err
+}
+
+// btreeLeaf descends from the root page to the leaf page where the pairs of
+// key start, comparing keys byte-wise like Berkeley DB does by default. A nil
+// key finds the first leaf page.
+func (db *BerkeleyDB) btreeLeaf(root uint32, key []byte) (uint32, error) {
+	pgNo := root
+	for level := 0; level < maxBtreeLevel; level++ {
+		pageData, page, err := db.btreePage(pgNo)
+		if err != nil {
+			return 0, err
+		}
+		if page.PageType == BtreeLeafPageType {
+			return pgNo, nil
+		}
+
+		// the last child whose first key sorts before key, as pairs with the
+		// same key may continue from one child to the next
+		var child uint32
+		for i := 0; i < int(page.NumEntries); i++ {
+			off := btreeItemOffset(pageData, i, db.swapped)
+			childPgNo, keyItem, err := btreeInternalItem(pageData, off, db.swapped)
+			if err != nil {
+				return 0, xerrors.Errorf("page %d: %w", pgNo, err)
+			}
+			if i > 0 {
+				if key == nil {
+					break
+				}
+				k, err := db.itemData(keyItem, nil)
+				if err != nil {
+					return 0, xerrors.Errorf("page %d: %w", pgNo, err)
+				}
+				if bytes.Compare(k, key) >= 0 {
+					break
+				}
+			}
+			child = childPgNo
+		}
+		if child == 0 {
+			return 0, xerrors.Errorf("internal page %d has no entries", pgNo)
+		}
+		pgNo = child
+	}
+	return 0, xerrors.Errorf("btree is deeper than %d levels", maxBtreeLevel)
+}
+
+// walkLeaves calls fn with the pairs of the leaf page pgNo and the leaf
+// pages that follow it, which are charged to budget. Deleted pairs are
+// skipped.
+func (db *BerkeleyDB) walkLeaves(ctx context.Context, pgNo uint32, budget *dbi.Budget, fn func(key, value item) error) error {
+	for visited := uint32(0); pgNo != 0; visited++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if visited > db.lastPgNo {
+			return xerrors.Errorf("cycle in the leaf pages at page %d", pgNo)
+		}
+		if err := budget.Page(); err != nil {
+			return err
+		}
+
+		pageData, page, err := db.btreePage(pgNo)
+		if err != nil {
+			return err
+		}
+		if page.PageType != BtreeLeafPageType {
+			return xerrors.Errorf("unexpected page type in leaf chain: page=%d type=%d", pgNo, page.PageType)
+		}
+		if err := db.leafPairs(pgNo, pageData, page, fn); err != nil {
+			return err
+		}
+
+		pgNo = page.NextPageNo
+	}
+	return nil
+}
+
+// leafPairs calls fn with the pairs of a leaf page that are not marked
+// deleted.
+func (db *BerkeleyDB) leafPairs(pgNo uint32, pageData []byte, page *HashPage, fn func(key, value item) error) error {
+	if page.NumEntries%2 != 0 {
+		return xerrors.Errorf("invalid btree leaf: entries should only come in pairs (%+v)", page.NumEntries)
+	}
+
+	for i := 0; i < int(page.NumEntries); i += 2 {
+		key, keyDeleted, err := btreeLeafItem(pageData, btreeItemOffset(pageData, i, db.swapped), db.swapped)
+		if err != nil {
+			return xerrors.Errorf("page %d: %w", pgNo, err)
+		}
+		value, valueDeleted, err := btreeLeafItem(pageData, btreeItemOffset(pageData, i+1, db.swapped), db.swapped)
+		if err != nil {
+			return xerrors.Errorf("page %d: %w", pgNo, err)
+		}
+		if keyDeleted || valueDeleted {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// btreePage reads the internal or leaf page pgNo. Btree pages share the
+// header of hash pages.
+func (db *BerkeleyDB) btreePage(pgNo uint32) ([]byte, *HashPage, error) {
+	if pgNo == 0 || pgNo > db.lastPgNo {
+		return nil, nil, xerrors.Errorf("btree page %d out of range: last page is %d", pgNo, db.lastPgNo)
+	}
+
+	pageData, err := readPage(db.file, pgNo, db.pgSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	page, err := ParseHashPage(pageData, db.swapped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if page.PageType != BtreeInternalPageType && page.PageType != BtreeLeafPageType {
+		return nil, nil, xerrors.Errorf("unexpected page type for btree page %d: %d", pgNo, page.PageType)
+	}
+	if PageHeaderSize+HashIndexEntrySize*int(page.NumEntries) > len(pageData) {
+		return nil, nil, xerrors.Errorf("too many entries on btree page %d: %d", pgNo, page.NumEntries)
+	}
+	return pageData, page, nil
+}
+
+func btreeItemOffset(pageData []byte, i int, swapped bool) int {
+	return int(byteOrder(swapped).Uint16(pageData[PageHeaderSize+HashIndexEntrySize*i:]))
+}
+
+// btreeLeafItem decodes the BKEYDATA or BOVERFLOW item at off of a leaf
+// page, and whether it is marked deleted.
+func btreeLeafItem(pageData []byte, off int, swapped bool) (item, bool, error) {
+	if off < PageHeaderSize || off+3 > len(pageData) {
+		return item{}, false, xerrors.Errorf("btree item out of page bounds: %d", off)
+	}
+
+	order := byteOrder(swapped)
+	typ := pageData[off+2] &^ BtreeDeletedFlag
+	deleted := pageData[off+2]&BtreeDeletedFlag != 0
+
+	switch typ {
+	case BtreeKeyDataType:
+		// length, type, data
+		end := off + 3 + int(order.Uint16(pageData[off:]))
+		if end > len(pageData) {
+			return item{}, false, xerrors.Errorf("btree item out of page bounds: %d-%d", off, end)
+		}
+		return item{typ: typ, data: pageData[off+3 : end]}, deleted, nil
+	case BtreeOverflowType, BtreeDuplicateType:
+		// 2 unused bytes, type, 1 unused byte, first page, total length
+		if off+BtreeOverflowSize > len(pageData) {
+			return item{}, false, xerrors.Errorf("btree item out of page bounds: %d", off)
+		}
+		if typ == BtreeDuplicateType {
+			// the root of an off-page duplicate tree, like H_OFFDUP
+			typ = HashOffDupPageType
+		}
+		return item{typ: typ, overflow: order.Uint32(pageData[off+4:]), length: order.Uint32(pageData[off+8:])}, deleted, nil
+	}
+	return item{}, false, xerrors.Errorf("unsupported btree item type: %d", typ)
+}
+
+// btreeInternalItem decodes the BINTERNAL item at off of an internal page,
+// returning the page number of the child and its first key.
+func btreeInternalItem(pageData []byte, off int, swapped bool) (uint32, item, error) {
+	if off < PageHeaderSize || off+BtreeInternalSize > len(pageData) {
+		return 0, item{}, xerrors.Errorf("btree item out of page bounds: %d", off)
+	}
+
+	// length, type, 1 unused byte, child page, record count, data
+	order := byteOrder(swapped)
+	typ := pageData[off+2] &^ BtreeDeletedFlag
+	child := order.Uint32(pageData[off+4:])
+	start := off + BtreeInternalSize
+	end := start + int(order.Uint16(pageData[off:]))
+	if end > len(pageData) {
+		return 0, item{}, xerrors.Errorf("btree item out of page bounds: %d-%d", off, end)
+	}
+
+	switch typ {
+	case BtreeKeyDataType:
+		return child, item{typ: typ, data: pageData[start:end]}, nil
+	case BtreeOverflowType:
+		// the key is a BOVERFLOW item
+		if end-start < BtreeOverflowSize {
+			return 0, item{}, xerrors.Errorf("short BOVERFLOW key: %d bytes", end-start)
+		}
+		return child, item{typ: typ, overflow: order.Uint32(pageData[start+4:]), length: order.Uint32(pageData[start+8:])}, nil
+	}
+	return 0, item{}, xerrors.Errorf("unsupported btree item type: %d", typ)
+}
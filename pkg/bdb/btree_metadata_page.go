@@ -0,0 +1,65 @@
+package bdb
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// source: https://github.com/berkeleydb/libdb/blob/5b7b02ae052442626af54c176335b67ecc613a30/src/dbinc/db_page.h#L107
+type BtreeMetadata struct {
+	GenericMetadataPage
+	Unused1 uint32 `struct:"uint32"` /* 72-75: Unused space. */
+	MinKey  uint32 `struct:"uint32"` /* 76-79: Btree: Minkey. */
+	ReLen   uint32 `struct:"uint32"` /* 80-83: Recno: fixed-length record length. */
+	RePad   uint32 `struct:"uint32"` /* 84-87: Recno: fixed-length record pad. */
+	Root    uint32 `struct:"uint32"` /* 88-91: Root page. */
+	// don't care about the rest...
+}
+
+type BtreeMetadataPage struct {
+	BtreeMetadata
+	Swapped bool
+}
+
+func ParseBtreeMetadataPage(data []byte) (*BtreeMetadataPage, error) {
+	var pageMetadata BtreeMetadataPage
+
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &pageMetadata.BtreeMetadata)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to unpack BtreeMetadataPage: %w", err)
+	}
+
+	if pageMetadata.Magic == BtreeMagicNumberBE {
+		// Re-read the whole metadata as BigEndian
+		pageMetadata.Swapped = true
+		err := binary.Read(bytes.NewReader(data), binary.BigEndian, &pageMetadata.BtreeMetadata)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to unpack BtreeMetadataPage: %w", err)
+		}
+	}
+
+	return &pageMetadata, pageMetadata.validate()
+}
+
+func (p *BtreeMetadata) validate() error {
+	err := p.GenericMetadataPage.validate()
+	if err != nil {
+		return err
+	}
+
+	if p.Magic != BtreeMagicNumber {
+		return xerrors.Errorf("unexpected DB magic number: %+v", p.Magic)
+	}
+
+	if p.PageType != BtreeMetadataPageType {
+		return xerrors.Errorf("unexpected page type: %+v", p.PageType)
+	}
+
+	if p.Root == 0 || p.Root > p.LastPageNo {
+		return xerrors.Errorf("unexpected root page: %d of %d", p.Root, p.LastPageNo)
+	}
+
+	return nil
+}
@@ -3,8 +3,10 @@ package bdb
 const (
 	NoEncryptionAlgorithm = 0
 
-	HashMagicNumber   = 0x00061561
-	HashMagicNumberBE = 0x61150600
+	HashMagicNumber    = 0x00061561
+	HashMagicNumberBE  = 0x61150600
+	BtreeMagicNumber   = 0x00053162
+	BtreeMagicNumberBE = 0x62310500
 
 	// the size (in bytes) of an in-page offset
 	HashIndexEntrySize = 2
@@ -13,15 +15,35 @@ const (
 
 	// all page types supported
 	// https://github.com/berkeleydb/libdb/blob/v5.3.28/src/dbinc/db_page.h#L35-L53
-	HashUnsortedPageType PageType = 2 // Hash pages created pre 4.6. DEPRECATED
-	OverflowPageType     PageType = 7
-	HashMetadataPageType PageType = 8
-	HashPageType         PageType = 13 // Sorted hash page.
+	HashUnsortedPageType  PageType = 2 // Hash pages created pre 4.6. DEPRECATED
+	BtreeInternalPageType PageType = 3 // aka P_IBTREE
+	RecnoInternalPageType PageType = 4 // aka P_IRECNO
+	BtreeLeafPageType     PageType = 5 // aka P_LBTREE
+	RecnoLeafPageType     PageType = 6 // aka P_LRECNO
+	OverflowPageType      PageType = 7
+	HashMetadataPageType  PageType = 8
+	BtreeMetadataPageType PageType = 9
+	DuplicateLeafPageType PageType = 12 // aka P_LDUP
+	HashPageType          PageType = 13 // Sorted hash page.
 
 	// https://github.com/berkeleydb/libdb/blob/v5.3.28/src/dbinc/db_page.h#L569-L573
-	HashOffIndexPageType PageType = 3 // aka HOFFPAGE
+	HashKeyDataPageType   PageType = 1 // aka H_KEYDATA
+	HashDuplicatePageType PageType = 2 // aka H_DUPLICATE
+	HashOffIndexPageType  PageType = 3 // aka HOFFPAGE
+	HashOffDupPageType    PageType = 4 // aka H_OFFDUP
 
 	HashOffPageSize = 12 // (in bytes)
+	HashOffDupSize  = 8  // (in bytes)
+
+	// https://github.com/berkeleydb/libdb/blob/v5.3.28/src/dbinc/db_page.h#L693-L699
+	BtreeKeyDataType   PageType = 1    // aka B_KEYDATA
+	BtreeDuplicateType PageType = 2    // aka B_DUPLICATE
+	BtreeOverflowType  PageType = 3    // aka B_OVERFLOW
+	BtreeDeletedFlag   PageType = 0x80 // aka B_DELETE
+
+	BtreeOverflowSize = 12 // size of a BOVERFLOW item (in bytes)
+	BtreeInternalSize = 12 // size of a BINTERNAL item without its data (in bytes)
+	RecnoInternalSize = 8  // size of a RINTERNAL item (in bytes)
 )
 
 type PageType = uint8
@@ -0,0 +1,155 @@
+package bdb
+
+import (
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* Databases that allow duplicates keep every value stored under a key. A
+   small set of values stays on the hash page as one H_DUPLICATE item, whose
+   values each come with their length before and after them. Larger sets move
+   to an off-page duplicate tree, referred to by an H_OFFDUP item of a hash
+   page or a B_DUPLICATE item of a btree leaf. The tree is a btree of sorted
+   values (P_IBTREE over P_LDUP pages) or a recno tree of values in insertion
+   order (P_IRECNO over P_LRECNO pages). Either way, its leaf pages are linked
+   in order and hold one BKEYDATA or BOVERFLOW item per value.
+
+   https://github.com/berkeleydb/libdb/blob/v5.3.28/src/dbinc/db_page.h#L575-L620
+*/
+
+// itemValues calls fn with every value of an item, with the first overflow
+// page of values that are not on a page: one for most items, and one per
+// duplicate for duplicate sets. Overflow and duplicate pages are charged to
+// budget.
+func (db *BerkeleyDB) itemValues(it item, budget *dbi.Budget, fn func(value []byte, overflow uint32) error) error {
+	switch it.typ {
+	case HashDuplicatePageType:
+		return duplicateSet(it.data, db.swapped, func(value []byte) error {
+			return fn(value, 0)
+		})
+	case HashOffDupPageType:
+		return db.walkDuplicates(it.overflow, budget, func(value item) error {
+			data, err := db.itemData(value, budget)
+			if err != nil {
+				return err
+			}
+			return fn(data, value.overflow)
+		})
+	}
+
+	data, err := db.itemData(it, budget)
+	if err != nil {
+		return err
+	}
+	return fn(data, it.overflow)
+}
+
+// duplicateSet calls fn with the values of an H_DUPLICATE item, without its
+// type byte.
+func duplicateSet(data []byte, swapped bool, fn func(value []byte) error) error {
+	order := byteOrder(swapped)
+	for off := 0; off < len(data); {
+		if off+2 > len(data) {
+			return xerrors.Errorf("truncated duplicate at %d", off)
+		}
+		n := int(order.Uint16(data[off:]))
+		end := off + 2 + n
+		if end+2 > len(data) || int(order.Uint16(data[end:])) != n {
+			return xerrors.Errorf("invalid duplicate of %d bytes at %d", n, off)
+		}
+		if err := fn(data[off+2 : end]); err != nil {
+			return err
+		}
+		off = end + 2
+	}
+	return nil
+}
+
+// walkDuplicates calls fn with the value items of the off-page duplicate tree
+// whose root is page root, in order.
+func (db *BerkeleyDB) walkDuplicates(root uint32, budget *dbi.Budget, fn func(value item) error) error {
+	// descend to the first leaf page
+	pgNo := root
+	for level := 0; ; level++ {
+		if level == maxBtreeLevel {
+			return xerrors.Errorf("duplicate tree is deeper than %d levels", maxBtreeLevel)
+		}
+		if err := budget.Page(); err != nil {
+			return err
+		}
+		pageData, page, err := db.duplicatePage(pgNo)
+		if err != nil {
+			return err
+		}
+		if page.PageType == DuplicateLeafPageType || page.PageType == RecnoLeafPageType {
+			break
+		}
+		if page.NumEntries == 0 {
+			return xerrors.Errorf("internal page %d has no entries", pgNo)
+		}
+
+		off := btreeItemOffset(pageData, 0, db.swapped)
+		if page.PageType == RecnoInternalPageType {
+			// RINTERNAL: child page, record count
+			if off < PageHeaderSize || off+RecnoInternalSize > len(pageData) {
+				return xerrors.Errorf("page %d: recno item out of page bounds: %d", pgNo, off)
+			}
+			pgNo = byteOrder(db.swapped).Uint32(pageData[off:])
+			continue
+		}
+		child, _, err := btreeInternalItem(pageData, off, db.swapped)
+		if err != nil {
+			return xerrors.Errorf("page %d: %w", pgNo, err)
+		}
+		pgNo = child
+	}
+
+	for visited := uint32(0); pgNo != 0; visited++ {
+		if visited > db.lastPgNo {
+			return xerrors.Errorf("cycle in the duplicate pages at page %d", pgNo)
+		}
+		if visited > 0 {
+			if err := budget.Page(); err != nil {
+				return err
+			}
+		}
+		pageData, page, err := db.duplicatePage(pgNo)
+		if err != nil {
+			return err
+		}
+		if page.PageType != DuplicateLeafPageType && page.PageType != RecnoLeafPageType {
+			return xerrors.Errorf("unexpected page type in duplicate chain: page=%d type=%d", pgNo, page.PageType)
+		}
+		if err := db.btreeLeafChains(pgNo, pageData, page, fn); err != nil {
+			return err
+		}
+		pgNo = page.NextPageNo
+	}
+	return nil
+}
+
+// duplicatePage reads the page pgNo of an off-page duplicate tree.
+func (db *BerkeleyDB) duplicatePage(pgNo uint32) ([]byte, *HashPage, error) {
+	if pgNo == 0 || pgNo > db.lastPgNo {
+		return nil, nil, xerrors.Errorf("duplicate page %d out of range: last page is %d", pgNo, db.lastPgNo)
+	}
+
+	pageData, err := readPage(db.file, pgNo, db.pgSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	page, err := ParseHashPage(pageData, db.swapped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch page.PageType {
+	case BtreeInternalPageType, RecnoInternalPageType, DuplicateLeafPageType, RecnoLeafPageType:
+	default:
+		return nil, nil, xerrors.Errorf("unexpected page type for duplicate page %d: %d", pgNo, page.PageType)
+	}
+	if PageHeaderSize+HashIndexEntrySize*int(page.NumEntries) > len(pageData) {
+		return nil, nil, xerrors.Errorf("too many entries on duplicate page %d: %d", pgNo, page.NumEntries)
+	}
+	return pageData, page, nil
+}
@@ -24,7 +24,7 @@ type GenericMetadataPage struct {
 	KeyCount      uint32   `struct:"uint32"`   /* 40-43: Cached key count. */
 	RecordCount   uint32   `struct:"uint32"`   /* 44-47: Cached record count. */
 	Flags         uint32   `struct:"uint32"`   /* 48-51: Flags: unique to each AM. */
-	UniqueFileID  [19]byte `struct:"[19]byte"` /* 52-71: Unique file ID. */
+	UniqueFileID  [20]byte `struct:"[20]byte"` /* 52-71: Unique file ID. */
 }
 
 func ParseGenericMetadataPage(data []byte) (*GenericMetadataPage, error) {
@@ -45,3 +45,47 @@ func (p *GenericMetadataPage) validate() error {
 
 	return nil
 }
+
+// Metadata is the metadata page shared by every access method, decoded in the
+// byte order of the host that wrote the database.
+type Metadata struct {
+	GenericMetadataPage
+	Swapped bool
+}
+
+// ParseMetadata parses the first page of a hash or btree database, detecting
+// the byte order from the magic number.
+func ParseMetadata(data []byte) (*Metadata, error) {
+	var metadata Metadata
+
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &metadata.GenericMetadataPage)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to unpack GenericMetadataPage: %w", err)
+	}
+
+	switch metadata.Magic {
+	case HashMagicNumber, BtreeMagicNumber:
+	case HashMagicNumberBE, BtreeMagicNumberBE:
+		metadata.Swapped = true
+		err := binary.Read(bytes.NewReader(data), binary.BigEndian, &metadata.GenericMetadataPage)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to unpack GenericMetadataPage: %w", err)
+		}
+	default:
+		return nil, xerrors.Errorf("unexpected DB magic number: %+v", metadata.Magic)
+	}
+
+	return &metadata, nil
+}
+
+func (m *Metadata) IsHash() bool {
+	return m.Magic == HashMagicNumber
+}
+
+func (m *Metadata) IsBtree() bool {
+	return m.Magic == BtreeMagicNumber
+}
+
+func (m *Metadata) ByteOrder() binary.ByteOrder {
+	return byteOrder(m.Swapped)
+}
@@ -0,0 +1,108 @@
+package bdb
+
+import (
+	"golang.org/x/xerrors"
+)
+
+/* The hash access method stores a pair on the pages of the bucket its key
+   hashes to. Buckets are added one at a time as the table grows, so a hash
+   is masked with HighMask, or with LowMask if that bucket was not split yet.
+   The pages of the buckets are allocated in doublings, and Spares holds how
+   far each doubling is shifted by the pages allocated in between.
+
+   The hash function is not recorded, but CharKeyHash is the hash of CHARKEY,
+   which tells the functions Berkeley DB has shipped apart.
+
+   https://github.com/berkeleydb/libdb/blob/v5.3.28/src/hash/hash_func.c
+   https://github.com/berkeleydb/libdb/blob/v5.3.28/src/dbinc/hash.h
+*/
+
+// charKey is CHARKEY, including the terminating NUL that sizeof counts.
+const charKey = "%$sniglet^&\x00"
+
+// HashFunc is a hash function of the hash access method.
+type HashFunc func(key []byte) uint32
+
+// hashFuncs are the hash functions of Berkeley DB. hashFunc5 is the default
+// since version 5 of the hash format, and hashFunc4 before that.
+var hashFuncs = []HashFunc{hashFunc5, hashFunc4, hashFunc3, hashFunc2}
+
+// hashFunc5 is __ham_func5, a Fowler/Noll/Vo hash.
+func hashFunc5(key []byte) uint32 {
+	var h uint32
+	for _, c := range key {
+		h *= 16777619
+		h ^= uint32(c)
+	}
+	return h
+}
+
+// hashFunc4 is __ham_func4, Chris Torek's hash.
+func hashFunc4(key []byte) uint32 {
+	var h uint32
+	for _, c := range key {
+		h = (h << 5) + h + uint32(c)
+	}
+	return h
+}
+
+// hashFunc3 is __ham_func3, Ozan Yigit's hash.
+func hashFunc3(key []byte) uint32 {
+	var h uint32
+	for _, c := range key {
+		h = uint32(c) + 65599*h
+	}
+	return h
+}
+
+// hashFunc2 is __ham_func2, Phong Vo's linear congruential hash.
+func hashFunc2(key []byte) uint32 {
+	var h uint32
+	for _, c := range key {
+		h = 0x63c63cd9*h + 0x9c39c33d + uint32(c)
+	}
+	return h
+}
+
+// HashFunc returns the hash function the database was created with, which is
+// the one that hashes CHARKEY to CharKeyHash.
+func (p *HashMetadata) HashFunc() (HashFunc, error) {
+	for _, fn := range hashFuncs {
+		if fn([]byte(charKey)) == p.CharKeyHash {
+			return fn, nil
+		}
+	}
+	return nil, xerrors.Errorf("unknown hash function: hash(CHARKEY) is %#x", p.CharKeyHash)
+}
+
+// BucketPage returns the first page of the bucket that keys with the given
+// hash are stored in.
+// ref. __ham_call_hash and BS_TO_PAGE
+func (p *HashMetadata) BucketPage(hash uint32) (uint32, error) {
+	bucket := hash & p.HighMask
+	if bucket > p.MaxBucket {
+		bucket &= p.LowMask
+	}
+	if bucket > p.MaxBucket {
+		return 0, xerrors.Errorf("invalid hash masks: bucket %d of %d", bucket, p.MaxBucket)
+	}
+
+	spare := log2(bucket + 1)
+	if spare >= uint32(len(p.Spares)) {
+		return 0, xerrors.Errorf("bucket %d out of range", bucket)
+	}
+	pgNo := bucket + p.Spares[spare]
+	if pgNo == 0 || pgNo > p.LastPageNo {
+		return 0, xerrors.Errorf("bucket %d on page %d out of range: last page is %d", bucket, pgNo, p.LastPageNo)
+	}
+	return pgNo, nil
+}
+
+// log2 is __db_log2, the ceiling of the binary logarithm of num.
+func log2(num uint32) uint32 {
+	var i uint32
+	for limit := uint64(1); limit < uint64(num); limit <<= 1 {
+		i++
+	}
+	return i
+}
@@ -10,12 +10,13 @@ import (
 // source: https://github.com/berkeleydb/libdb/blob/5b7b02ae052442626af54c176335b67ecc613a30/src/dbinc/db_page.h#L130
 type HashMetadata struct {
 	GenericMetadataPage
-	MaxBucket   uint32 `struct:"uint32"` /* 72-75: ID of Maximum bucket in use */
-	HighMask    uint32 `struct:"uint32"` /* 76-79: Modulo mask into table */
-	LowMask     uint32 `struct:"uint32"` /* 80-83: Modulo mask into table lower half */
-	FillFactor  uint32 `struct:"uint32"` /* 84-87: Fill factor */
-	NumKeys     uint32 `struct:"uint32"` /* 88-91: Number of keys in hash table */
-	CharKeyHash uint32 `struct:"uint32"` /* 92-95: Value of hash(CHARKEY) */
+	MaxBucket   uint32     `struct:"uint32"`     /* 72-75: ID of Maximum bucket in use */
+	HighMask    uint32     `struct:"uint32"`     /* 76-79: Modulo mask into table */
+	LowMask     uint32     `struct:"uint32"`     /* 80-83: Modulo mask into table lower half */
+	FillFactor  uint32     `struct:"uint32"`     /* 84-87: Fill factor */
+	NumKeys     uint32     `struct:"uint32"`     /* 88-91: Number of keys in hash table */
+	CharKeyHash uint32     `struct:"uint32"`     /* 92-95: Value of hash(CHARKEY) */
+	Spares      [32]uint32 `struct:"[32]uint32"` /* 96-223: Spare pages for overflow */
 	// don't care about the rest...
 }
 
@@ -35,9 +36,9 @@ func ParseHashMetadataPage(data []byte) (*HashMetadataPage, error) {
 	}
 
 	if metadata.Magic == HashMagicNumberBE {
-		// Re-read the generic metadata as BigEndian
+		// Re-read the whole metadata as BigEndian
 		pageMetadata.Swapped = true
-		err := binary.Read(bytes.NewReader(data), binary.BigEndian, &metadata.GenericMetadataPage)
+		err := binary.Read(bytes.NewReader(data), binary.BigEndian, &metadata)
 		if err != nil {
 			return nil, xerrors.Errorf("failed to unpack HashMetadataPage: %w", err)
 		}
@@ -4,8 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
-	"os"
+	"math"
 
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
 	"golang.org/x/xerrors"
 )
 
@@ -31,7 +32,19 @@ func ParseHashPage(data []byte, swapped bool) (*HashPage, error) {
 	return &hashPage, nil
 }
 
-func HashPageValueContent(db *os.File, pageData []byte, hashPageIndex uint16, pageSize uint32, swapped bool) (uint32, []byte, error) {
+func HashPageValueContent(db io.ReaderAt, pageData []byte, hashPageIndex uint16, pageSize uint32, swapped bool) (uint32, []byte, error) {
+	// the size of db is not known
+	return hashPageValueContent(db, pageData, hashPageIndex, pageSize, math.MaxUint32, swapped, nil)
+}
+
+// hashPageValueContent is HashPageValueContent for a database whose last page
+// is lastPgNo, charging the value and its overflow pages to budget.
+func hashPageValueContent(db io.ReaderAt, pageData []byte, hashPageIndex uint16, pageSize, lastPgNo uint32, swapped bool,
+	budget *dbi.Budget) (uint32, []byte, error) {
+	if int(hashPageIndex)+HashOffPageSize > len(pageData) {
+		return 0, nil, xerrors.Errorf("hash value out of page bounds: %d", hashPageIndex)
+	}
+
 	// the first byte is the page type, so we can peek at it first before parsing further...
 	valuePageType := pageData[hashPageIndex]
 
@@ -47,30 +60,55 @@ func HashPageValueContent(db *os.File, pageData []byte, hashPageIndex uint16, pa
 		return 0, nil, err
 	}
 
-	var hashValue []byte
+	hashValue, err := readOverflow(db, entry.PageNo, pageSize, lastPgNo, swapped, entry.Length, budget)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return entry.PageNo, hashValue, nil
+}
 
-	for currentPageNo := entry.PageNo; currentPageNo != 0; {
-		pageStart := pageSize * currentPageNo
+// readOverflow concatenates the data of the chain of overflow pages that
+// starts at pageNo, of an item of length bytes. The chain ends once it holds
+// more than that, which also breaks cycles, or once it is longer than the
+// lastPgNo pages of the database.
+func readOverflow(db io.ReaderAt, pageNo, pageSize, lastPgNo uint32, swapped bool, length uint32, budget *dbi.Budget) ([]byte, error) {
+	if int64(length) > int64(lastPgNo)*int64(pageSize) {
+		return nil, xerrors.Errorf("overflow item at page=%d of %d bytes is larger than the database", pageNo, length)
+	}
+	if err := budget.Header(int64(length)); err != nil {
+		return nil, err
+	}
+	var hashValue []byte
 
-		_, err := db.Seek(int64(pageStart), io.SeekStart)
-		if err != nil {
-			return 0, nil, xerrors.Errorf("failed to seek to HashPageValueContent (page=%d): %w", currentPageNo, err)
+	for pages, currentPageNo := uint32(0), pageNo; currentPageNo != 0; pages++ {
+		if len(hashValue) > int(length) {
+			return nil, xerrors.Errorf("overflow chain at page=%d holds more than the %d bytes of its item", pageNo, length)
+		}
+		if pages >= lastPgNo || currentPageNo > lastPgNo {
+			return nil, xerrors.Errorf("overflow chain at page=%d runs past the last page %d", pageNo, lastPgNo)
+		}
+		if err := budget.Page(); err != nil {
+			return nil, err
 		}
 
-		currentPageBuff, err := slice(db, int(pageSize))
+		currentPageBuff, err := readPage(db, currentPageNo, pageSize)
 		if err != nil {
-			return 0, nil, xerrors.Errorf("failed to read page=%d: %w", currentPageNo, err)
+			return nil, xerrors.Errorf("failed to read page=%d: %w", currentPageNo, err)
 		}
 
 		currentPage, err := ParseHashPage(currentPageBuff, swapped)
 		if err != nil {
-			return 0, nil, xerrors.Errorf("failed to parse page=%d: %w", currentPageNo, err)
+			return nil, xerrors.Errorf("failed to parse page=%d: %w", currentPageNo, err)
 		}
 		if currentPage.PageType != OverflowPageType {
-			continue
+			return nil, xerrors.Errorf("unexpected page type in overflow chain: page=%d type=%d", currentPageNo, currentPage.PageType)
 		}
 
 		var hashValueBytes []byte
+		if PageHeaderSize+int(currentPage.FreeAreaOffset) > len(currentPageBuff) {
+			return nil, xerrors.Errorf("overflow page %d holds more than a page: %d bytes", currentPageNo, currentPage.FreeAreaOffset)
+		}
 		if currentPage.NextPageNo == 0 {
 			// this is the last page, the whole page contains content
 			hashValueBytes = currentPageBuff[PageHeaderSize : PageHeaderSize+currentPage.FreeAreaOffset]
@@ -83,10 +121,42 @@ func HashPageValueContent(db *os.File, pageData []byte, hashPageIndex uint16, pa
 		currentPageNo = currentPage.NextPageNo
 	}
 
-	return entry.PageNo, hashValue, nil
+	return hashValue, nil
+}
+
+// HashPageItem returns item i of a hash page holding entries items, starting
+// with its type byte. Items are stored back to front, so an item ends where
+// the previous one starts.
+// ref. LEN_HITEM in https://github.com/berkeleydb/libdb/blob/v5.3.28/src/dbinc/hash.h
+func HashPageItem(pageData []byte, entries uint16, i int, swapped bool) ([]byte, error) {
+	if i < 0 || i >= int(entries) || PageHeaderSize+2*int(entries) > len(pageData) {
+		return nil, xerrors.Errorf("invalid hash item %d of %d", i, entries)
+	}
+
+	order := byteOrder(swapped)
+	start := int(order.Uint16(pageData[PageHeaderSize+2*i:]))
+	end := len(pageData)
+	if i > 0 {
+		end = int(order.Uint16(pageData[PageHeaderSize+2*(i-1):]))
+	}
+	if start < PageHeaderSize+2*int(entries) || start >= end || end > len(pageData) {
+		return nil, xerrors.Errorf("invalid hash item %d: offsets %d-%d", i, start, end)
+	}
+	return pageData[start:end], nil
 }
 
 func HashPageValueIndexes(data []byte, entries uint16, swapped bool) ([]uint16, error) {
+	// skip over keys and only keep values
+	return hashPageIndexes(data, entries, swapped, HashIndexEntrySize)
+}
+
+// HashPageKeyIndexes is like HashPageValueIndexes, but returns the offsets of
+// the keys, in the same order.
+func HashPageKeyIndexes(data []byte, entries uint16, swapped bool) ([]uint16, error) {
+	return hashPageIndexes(data, entries, swapped, 0)
+}
+
+func hashPageIndexes(data []byte, entries uint16, swapped bool, start int) ([]uint16, error) {
 	order := byteOrder(swapped)
 	hashIndexValues := make([]uint16, 0)
 	if entries%2 != 0 {
@@ -94,30 +164,41 @@ func HashPageValueIndexes(data []byte, entries uint16, swapped bool) ([]uint16,
 	}
 
 	// Every entry is a 2-byte offset that points somewhere in the current database page.
-	hashIndexSize := entries * HashIndexEntrySize
+	hashIndexSize := int(entries) * HashIndexEntrySize
+	if PageHeaderSize+hashIndexSize > len(data) {
+		return nil, xerrors.Errorf("too many entries on hash page: %d", entries)
+	}
 	hashIndexData := data[PageHeaderSize : PageHeaderSize+hashIndexSize]
 
 	// data is stored in key-value pairs (https://github.com/berkeleydb/libdb/blob/5b7b02ae052442626af54c176335b67ecc613a30/src/dbinc/db_page.h#L591)
-	// skip over keys and only keep values
 	const keyValuePairSize = 2 * HashIndexEntrySize
-	for idx := range hashIndexData {
-		if (idx-HashIndexEntrySize)%keyValuePairSize == 0 {
-			value := order.Uint16(hashIndexData[idx : idx+2])
-			hashIndexValues = append(hashIndexValues, value)
-		}
+	for idx := start; idx < len(hashIndexData); idx += keyValuePairSize {
+		value := order.Uint16(hashIndexData[idx : idx+2])
+		hashIndexValues = append(hashIndexValues, value)
 	}
 
 	return hashIndexValues, nil
 }
 
-func slice(reader io.Reader, n int) ([]byte, error) {
-	newBuff := make([]byte, n)
-	numRead, err := reader.Read(newBuff)
+// HashPageKeyInstance decodes the key at hashPageIndex, which rpm sets to the
+// header number of the package.
+func HashPageKeyInstance(pageData []byte, hashPageIndex uint16, swapped bool) (uint32, error) {
+	// H_KEYDATA: the page type followed by the key itself
+	if int(hashPageIndex)+1+4 > len(pageData) {
+		return 0, xerrors.Errorf("hash key out of page bounds: %d", hashPageIndex)
+	}
+	if keyPageType := pageData[hashPageIndex]; keyPageType != HashKeyDataPageType {
+		return 0, xerrors.Errorf("only H_KEYDATA keys supported (%+v)", keyPageType)
+	}
+	return byteOrder(swapped).Uint32(pageData[hashPageIndex+1:]), nil
+}
+
+// readPage returns the page pageNo. Pages of a dbi.PageSource are not copied,
+// so the result must not be modified.
+func readPage(reader io.ReaderAt, pageNo, pageSize uint32) ([]byte, error) {
+	data, err := dbi.ReadSlice(reader, int64(pageNo)*int64(pageSize), int(pageSize))
 	if err != nil {
 		return nil, xerrors.Errorf("failed to read page: %w", err)
 	}
-	if numRead != n {
-		return nil, xerrors.Errorf("short page size: %d!=%d", n, numRead)
-	}
-	return newBuff, nil
+	return data, nil
 }
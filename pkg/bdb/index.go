@@ -0,0 +1,316 @@
+package bdb
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* Next to Packages, rpm keeps its secondary indexes, e.g. Name or Basenames,
+   in databases of their own. They map a key to an array of dbiIndexItem,
+   (header number, tag index) pairs of uint32 in the byte order of the
+   database.
+
+   https://github.com/rpm-software-management/rpm/blob/rpm-4.14.3-release/lib/backend/dbiset.c
+*/
+
+// indexItemSize is the size of an encoded dbiIndexItem.
+const indexItemSize = 8
+
+var _ dbi.IndexLookup = (*BerkeleyDB)(nil)
+
+// LookupIndex implements dbi.IndexLookup with the index database of the same
+// name next to Packages. It returns dbi.ErrNoIndex if the database was not
+// opened from a path, or there is no such index.
+func (db *BerkeleyDB) LookupIndex(ctx context.Context, index dbi.Index, key string) ([]dbi.IndexMatch, error) {
+	idx, err := db.openIndex(index)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []dbi.IndexMatch
+	collect := func(valueItem item) error {
+		return idx.itemValues(valueItem, nil, func(v []byte, _ uint32) error {
+			items, err := decodeIndexItems(v, idx.swapped)
+			if err != nil {
+				return err
+			}
+			matches = append(matches, items...)
+			return nil
+		})
+	}
+
+	if idx.BtreeMetadata != nil {
+		err = idx.searchBtree(ctx, []byte(key), collect)
+	} else {
+		err = idx.lookupHash(ctx, []byte(key), collect)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("failed to look up %s: %w", index, err)
+	}
+
+	return matches, nil
+}
+
+// ReadInstance implements dbi.IndexLookup.
+func (db *BerkeleyDB) ReadInstance(ctx context.Context, instance uint32) (dbi.Entry, error) {
+	// key 0 holds the next free instance rather than a header
+	if instance == 0 {
+		return dbi.Entry{}, xerrors.Errorf("%d: %w", instance, dbi.ErrNotFound)
+	}
+
+	key := make([]byte, 4)
+	byteOrder(db.swapped).PutUint32(key, instance)
+
+	var entry *dbi.Entry
+	read := func(valueItem item) error {
+		// the first value, if there are duplicates
+		return db.itemValues(valueItem, nil, func(value []byte, overflow uint32) error {
+			// on-page values alias the mapping of the database
+			entry = &dbi.Entry{
+				Value:                bytes.Clone(value),
+				Instance:             instance,
+				BdbFirstOverflowPgNo: overflow,
+			}
+			return errStopWalk
+		})
+	}
+
+	var err error
+	if db.BtreeMetadata != nil {
+		// integer keys need not be sorted byte-wise, so the whole tree is read
+		err = db.walkBtree(ctx, nil, db.withKey(key, read))
+	} else {
+		err = db.lookupHash(ctx, key, read)
+	}
+	if err != nil && err != errStopWalk {
+		return dbi.Entry{}, xerrors.Errorf("failed to read package %d: %w", instance, err)
+	}
+	if entry == nil {
+		return dbi.Entry{}, xerrors.Errorf("%d: %w", instance, dbi.ErrNotFound)
+	}
+
+	return *entry, nil
+}
+
+// openIndex opens the index database of the given name in the directory of
+// Packages, and keeps it open until db is closed.
+func (db *BerkeleyDB) openIndex(index dbi.Index) (*BerkeleyDB, error) {
+	if db.dir == "" && db.OpenIndexFile == nil {
+		return nil, xerrors.Errorf("%s: %w", index, dbi.ErrNoIndex)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if idx, ok := db.indexes[index]; ok {
+		return idx, nil
+	}
+
+	open := db.OpenIndexFile
+	if open == nil {
+		open = func(name string) (*os.File, error) {
+			return dbi.OpenNoFollow(filepath.Join(db.dir, name))
+		}
+	}
+	file, err := open(filepath.Base(string(index)))
+	switch {
+	case xerrors.Is(err, os.ErrNotExist):
+		return nil, xerrors.Errorf("%s: %w", index, dbi.ErrNoIndex)
+	case xerrors.Is(err, dbi.ErrSymlink):
+		// used as if it was missing, so that lookups read Packages instead
+		return nil, xerrors.Errorf("%s is a symlink: %w", index, dbi.ErrNoIndex)
+	case err != nil:
+		return nil, xerrors.Errorf("failed to open %s: %w", index, err)
+	}
+	idx, err := openFile(file)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open %s: %w", index, err)
+	}
+
+	if db.indexes == nil {
+		db.indexes = make(map[dbi.Index]*BerkeleyDB)
+	}
+	db.indexes[index] = idx
+	return idx, nil
+}
+
+// decodeIndexItems decodes an array of dbiIndexItem.
+func decodeIndexItems(data []byte, swapped bool) ([]dbi.IndexMatch, error) {
+	if len(data)%indexItemSize != 0 {
+		return nil, xerrors.Errorf("invalid index value of %d bytes", len(data))
+	}
+
+	order := byteOrder(swapped)
+	matches := make([]dbi.IndexMatch, 0, len(data)/indexItemSize)
+	for off := 0; off < len(data); off += indexItemSize {
+		matches = append(matches, dbi.IndexMatch{
+			Instance: order.Uint32(data[off:]),
+			TagIndex: order.Uint32(data[off+4:]),
+		})
+	}
+	return matches, nil
+}
+
+var errStopWalk = xerrors.New("stop walk")
+
+// item is a key or a value of a database. Items that do not fit on a page
+// are stored on a chain of overflow pages. typ is a hash item type; btree
+// items map to the hash type of the same kind.
+type item struct {
+	typ      PageType
+	data     []byte // data of an on-page item or duplicate set
+	overflow uint32 // first overflow page of an off-page item, or root of an off-page duplicate tree
+	length   uint32 // total length of an off-page item
+}
+
+// hashItem decodes an item of a hash page, see HashPageItem.
+func hashItem(raw []byte, swapped bool) (item, error) {
+	switch raw[0] {
+	case HashKeyDataPageType, HashDuplicatePageType:
+		return item{typ: raw[0], data: raw[1:]}, nil
+	case HashOffIndexPageType:
+		if len(raw) < HashOffPageSize {
+			return item{}, xerrors.Errorf("short HOFFPAGE item: %d bytes", len(raw))
+		}
+		entry, err := ParseHashOffPageEntry(raw, swapped)
+		if err != nil {
+			return item{}, err
+		}
+		return item{typ: raw[0], overflow: entry.PageNo, length: entry.Length}, nil
+	case HashOffDupPageType:
+		// type, 3 unused bytes, root page of the duplicate tree
+		if len(raw) < HashOffDupSize {
+			return item{}, xerrors.Errorf("short H_OFFDUP item: %d bytes", len(raw))
+		}
+		return item{typ: raw[0], overflow: byteOrder(swapped).Uint32(raw[4:])}, nil
+	}
+	// itemData and itemValues refuse anything else
+	return item{typ: raw[0]}, nil
+}
+
+// itemData returns the data of an item, following its overflow pages, which
+// are charged to budget. Duplicate sets hold several values, see itemValues.
+func (db *BerkeleyDB) itemData(it item, budget *dbi.Budget) ([]byte, error) {
+	switch it.typ {
+	case HashKeyDataPageType:
+		return it.data, nil
+	case HashOffIndexPageType:
+		return readOverflow(db.file, it.overflow, db.pgSize, db.lastPgNo, db.swapped, it.length, budget)
+	}
+	return nil, xerrors.Errorf("unsupported item type: %d", it.typ)
+}
+
+// withKey returns a function for walk that calls fn with the value items of
+// the pairs whose key is key.
+func (db *BerkeleyDB) withKey(key []byte, fn func(value item) error) func(key, value item) error {
+	return func(keyItem, valueItem item) error {
+		k, err := db.itemData(keyItem, nil)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(k, key) {
+			return nil
+		}
+		return fn(valueItem)
+	}
+}
+
+// lookupHash calls fn with the value items of the pairs whose key is key,
+// reading only the pages of its bucket. If the hash function is unknown, every
+// page is read instead.
+func (db *BerkeleyDB) lookupHash(ctx context.Context, key []byte, fn func(value item) error) error {
+	hashFunc, err := db.HashMetadata.HashFunc()
+	if err != nil {
+		return db.walkHash(ctx, db.withKey(key, fn))
+	}
+
+	pageNum, err := db.HashMetadata.BucketPage(hashFunc(key))
+	if err != nil {
+		return err
+	}
+	for visited := uint32(0); pageNum != 0; visited++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if visited > db.lastPgNo || pageNum > db.lastPgNo {
+			return xerrors.Errorf("invalid bucket chain at page %d", pageNum)
+		}
+
+		pageData, err := readPage(db.file, pageNum, db.pgSize)
+		if err != nil {
+			return err
+		}
+		hashPageHeader, err := ParseHashPage(pageData, db.swapped)
+		if err != nil {
+			return err
+		}
+		if hashPageHeader.PageType != HashUnsortedPageType && hashPageHeader.PageType != HashPageType {
+			return xerrors.Errorf("unexpected page type in bucket chain: page=%d type=%d", pageNum, hashPageHeader.PageType)
+		}
+
+		if err := db.hashPagePairs(pageNum, pageData, hashPageHeader, db.withKey(key, fn)); err != nil {
+			return err
+		}
+		pageNum = hashPageHeader.NextPageNo
+	}
+	return nil
+}
+
+// walkHash calls fn with the key and value items of every pair on the hash
+// pages, in page order.
+func (db *BerkeleyDB) walkHash(ctx context.Context, fn func(key, value item) error) error {
+	for pageNum := uint32(0); pageNum <= db.lastPgNo; pageNum++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		pageData, err := readPage(db.file, pageNum, db.pgSize)
+		if err != nil {
+			return err
+		}
+
+		hashPageHeader, err := ParseHashPage(pageData, db.swapped)
+		if err != nil {
+			return err
+		}
+		if hashPageHeader.PageType != HashUnsortedPageType && hashPageHeader.PageType != HashPageType {
+			continue
+		}
+
+		if err := db.hashPagePairs(pageNum, pageData, hashPageHeader, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashPagePairs calls fn with the key and value items of every pair on a hash
+// page.
+func (db *BerkeleyDB) hashPagePairs(pageNum uint32, pageData []byte, hashPageHeader *HashPage,
+	fn func(key, value item) error) error {
+	if hashPageHeader.NumEntries%2 != 0 {
+		return xerrors.Errorf("invalid hash index: entries should only come in pairs (%+v)", hashPageHeader.NumEntries)
+	}
+
+	for i := 0; i < int(hashPageHeader.NumEntries); i += 2 {
+		var pair [2]item
+		for j := range pair {
+			raw, err := HashPageItem(pageData, hashPageHeader.NumEntries, i+j, db.swapped)
+			if err == nil {
+				pair[j], err = hashItem(raw, db.swapped)
+			}
+			if err != nil {
+				return xerrors.Errorf("page %d: %w", pageNum, err)
+			}
+		}
+		if err := fn(pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package bdb
+
+import (
+	"context"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+var _ dbi.RemnantSource = (*BerkeleyDB)(nil)
+
+// UnreferencedRegions implements dbi.RemnantSource. A page is live if it is
+// the metadata page, a hash, btree or duplicate page, or on the overflow chain
+// of an item of one. Berkeley DB only rewrites the header of the pages it frees, so the
+// bodies of every other page are returned, without their page headers. The
+// bodies of consecutive pages form one region, as the pages of an overflow
+// chain are mostly allocated in order.
+func (db *BerkeleyDB) UnreferencedRegions(ctx context.Context) ([]dbi.Region, error) {
+	live := make([]bool, db.lastPgNo+1)
+	live[0] = true
+
+	// markChain marks the overflow chain of an off-page item as live
+	markChain := func(it item) error {
+		if it.typ != HashOffIndexPageType {
+			// BtreeOverflowType has the same value
+			return nil
+		}
+		for pgNo := it.overflow; pgNo != 0; {
+			if pgNo > db.lastPgNo {
+				return xerrors.Errorf("overflow page %d out of range: last page is %d", pgNo, db.lastPgNo)
+			}
+			if live[pgNo] {
+				// already followed, or a cycle
+				break
+			}
+			pageData, err := readPage(db.file, pgNo, db.pgSize)
+			if err != nil {
+				return err
+			}
+			page, err := ParseHashPage(pageData, db.swapped)
+			if err != nil {
+				return err
+			}
+			if page.PageType != OverflowPageType {
+				return xerrors.Errorf("unexpected page type in overflow chain: page=%d type=%d", pgNo, page.PageType)
+			}
+			live[pgNo] = true
+			pgNo = page.NextPageNo
+		}
+		return nil
+	}
+
+	for pgNo := uint32(1); pgNo <= db.lastPgNo; pgNo++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		pageData, err := readPage(db.file, pgNo, db.pgSize)
+		if err != nil {
+			return nil, err
+		}
+		page, err := ParseHashPage(pageData, db.swapped)
+		if err != nil {
+			return nil, err
+		}
+
+		switch page.PageType {
+		case HashUnsortedPageType, HashPageType:
+			live[pgNo] = true
+			err = db.hashPagePairs(pgNo, pageData, page, func(key, value item) error {
+				if err := markChain(key); err != nil {
+					return err
+				}
+				return markChain(value)
+			})
+		case BtreeLeafPageType, DuplicateLeafPageType, RecnoLeafPageType:
+			live[pgNo] = true
+			err = db.btreeLeafChains(pgNo, pageData, page, markChain)
+		case BtreeInternalPageType:
+			live[pgNo] = true
+			err = db.btreeInternalChains(pgNo, pageData, page, markChain)
+		case RecnoInternalPageType:
+			// its items hold no data
+			live[pgNo] = true
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("failed to follow the items of page %d: %w", pgNo, err)
+		}
+	}
+
+	var regions []dbi.Region
+	for pgNo := uint32(1); pgNo <= db.lastPgNo; pgNo++ {
+		if live[pgNo] {
+			continue
+		}
+		if live[pgNo-1] {
+			regions = append(regions, dbi.Region{})
+		}
+		region := &regions[len(regions)-1]
+
+		pageData, err := readPage(db.file, pgNo, db.pgSize)
+		if err != nil {
+			return nil, err
+		}
+		region.Extents = append(region.Extents, dbi.Extent{
+			Offset: int64(pgNo)*int64(db.pgSize) + PageHeaderSize,
+			Length: int64(db.pgSize) - PageHeaderSize,
+		})
+		region.Data = append(region.Data, pageData[PageHeaderSize:]...)
+	}
+	return regions, nil
+}
+
+// btreeLeafChains calls fn with the items of a leaf page that are not marked
+// deleted.
+func (db *BerkeleyDB) btreeLeafChains(pgNo uint32, pageData []byte, page *HashPage, fn func(it item) error) error {
+	if PageHeaderSize+HashIndexEntrySize*int(page.NumEntries) > len(pageData) {
+		return xerrors.Errorf("too many entries on btree page %d: %d", pgNo, page.NumEntries)
+	}
+	for i := 0; i < int(page.NumEntries); i++ {
+		it, deleted, err := btreeLeafItem(pageData, btreeItemOffset(pageData, i, db.swapped), db.swapped)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			continue
+		}
+		if err := fn(it); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// btreeInternalChains calls fn with the keys of an internal page.
+func (db *BerkeleyDB) btreeInternalChains(pgNo uint32, pageData []byte, page *HashPage, fn func(it item) error) error {
+	if PageHeaderSize+HashIndexEntrySize*int(page.NumEntries) > len(pageData) {
+		return xerrors.Errorf("too many entries on btree page %d: %d", pgNo, page.NumEntries)
+	}
+	for i := 0; i < int(page.NumEntries); i++ {
+		_, it, err := btreeInternalItem(pageData, btreeItemOffset(pageData, i, db.swapped), db.swapped)
+		if err != nil {
+			return err
+		}
+		if err := fn(it); err != nil {
+			return err
+		}
+	}
+	return nil
+}
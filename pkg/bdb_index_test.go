@@ -0,0 +1,860 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ZafranSecurity/go-rpmdb/pkg/bdb"
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+)
+
+type bdbPair struct {
+	key, value []byte
+}
+
+// bdbBuilder lays out the pages of a Berkeley DB database. Page 0 is the
+// metadata page.
+type bdbBuilder struct {
+	pageSize int
+	order    binary.ByteOrder
+	pages    [][]byte
+}
+
+func newBDBBuilder(pageSize int, order binary.ByteOrder) *bdbBuilder {
+	return &bdbBuilder{pageSize: pageSize, order: order, pages: [][]byte{make([]byte, pageSize)}}
+}
+
+func (b *bdbBuilder) newPage(typ byte) (uint32, []byte) {
+	page := make([]byte, b.pageSize)
+	pgno := uint32(len(b.pages))
+	b.order.PutUint32(page[8:], pgno)
+	page[25] = typ
+	b.pages = append(b.pages, page)
+	return pgno, page
+}
+
+// overflow stores data on a chain of overflow pages and returns the first.
+func (b *bdbBuilder) overflow(data []byte) uint32 {
+	var first uint32
+	var prev []byte
+	for len(data) > 0 {
+		pgno, page := b.newPage(bdb.OverflowPageType)
+		n := copy(page[bdb.PageHeaderSize:], data)
+		data = data[n:]
+		b.order.PutUint16(page[20:], 1)         // reference count
+		b.order.PutUint16(page[22:], uint16(n)) // bytes on the page
+		if prev == nil {
+			first = pgno
+		} else {
+			b.order.PutUint32(prev[16:], pgno)
+			b.order.PutUint32(page[12:], b.order.Uint32(prev[8:]))
+		}
+		prev = page
+	}
+	return first
+}
+
+// offPage stores data on overflow pages and returns its BOVERFLOW item: 2
+// unused bytes, type, 1 unused byte, first page, total length.
+func (b *bdbBuilder) offPage(data []byte) []byte {
+	it := make([]byte, bdb.BtreeOverflowSize)
+	it[2] = bdb.BtreeOverflowType
+	b.order.PutUint32(it[4:], b.overflow(data))
+	b.order.PutUint32(it[8:], uint32(len(data)))
+	return it
+}
+
+// leafItem returns the BKEYDATA item of data, length, type and data, or its
+// BOVERFLOW item if it is larger than a quarter page.
+func (b *bdbBuilder) leafItem(data []byte) []byte {
+	if 3+len(data) > b.pageSize/4 {
+		return b.offPage(data)
+	}
+	it := make([]byte, 3+len(data))
+	b.order.PutUint16(it, uint16(len(data)))
+	it[2] = bdb.BtreeKeyDataType
+	copy(it[3:], data)
+	return it
+}
+
+// internalItem returns the BINTERNAL item of a child page: length, type, 1
+// unused byte, child page, record count, data.
+func (b *bdbBuilder) internalItem(child uint32, key []byte) []byte {
+	typ := bdb.BtreeKeyDataType
+	if bdb.BtreeInternalSize+len(key) > b.pageSize/4 {
+		typ, key = bdb.BtreeOverflowType, b.offPage(key)
+	}
+	it := make([]byte, bdb.BtreeInternalSize+len(key))
+	b.order.PutUint16(it, uint16(len(key)))
+	it[2] = typ
+	b.order.PutUint32(it[4:], child)
+	copy(it[bdb.BtreeInternalSize:], key)
+	return it
+}
+
+// addItem adds an item to a page that has room for it, and reports whether
+// it had.
+func (b *bdbBuilder) addItem(page, it []byte) bool {
+	entries := int(b.order.Uint16(page[20:]))
+	free := int(b.order.Uint16(page[22:]))
+	if bdb.PageHeaderSize+2*(entries+1) > free-len(it) {
+		return false
+	}
+	free -= len(it)
+	copy(page[free:], it)
+	b.order.PutUint16(page[bdb.PageHeaderSize+2*entries:], uint16(free))
+	b.order.PutUint16(page[20:], uint16(entries+1))
+	b.order.PutUint16(page[22:], uint16(free))
+	return true
+}
+
+// duplicates stores values on the linked P_LDUP pages of an off-page
+// duplicate tree, under a P_IBTREE page if there is more than one, and
+// returns its root.
+func (b *bdbBuilder) duplicates(values [][]byte) uint32 {
+	var leaves []uint32
+	var firsts [][]byte
+	var page []byte
+	for _, value := range values {
+		it := b.leafItem(value)
+		if page == nil || !b.addItem(page, it) {
+			pgno, next := b.newPage(bdb.DuplicateLeafPageType)
+			next[24] = 1
+			b.order.PutUint16(next[22:], uint16(b.pageSize))
+			if page != nil {
+				b.order.PutUint32(page[16:], pgno)
+				b.order.PutUint32(next[12:], b.order.Uint32(page[8:]))
+			}
+			page = next
+			leaves, firsts = append(leaves, pgno), append(firsts, value)
+			b.addItem(page, it)
+		}
+	}
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+
+	root, page := b.newPage(bdb.BtreeInternalPageType)
+	page[24] = 2
+	b.order.PutUint16(page[22:], uint16(b.pageSize))
+	for i, leaf := range leaves {
+		// the first key of a page is left out
+		var key []byte
+		if i > 0 {
+			key = firsts[i]
+		}
+		b.addItem(page, b.internalItem(leaf, key))
+	}
+	return root
+}
+
+// bytes fills in the generic metadata and returns the database.
+func (b *bdbBuilder) bytes(magic uint32, typ byte) []byte {
+	meta := b.pages[0]
+	b.order.PutUint32(meta[12:], magic)
+	b.order.PutUint32(meta[16:], 9) // version
+	b.order.PutUint32(meta[20:], uint32(b.pageSize))
+	meta[25] = typ
+	b.order.PutUint32(meta[32:], uint32(len(b.pages)-1))
+	return lo.Flatten(b.pages)
+}
+
+// fnvHash is Berkeley DB's default hash function.
+func fnvHash(key []byte) uint32 {
+	var h uint32
+	for _, c := range key {
+		h = h*16777619 ^ uint32(c)
+	}
+	return h
+}
+
+// bdbHash builds a Berkeley DB hash database with the default hash function.
+func bdbHash(t *testing.T, pageSize int, order binary.ByteOrder, pairs []bdbPair) []byte {
+	t.Helper()
+	return bdbHashWith(t, pageSize, order, fnvHash, pairs)
+}
+
+// bdbHashWith builds a Berkeley DB hash database, with a bucket for every ten
+// keys. The first page of each bucket follows the metadata page, and pages
+// added to a full bucket go at the end. Like Berkeley DB does, items larger
+// than a quarter page are moved to overflow pages, and the values of pairs
+// with the same key are kept together as duplicates, moved to an off-page
+// duplicate tree if they take more than a quarter page.
+func bdbHashWith(t *testing.T, pageSize int, order binary.ByteOrder, hash func([]byte) uint32,
+	pairs []bdbPair) []byte {
+	t.Helper()
+	b := newBDBBuilder(pageSize, order)
+
+	var keys [][]byte
+	values := make(map[string][][]byte)
+	for _, pair := range pairs {
+		if _, ok := values[string(pair.key)]; !ok {
+			keys = append(keys, pair.key)
+		}
+		values[string(pair.key)] = append(values[string(pair.key)], pair.value)
+	}
+
+	maxBucket := uint32(max(1, len(keys)/10))
+	highMask := uint32(1)
+	for highMask < maxBucket {
+		highMask = highMask<<1 | 1
+	}
+	lowMask := highMask >> 1
+
+	type bucket struct {
+		page []byte
+		free int
+	}
+	buckets := make([]bucket, maxBucket+1)
+	for i := range buckets {
+		_, page := b.newPage(bdb.HashPageType)
+		order.PutUint16(page[22:], uint16(pageSize))
+		buckets[i] = bucket{page: page, free: pageSize}
+	}
+
+	// H_OFFPAGE: type, 3 unused bytes, first overflow page, total length
+	item := func(data []byte) []byte {
+		if 1+len(data) <= pageSize/4 {
+			return append([]byte{bdb.HashKeyDataPageType}, data...)
+		}
+
+		off := make([]byte, bdb.HashOffPageSize)
+		off[0] = bdb.HashOffIndexPageType
+		order.PutUint32(off[4:], b.overflow(data))
+		order.PutUint32(off[8:], uint32(len(data)))
+		return off
+	}
+	// H_DUPLICATE: type, then every value between copies of its length, or
+	// H_OFFDUP: type, 3 unused bytes, root of the duplicate tree
+	duplicates := func(values [][]byte) []byte {
+		dup := []byte{bdb.HashDuplicatePageType}
+		for _, v := range values {
+			n := make([]byte, 2)
+			order.PutUint16(n, uint16(len(v)))
+			dup = append(append(append(dup, n...), v...), n...)
+		}
+		if len(dup) <= pageSize/4 {
+			return dup
+		}
+
+		off := make([]byte, bdb.HashOffDupSize)
+		off[0] = bdb.HashOffDupPageType
+		order.PutUint32(off[4:], b.duplicates(values))
+		return off
+	}
+
+	for _, k := range keys {
+		n := hash(k) & highMask
+		if n > maxBucket {
+			n &= lowMask
+		}
+		bk := &buckets[n]
+		key := item(k)
+		value := item(values[string(k)][0])
+		if len(values[string(k)]) > 1 {
+			value = duplicates(values[string(k)])
+		}
+
+		entries := int(order.Uint16(bk.page[20:]))
+		if bdb.PageHeaderSize+2*(entries+2) > bk.free-len(key)-len(value) {
+			pgno, next := b.newPage(bdb.HashPageType)
+			order.PutUint32(bk.page[16:], pgno)
+			order.PutUint32(next[12:], order.Uint32(bk.page[8:]))
+			bk.page, bk.free, entries = next, pageSize, 0
+		}
+
+		for _, it := range [][]byte{key, value} {
+			bk.free -= len(it)
+			copy(bk.page[bk.free:], it)
+			order.PutUint16(bk.page[bdb.PageHeaderSize+2*entries:], uint16(bk.free))
+			entries++
+		}
+		order.PutUint16(bk.page[20:], uint16(entries))
+		order.PutUint16(bk.page[22:], uint16(bk.free))
+	}
+
+	meta := b.pages[0]
+	order.PutUint32(meta[72:], maxBucket)
+	order.PutUint32(meta[76:], highMask)
+	order.PutUint32(meta[80:], lowMask)
+	order.PutUint32(meta[88:], uint32(len(keys)))
+	order.PutUint32(meta[92:], hash([]byte("%$sniglet^&\x00")))
+	// spares: bucket n is on page n + 1
+	for i := 0; 1<<i <= 2*(maxBucket+1) && i < 32; i++ {
+		order.PutUint32(meta[96+4*i:], 1)
+	}
+
+	return b.bytes(bdb.HashMagicNumber, bdb.HashMetadataPageType)
+}
+
+// bdbBtree builds a Berkeley DB btree database of pairs, sorted by key.
+// Items larger than a quarter page are moved to overflow pages, and the
+// values of pairs with the same key to an off-page duplicate tree if they
+// take more than a quarter page, like Berkeley DB does.
+func bdbBtree(t *testing.T, pageSize int, order binary.ByteOrder, pairs []bdbPair) []byte {
+	t.Helper()
+	b := newBDBBuilder(pageSize, order)
+
+	pairs = slices.Clone(pairs)
+	slices.SortStableFunc(pairs, func(a, b bdbPair) int {
+		return bytes.Compare(a.key, b.key)
+	})
+
+	// the items of the leaf entries, and their keys
+	var leafItems [][][]byte
+	var leafKeys [][]byte
+	for i := 0; i < len(pairs); {
+		j, size := i, 0
+		for ; j < len(pairs) && bytes.Equal(pairs[j].key, pairs[i].key); j++ {
+			size += 3 + len(pairs[j].value)
+		}
+		if j-i > 1 && size > pageSize/4 {
+			// B_DUPLICATE: like BOVERFLOW, with the root of the duplicate tree
+			dup := make([]byte, bdb.BtreeOverflowSize)
+			dup[2] = bdb.BtreeDuplicateType
+			order.PutUint32(dup[4:], b.duplicates(lo.Map(pairs[i:j], func(p bdbPair, _ int) []byte {
+				return p.value
+			})))
+			leafItems = append(leafItems, [][]byte{b.leafItem(pairs[i].key), dup})
+			leafKeys = append(leafKeys, pairs[i].key)
+		} else {
+			for _, p := range pairs[i:j] {
+				leafItems = append(leafItems, [][]byte{b.leafItem(p.key), b.leafItem(p.value)})
+				leafKeys = append(leafKeys, p.key)
+			}
+		}
+		i = j
+	}
+
+	type node struct {
+		pgno uint32
+		key  []byte
+	}
+	// pack lays out n groups of items on pages, starting a new page whenever
+	// the next group does not fit, and returns the pages with their first keys
+	pack := func(typ, level byte, n int, group func(i int, first bool) [][]byte, key func(i int) []byte) []node {
+		var nodes []node
+		var page []byte
+		var free, entries int
+		for i := 0; i < n || page == nil; i++ {
+			first := page == nil
+			var items [][]byte
+			if i < n {
+				items = group(i, first)
+			}
+			size := 0
+			for _, it := range items {
+				size += 2 + len(it)
+			}
+			if page == nil || bdb.PageHeaderSize+2*entries+size > free {
+				pgno, next := b.newPage(typ)
+				next[24] = level
+				if page != nil && typ == bdb.BtreeLeafPageType {
+					order.PutUint32(page[16:], pgno)
+					order.PutUint32(next[12:], order.Uint32(page[8:]))
+				}
+				page, free, entries = next, pageSize, 0
+				order.PutUint16(page[22:], uint16(free))
+				if i >= n {
+					return append(nodes, node{pgno: pgno})
+				}
+				if !first && typ != bdb.BtreeLeafPageType {
+					items = group(i, true)
+				}
+				nodes = append(nodes, node{pgno: pgno, key: key(i)})
+			}
+
+			for _, it := range items {
+				free -= len(it)
+				copy(page[free:], it)
+				order.PutUint16(page[bdb.PageHeaderSize+2*entries:], uint16(free))
+				entries++
+			}
+			order.PutUint16(page[20:], uint16(entries))
+			order.PutUint16(page[22:], uint16(free))
+		}
+		return nodes
+	}
+
+	nodes := pack(bdb.BtreeLeafPageType, 1, len(leafItems), func(i int, _ bool) [][]byte {
+		return leafItems[i]
+	}, func(i int) []byte {
+		return leafKeys[i]
+	})
+	for level := byte(2); len(nodes) > 1; level++ {
+		children := nodes
+		nodes = pack(bdb.BtreeInternalPageType, level, len(children), func(i int, first bool) [][]byte {
+			// the first key of a page is left out
+			if first {
+				return [][]byte{b.internalItem(children[i].pgno, nil)}
+			}
+			return [][]byte{b.internalItem(children[i].pgno, children[i].key)}
+		}, func(i int) []byte {
+			return children[i].key
+		})
+	}
+
+	order.PutUint32(b.pages[0][88:], nodes[0].pgno) // root
+	return b.bytes(bdb.BtreeMagicNumber, bdb.BtreeMetadataPageType)
+}
+
+// indexValue encodes the dbiIndexItems of an index value.
+func indexValue(order binary.ByteOrder, items ...dbi.IndexMatch) []byte {
+	b := make([]byte, 8*len(items))
+	for i, item := range items {
+		order.PutUint32(b[8*i:], item.Instance)
+		order.PutUint32(b[8*i+4:], item.TagIndex)
+	}
+	return b
+}
+
+func TestBDBIndexes(t *testing.T) {
+	le := binary.LittleEndian
+	pairs := func(kv ...any) []bdbPair {
+		var pairs []bdbPair
+		for i := 0; i < len(kv); i += 2 {
+			pairs = append(pairs, bdbPair{key: []byte(kv[i].(string)), value: kv[i+1].([]byte)})
+		}
+		return pairs
+	}
+
+	// a value on overflow pages, mostly referring to headers that are gone
+	var stale []dbi.IndexMatch
+	for i := uint32(0); i < 1000; i++ {
+		stale = append(stale, dbi.IndexMatch{Instance: 1000 + i, TagIndex: i})
+	}
+	copying := indexValue(le, append(stale, dbi.IndexMatch{Instance: 1, TagIndex: 5})...)
+
+	// enough keys to spread over several hash pages
+	var decoys []any
+	for i := 0; i < 500; i++ {
+		decoys = append(decoys, fmt.Sprintf("decoy-%d", i),
+			indexValue(le, dbi.IndexMatch{Instance: 2000, TagIndex: 0}))
+	}
+
+	dir := t.TempDir()
+	b, err := os.ReadFile("testdata/libuuid/Packages")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Packages"), b, 0o644))
+
+	indexes := map[string][]bdbPair{
+		"Name": pairs(append(decoys,
+			"libuuid", indexValue(le, dbi.IndexMatch{Instance: 1}),
+			"util-linux", indexValue(le, dbi.IndexMatch{Instance: 7}),
+		)...),
+		"Providename": pairs(
+			"libuuid", indexValue(le, dbi.IndexMatch{Instance: 1}),
+			"libuuid.so.1()(64bit)", indexValue(le, dbi.IndexMatch{Instance: 1, TagIndex: 2}),
+		),
+		"Basenames": pairs(append(decoys,
+			"libuuid.so.1", indexValue(le, dbi.IndexMatch{Instance: 1, TagIndex: 2}),
+			"COPYING", copying,
+		)...),
+	}
+	for name, pairs := range indexes {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), bdbHash(t, 4096, le, pairs), 0o644))
+	}
+
+	// a big-endian btree index, several levels deep on small pages
+	be := binary.BigEndian
+	long := strings.Repeat("long-requirement-", 100)
+	requires := []bdbPair{
+		{key: []byte("libc.so.6()(64bit)"), value: indexValue(be, dbi.IndexMatch{Instance: 1, TagIndex: 3})},
+		{key: []byte(long), value: indexValue(be, dbi.IndexMatch{Instance: 1, TagIndex: 4})},
+	}
+	for i := 0; i < 500; i++ {
+		requires = append(requires, bdbPair{
+			key:   []byte(fmt.Sprintf("decoy-%d", i)),
+			value: indexValue(be, dbi.IndexMatch{Instance: 2000, TagIndex: uint32(i)}),
+		})
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Requirename"), bdbBtree(t, 512, be, requires), 0o644))
+
+	open := func(t *testing.T) (*RpmDB, *RpmDB) {
+		db, err := Open(filepath.Join(dir, "Packages"))
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		return db, &RpmDB{Db: indexOnlyDB{db.Db.(*bdb.BerkeleyDB)}}
+	}
+	names := func(pkgs []*PackageInfo) []string {
+		return lo.Map(pkgs, func(pkg *PackageInfo, _ int) string {
+			return pkg.Name
+		})
+	}
+
+	t.Run("indexed", func(t *testing.T) {
+		_, db := open(t)
+
+		pkg, err := db.Package("libuuid")
+		require.NoError(t, err)
+		assert.Equal(t, uint32(1), pkg.Instance)
+
+		// the index refers to a header that does not exist
+		_, err = db.Package("util-linux")
+		assert.ErrorContains(t, err, "util-linux is not installed")
+
+		pkgs, err := db.WhatProvides("libuuid.so.1()(64bit)")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"libuuid"}, names(pkgs))
+
+		pkgs, err = db.FileOwner("/usr/lib64/libuuid.so.1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"libuuid"}, names(pkgs))
+
+		pkgs, err = db.FileOwner("/usr/lib/libuuid.so.1")
+		require.NoError(t, err)
+		assert.Empty(t, pkgs)
+
+		pkgs, err = db.FileOwner("/usr/share/licenses/libuuid/COPYING")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"libuuid"}, names(pkgs))
+
+		pkgs, err = db.WhatRequires("libc.so.6()(64bit)")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"libuuid"}, names(pkgs))
+
+		pkg, err = db.PackageByInstance(1)
+		require.NoError(t, err)
+		assert.Equal(t, "libuuid", pkg.Name)
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		db, _ := open(t)
+		lookup := db.Db.(dbi.IndexLookup)
+
+		matches, err := lookup.LookupIndex(context.Background(), dbi.IndexBasenames, "COPYING")
+		require.NoError(t, err)
+		assert.Len(t, matches, len(stale)+1)
+		assert.Equal(t, dbi.IndexMatch{Instance: 1, TagIndex: 5}, matches[len(matches)-1])
+
+		for key, want := range map[string][]dbi.IndexMatch{
+			"libc.so.6()(64bit)": {{Instance: 1, TagIndex: 3}},
+			long:                 {{Instance: 1, TagIndex: 4}},
+			"decoy-0":            {{Instance: 2000, TagIndex: 0}},
+			"decoy-250":          {{Instance: 2000, TagIndex: 250}},
+			"decoy-499":          {{Instance: 2000, TagIndex: 499}},
+			"decoy-25":           {{Instance: 2000, TagIndex: 25}},
+			"decoy-2500":         nil,
+			"":                   nil,
+			"zzz":                nil,
+		} {
+			matches, err := lookup.LookupIndex(context.Background(), dbi.IndexRequirename, key)
+			require.NoError(t, err)
+			assert.Equal(t, want, matches, key)
+		}
+
+		_, err = lookup.LookupIndex(context.Background(), dbi.IndexDirnames, "/usr/lib64/")
+		assert.ErrorIs(t, err, dbi.ErrNoIndex)
+	})
+
+	t.Run("symlinked index", func(t *testing.T) {
+		linked := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(linked, "Packages"), b, 0o644))
+		if err := os.Symlink(filepath.Join(dir, "Name"), filepath.Join(linked, "Name")); err != nil {
+			t.Skipf("symlinks are not supported: %s", err)
+		}
+		db, err := Open(filepath.Join(linked, "Packages"))
+		require.NoError(t, err)
+		defer db.Close()
+
+		_, err = db.Db.(dbi.IndexLookup).LookupIndex(context.Background(), dbi.IndexName, "libuuid")
+		assert.ErrorIs(t, err, dbi.ErrNoIndex)
+		pkg, err := db.Package("libuuid")
+		require.NoError(t, err)
+		assert.Equal(t, "libuuid", pkg.Name)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		// only Packages, without any indexes
+		bare := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(bare, "Packages"), b, 0o644))
+		db, err := Open(filepath.Join(bare, "Packages"))
+		require.NoError(t, err)
+		defer db.Close()
+
+		pkgs, err := db.WhatRequires("libc.so.6()(64bit)")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"libuuid"}, names(pkgs))
+	})
+}
+
+// countingReaderAt counts the reads of a database.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestBDBHashLookup(t *testing.T) {
+	tests := []struct {
+		name   string
+		order  binary.ByteOrder
+		hash   func([]byte) uint32
+		direct bool
+	}{
+		{name: "default", order: binary.LittleEndian, hash: fnvHash, direct: true},
+		{name: "big endian", order: binary.BigEndian, hash: fnvHash, direct: true},
+		{
+			// the default before version 5 of the hash format
+			name:  "Torek",
+			order: binary.LittleEndian,
+			hash: func(key []byte) uint32 {
+				var h uint32
+				for _, c := range key {
+					h = h*33 + uint32(c)
+				}
+				return h
+			},
+			direct: true,
+		},
+		{
+			name:  "custom",
+			order: binary.BigEndian,
+			hash: func(key []byte) uint32 {
+				return uint32(len(key))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := func(instance uint32) []byte {
+				k := make([]byte, 4)
+				tt.order.PutUint32(k, instance)
+				return k
+			}
+			value := func(instance uint32) []byte {
+				v := []byte(fmt.Sprintf("header %d", instance))
+				if instance%100 == 0 {
+					// on overflow pages
+					v = bytes.Repeat(v, 500)
+				}
+				return v
+			}
+
+			var pairs []bdbPair
+			for instance := uint32(1); instance <= 1000; instance++ {
+				pairs = append(pairs, bdbPair{key: key(instance), value: value(instance)})
+			}
+			data := bdbHashWith(t, 4096, tt.order, tt.hash, pairs)
+			reader := &countingReaderAt{r: bytes.NewReader(data)}
+			db, err := bdb.OpenReaderAt(reader, int64(len(data)))
+			require.NoError(t, err)
+			defer db.Close()
+
+			_, err = db.HashMetadata.HashFunc()
+			assert.Equal(t, tt.direct, err == nil)
+
+			for _, instance := range []uint32{1, 2, 500, 999, 1000} {
+				reader.reads = 0
+				entry, err := db.ReadInstance(context.Background(), instance)
+				require.NoError(t, err)
+				assert.Equal(t, value(instance), entry.Value)
+				assert.Equal(t, instance, entry.Instance)
+				assert.Equal(t, instance%100 == 0, entry.BdbFirstOverflowPgNo != 0)
+
+				if tt.direct {
+					// the bucket, and the overflow pages of the value
+					assert.LessOrEqual(t, reader.reads, 1+len(entry.Value)/4000+1)
+				}
+			}
+
+			reader.reads = 0
+			_, err = db.ReadInstance(context.Background(), 1001)
+			assert.ErrorIs(t, err, dbi.ErrNotFound)
+			if tt.direct {
+				assert.Equal(t, 1, reader.reads)
+			} else {
+				assert.Equal(t, len(data)/4096, reader.reads)
+			}
+		})
+	}
+}
+
+func TestBDBBtree(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	db, err := Open(file)
+	require.NoError(t, err)
+	want := listPackages(t, db)
+	sort.Slice(want, func(i, j int) bool {
+		return want[i].Instance < want[j].Instance
+	})
+
+	source, err := ndb.Open(file)
+	require.NoError(t, err)
+	defer source.Close()
+	var headers []dbi.Entry
+	for entry := range source.Read() {
+		require.NoError(t, entry.Err)
+		headers = append(headers, dbi.Entry{Value: bytes.Clone(entry.Value), Instance: entry.Instance})
+	}
+
+	tests := []struct {
+		name     string
+		pageSize int
+		order    binary.ByteOrder
+	}{
+		{name: "little endian", pageSize: 4096, order: binary.LittleEndian},
+		{name: "big endian", pageSize: 4096, order: binary.BigEndian},
+		// deeper trees, with every header on overflow pages
+		{name: "small pages", pageSize: 512, order: binary.BigEndian},
+		// most headers fit on the leaf pages
+		{name: "large pages", pageSize: 65536, order: binary.LittleEndian},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := func(instance uint32) []byte {
+				k := make([]byte, 4)
+				tt.order.PutUint32(k, instance)
+				return k
+			}
+			// key 0 holds the next free instance
+			pairs := []bdbPair{{key: key(0), value: key(want[len(want)-1].Instance + 1)}}
+			for _, header := range headers {
+				pairs = append(pairs, bdbPair{key: key(header.Instance), value: header.Value})
+			}
+
+			path := filepath.Join(t.TempDir(), "Packages")
+			require.NoError(t, os.WriteFile(path, bdbBtree(t, tt.pageSize, tt.order, pairs), 0o644))
+
+			format, err := DetectFormat(path)
+			require.NoError(t, err)
+			assert.Equal(t, FormatBDBBtree, format.Kind)
+			assert.Equal(t, tt.order == binary.BigEndian, format.BDB.Swapped)
+
+			db, err := OpenWithFormat(path, FormatBDBBtree)
+			require.NoError(t, err)
+			got := listPackages(t, db)
+			// keys are sorted byte-wise rather than by instance
+			sort.Slice(got, func(i, j int) bool {
+				return got[i].Instance < got[j].Instance
+			})
+			for _, pkg := range got {
+				if tt.pageSize < 65536 {
+					assert.NotZero(t, pkg.BdbFirstOverflowPgNo, pkg.Name)
+				}
+				pkg.BdbFirstOverflowPgNo = 0
+			}
+			assert.Equal(t, want, got)
+
+			db, err = Open(path)
+			require.NoError(t, err)
+			defer db.Close()
+			pkg, err := db.PackageByInstance(want[3].Instance)
+			require.NoError(t, err)
+			assert.Equal(t, want[3].Name, pkg.Name)
+
+			_, err = db.PackageByInstance(0)
+			assert.ErrorContains(t, err, "no package with instance 0")
+		})
+	}
+}
+
+func TestBDBValueItems(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	db, err := Open(file)
+	require.NoError(t, err)
+	want := listPackages(t, db)
+	headers := ndbHeaders(t, file)
+
+	t.Run("on-page headers", func(t *testing.T) {
+		for _, pageSize := range []int{32768, 65536} {
+			order := binary.LittleEndian
+			next := make([]byte, 4)
+			order.PutUint32(next, headers[len(headers)-1].Instance+1)
+			// key 0 holds the next free instance
+			pairs := append([]bdbPair{{key: make([]byte, 4), value: next}}, instancePairs(headers, order)...)
+			data := bdbHash(t, pageSize, order, pairs)
+
+			db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+			require.NoError(t, err)
+			got := listPackages(t, db)
+			var onPage int
+			for _, pkg := range got {
+				if pkg.BdbFirstOverflowPgNo == 0 {
+					onPage++
+				}
+				pkg.BdbFirstOverflowPgNo = 0
+			}
+			assert.NotZero(t, onPage, "page size %d", pageSize)
+			assert.ElementsMatch(t, want, got, "page size %d", pageSize)
+		}
+	})
+
+	key := func(order binary.ByteOrder, instance uint32) []byte {
+		k := make([]byte, 4)
+		order.PutUint32(k, instance)
+		return k
+	}
+	values := map[uint32][][]byte{
+		// on the page
+		1: {[]byte("one-a"), []byte("one-b"), []byte("one-c")},
+		// on several duplicate pages
+		2: lo.Times(300, func(i int) []byte {
+			return []byte(fmt.Sprintf("two-%03d-%s", i, strings.Repeat("x", 32)))
+		}),
+		// on a duplicate page, one of them on overflow pages
+		3: {[]byte("three-a"), bytes.Repeat([]byte("three-b"), 500), []byte("three-c")},
+		4: {[]byte("four")},
+	}
+
+	tests := []struct {
+		name     string
+		pageSize int
+		order    binary.ByteOrder
+		build    func(t *testing.T, pageSize int, order binary.ByteOrder, pairs []bdbPair) []byte
+	}{
+		{name: "hash", pageSize: 4096, order: binary.LittleEndian, build: bdbHash},
+		{name: "hash big endian", pageSize: 1024, order: binary.BigEndian, build: bdbHash},
+		{name: "btree", pageSize: 1024, order: binary.BigEndian, build: bdbBtree},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs := []bdbPair{{key: key(tt.order, 0), value: key(tt.order, 5)}}
+			for instance := uint32(1); instance <= 4; instance++ {
+				for _, v := range values[instance] {
+					pairs = append(pairs, bdbPair{key: key(tt.order, instance), value: v})
+				}
+			}
+			data := tt.build(t, tt.pageSize, tt.order, pairs)
+			db, err := bdb.OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+			require.NoError(t, err)
+
+			for _, read := range []func(context.Context) <-chan dbi.Entry{db.ReadContext, db.SalvageContext} {
+				got := make(map[uint32][][]byte)
+				for entry := range read(context.Background()) {
+					require.NoError(t, entry.Err)
+					got[entry.Instance] = append(got[entry.Instance], entry.Value)
+				}
+				assert.Equal(t, values, got)
+			}
+
+			entry, err := db.ReadInstance(context.Background(), 2)
+			require.NoError(t, err)
+			assert.Equal(t, values[2][0], entry.Value)
+
+			// the duplicate pages are live
+			regions, err := db.UnreferencedRegions(context.Background())
+			require.NoError(t, err)
+			assert.Empty(t, regions)
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package rpmdb
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/sqlite3"
+	"golang.org/x/xerrors"
+)
+
+// Consistency selects how OpenWithOptions guards against reading a database
+// while rpm is writing to it.
+type Consistency int
+
+const (
+	// ConsistencyNone reads the database as it is, like Open.
+	ConsistencyNone Consistency = iota
+	// ConsistencyLock holds a shared lock on rpm's transaction lock file,
+	// .rpm.lock next to the database, until the database is closed. rpm
+	// waits for the lock before changing the database, so no transaction can
+	// run while the database is open.
+	ConsistencyLock
+	// ConsistencySnapshot copies the database into memory and reads the copy.
+	// The transaction lock is only held while copying, if the lock file
+	// exists, and the copy is retried until the file did not change while it
+	// was being read.
+	ConsistencySnapshot
+)
+
+// DefaultLockTimeout is used when OpenOptions.LockTimeout is zero.
+const DefaultLockTimeout = 30 * time.Second
+
+// rpmLockFile is the name of rpm's transaction lock, in the database directory.
+const rpmLockFile = ".rpm.lock"
+
+// statFile is replaced in tests to simulate a database that changes.
+var statFile = os.Stat
+
+// ErrInconsistent is returned by OpenWithOptions when it could not get a
+// consistent view of the database.
+var ErrInconsistent = xerrors.New("no consistent view of the rpm database")
+
+// OpenOptions controls how OpenWithOptions opens a database.
+type OpenOptions struct {
+	// Consistency selects how to read a database that rpm may be changing.
+	Consistency Consistency
+	// LockTimeout bounds how long to wait for a running rpm transaction, or
+	// for a snapshot that did not change while it was copied. Zero means
+	// DefaultLockTimeout.
+	LockTimeout time.Duration
+	// IncludeWAL applies the transactions in the write-ahead log of a SQLite
+	// database, path + "-wal", that committed but were not checkpointed into
+	// the database yet. The database is then read without a SQL driver, and
+	// neither file is written to. It has no effect on other formats.
+	IncludeWAL bool
+	// NDBValidation selects what happens to NDB blobs that fail their
+	// checksum or other validation. By default, reading them fails with an
+	// *ndb.CorruptionError.
+	NDBValidation ndb.Validation
+	// Limits bounds what reading the database may cost, for databases from
+	// untrusted sources. Exceeding a limit fails the read with a
+	// *dbi.LimitError.
+	Limits dbi.Limits
+}
+
+// OpenWithOptions is like Open, with the guarantees selected by opts. Errors
+// caused by the database not being consistent wrap ErrInconsistent.
+func OpenWithOptions(path string, opts OpenOptions) (*RpmDB, error) {
+	timeout := opts.LockTimeout
+	if timeout == 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	switch opts.Consistency {
+	case ConsistencyNone:
+		return openWithOptions(path, opts)
+	case ConsistencyLock:
+		lock, err := acquireRPMLock(path, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if lock == nil {
+			return nil, xerrors.Errorf("%s does not exist: %w",
+				filepath.Join(filepath.Dir(path), rpmLockFile), ErrInconsistent)
+		}
+
+		db, err := openWithOptions(path, opts)
+		if err != nil {
+			_ = lock.Close()
+			return nil, err
+		}
+		// closing the lock file releases the lock
+		db.closer = lock
+		return db, nil
+	case ConsistencySnapshot:
+		paths := []string{path}
+		if opts.IncludeWAL {
+			paths = append(paths, path+"-wal")
+		}
+		b, err := snapshot(paths, deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		r := bytes.NewReader(b[0])
+		format, err := DetectFormatReaderAt(r, r.Size())
+		if err != nil {
+			return nil, err
+		}
+		if opts.IncludeWAL && format.Kind == FormatSQLite3 {
+			db, err := sqlite3.OpenReaderAtWithWAL(r, r.Size(), bytes.NewReader(b[1]), int64(len(b[1])))
+			if err != nil {
+				return nil, err
+			}
+			return opts.apply(&RpmDB{Db: db}), nil
+		}
+		db, err := openReaderAtWithFormat(r, r.Size(), format.Kind)
+		if err != nil {
+			return nil, err
+		}
+		return opts.apply(db), nil
+	}
+
+	return nil, xerrors.Errorf("unknown consistency mode: %d", opts.Consistency)
+}
+
+// openWithOptions opens the database at path, with its write-ahead log if
+// opts.IncludeWAL is set.
+func openWithOptions(path string, opts OpenOptions) (*RpmDB, error) {
+	format, err := DetectFormat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.IncludeWAL || format.Kind != FormatSQLite3 {
+		db, err := OpenWithFormat(path, format.Kind)
+		if err != nil {
+			return nil, err
+		}
+		return opts.apply(db), nil
+	}
+
+	db, err := sqlite3.OpenWithWAL(path)
+	if err != nil {
+		return nil, err
+	}
+	return opts.apply(&RpmDB{Db: db}), nil
+}
+
+// apply sets the options that concern the backend of db.
+func (opts OpenOptions) apply(db *RpmDB) *RpmDB {
+	if ndbDB, ok := db.Db.(*ndb.RpmNDB); ok {
+		ndbDB.Validation = opts.NDBValidation
+	}
+	db.SetLimits(opts.Limits)
+	return db
+}
+
+// WAL reports how the write-ahead log of a SQLite database was applied. ok is
+// false unless the database was opened with OpenOptions.IncludeWAL.
+func (d *RpmDB) WAL() (status sqlite3.WALStatus, ok bool) {
+	db, isSQLite := d.Db.(*sqlite3.SQLite3)
+	if !isSQLite {
+		return sqlite3.WALStatus{}, false
+	}
+	return db.WAL()
+}
+
+// acquireRPMLock takes a shared lock on the transaction lock of the database
+// at path, waiting until deadline for a running transaction. It returns nil
+// if there is no lock file, which rpm creates on its first transaction.
+func acquireRPMLock(path string, deadline time.Time) (*os.File, error) {
+	lockPath := filepath.Join(filepath.Dir(path), rpmLockFile)
+	lock, err := os.Open(lockPath)
+	if err != nil {
+		if xerrors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, xerrors.Errorf("failed to open %s: %w", lockPath, err)
+	}
+
+	for wait := time.Millisecond; ; wait *= 2 {
+		locked, err := tryLockShared(lock)
+		if err != nil {
+			_ = lock.Close()
+			return nil, xerrors.Errorf("failed to lock %s: %s: %w", lockPath, err, ErrInconsistent)
+		}
+		if locked {
+			return lock, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			_ = lock.Close()
+			return nil, xerrors.Errorf("timed out waiting for the rpm transaction holding %s: %w", lockPath, ErrInconsistent)
+		}
+		time.Sleep(min(wait, 100*time.Millisecond, remaining))
+	}
+}
+
+// snapshot copies the files at paths into memory, retrying until deadline if
+// any of them changed while they were read. The lock is taken for the first
+// path, which must exist; the others are nil if they do not exist.
+func snapshot(paths []string, deadline time.Time) ([][]byte, error) {
+	lock, err := acquireRPMLock(paths[0], deadline)
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+
+	for wait := time.Millisecond; ; wait *= 2 {
+		contents := make([][]byte, len(paths))
+		stable := true
+		for i, path := range paths {
+			b, ok, err := readStable(path)
+			if err != nil {
+				if i > 0 && xerrors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return nil, err
+			}
+			contents[i] = b
+			stable = stable && ok
+		}
+		if stable {
+			return contents, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, xerrors.Errorf("%s kept changing while it was copied: %w", paths[0], ErrInconsistent)
+		}
+		time.Sleep(min(wait, 100*time.Millisecond, remaining))
+	}
+}
+
+// readStable reads the file at path and reports whether it did not change
+// while it was read.
+func readStable(path string) ([]byte, bool, error) {
+	before, err := statFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	after, err := statFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return b, os.SameFile(before, after) && before.ModTime().Equal(after.ModTime()) &&
+		before.Size() == after.Size() && int64(len(b)) == after.Size(), nil
+}
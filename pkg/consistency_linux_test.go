@@ -0,0 +1,73 @@
+//go:build linux
+
+package rpmdb
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRPMLockHelper holds an exclusive rpm transaction lock, like rpm does
+// while installing packages, until its stdin is closed. fcntl locks do not
+// conflict within a process, so the lock is taken by a child process.
+func TestRPMLockHelper(t *testing.T) {
+	lockPath := os.Getenv("RPMDB_TEST_LOCK")
+	if lockPath == "" {
+		t.Skip("only runs as a helper process")
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK}
+	require.NoError(t, syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock))
+
+	os.Stdout.WriteString("locked\n")
+	_, _ = io.Copy(io.Discard, os.Stdin)
+}
+
+func TestOpenWithOptions_LockTimeout(t *testing.T) {
+	p := copyDB(t, "testdata/sle15-bci/Packages.db", true)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRPMLockHelper$")
+	cmd.Env = append(os.Environ(), "RPMDB_TEST_LOCK="+filepath.Join(filepath.Dir(p), rpmLockFile))
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "locked\n", line)
+
+	for _, consistency := range []Consistency{ConsistencyLock, ConsistencySnapshot} {
+		start := time.Now()
+		_, err = OpenWithOptions(p, OpenOptions{
+			Consistency: consistency,
+			LockTimeout: 300 * time.Millisecond,
+		})
+		require.ErrorIs(t, err, ErrInconsistent)
+		assert.Contains(t, err.Error(), "timed out waiting for the rpm transaction")
+		assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	}
+
+	// the transaction finishes while we wait
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		stdin.Close()
+	}()
+	db, err := OpenWithOptions(p, OpenOptions{Consistency: ConsistencyLock})
+	require.NoError(t, err)
+	assert.NotEmpty(t, listPackages(t, db))
+}
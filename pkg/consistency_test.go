@@ -0,0 +1,220 @@
+package rpmdb
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ZafranSecurity/go-rpmdb/pkg/sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyDB copies the database file into a new directory, optionally next to an
+// rpm transaction lock file.
+func copyDB(t *testing.T, file string, withLock bool) string {
+	t.Helper()
+
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	p := filepath.Join(dir, filepath.Base(file))
+	require.NoError(t, os.WriteFile(p, b, 0o644))
+	if withLock {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, rpmLockFile), nil, 0o644))
+	}
+	return p
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	modes := []struct {
+		name        string
+		consistency Consistency
+	}{
+		{name: "lock", consistency: ConsistencyLock},
+		{name: "snapshot", consistency: ConsistencySnapshot},
+	}
+	for _, tt := range readerTests {
+		db, err := Open(tt.file)
+		require.NoError(t, err)
+		want := listPackages(t, db)
+
+		for _, mode := range modes {
+			t.Run(tt.name+"/"+mode.name, func(t *testing.T) {
+				p := copyDB(t, tt.file, true)
+
+				db, err := OpenWithOptions(p, OpenOptions{Consistency: mode.consistency})
+				require.NoError(t, err)
+				assert.Equal(t, want, listPackages(t, db))
+			})
+		}
+	}
+}
+
+func TestOpenWithOptions_Inconsistent(t *testing.T) {
+	t.Run("no lock file", func(t *testing.T) {
+		p := copyDB(t, "testdata/libuuid/Packages", false)
+
+		_, err := OpenWithOptions(p, OpenOptions{Consistency: ConsistencyLock})
+		assert.ErrorIs(t, err, ErrInconsistent)
+
+		// a snapshot does not need the lock
+		db, err := OpenWithOptions(p, OpenOptions{Consistency: ConsistencySnapshot})
+		require.NoError(t, err)
+		assert.NotEmpty(t, listPackages(t, db))
+	})
+
+	t.Run("changing database", func(t *testing.T) {
+		p := copyDB(t, "testdata/libuuid/Packages", true)
+
+		// every stat sees a newer modification time
+		mtime := time.Now()
+		statFile = func(name string) (os.FileInfo, error) {
+			mtime = mtime.Add(time.Second)
+			if err := os.Chtimes(name, mtime, mtime); err != nil {
+				return nil, err
+			}
+			return os.Stat(name)
+		}
+		defer func() { statFile = os.Stat }()
+
+		_, err := OpenWithOptions(p, OpenOptions{
+			Consistency: ConsistencySnapshot,
+			LockTimeout: 200 * time.Millisecond,
+		})
+		require.ErrorIs(t, err, ErrInconsistent)
+		assert.Contains(t, err.Error(), "kept changing")
+	})
+}
+
+// walDB returns the path of a copy of the rpmdb.sqlite fixture in WAL mode,
+// with each of the statements run in its own transaction and still in the
+// write-ahead log.
+func walDB(t *testing.T, statements ...string) string {
+	t.Helper()
+
+	p := copyDB(t, "testdata/cbl-mariner-2.0/rpmdb.sqlite", false)
+	db, err := sql.Open("sqlite", p)
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range append([]string{"PRAGMA journal_mode=WAL", "PRAGMA wal_autocheckpoint=0"}, statements...) {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+
+	// closing the database checkpoints the log, so copy it while it is open
+	dir := t.TempDir()
+	for _, name := range []string{p, p + "-wal"} {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, filepath.Base(name)), b, 0o644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, rpmLockFile), nil, 0o644))
+	return filepath.Join(dir, filepath.Base(p))
+}
+
+func TestOpenWithOptions_WAL(t *testing.T) {
+	const deleteFirst = "DELETE FROM Packages WHERE hnum IN (SELECT hnum FROM Packages ORDER BY hnum LIMIT %d)"
+	p := walDB(t, fmt.Sprintf(deleteFirst, 2), fmt.Sprintf(deleteFirst, 1))
+
+	walInfo, err := os.Stat(p + "-wal")
+	require.NoError(t, err)
+	require.NotZero(t, walInfo.Size())
+
+	// without the log, the database is as it was before the transactions
+	db, err := Open(p)
+	require.NoError(t, err)
+	assert.Len(t, listPackages(t, db), 129)
+
+	names := func(pkgs []*PackageInfo) map[string]bool {
+		m := make(map[string]bool)
+		for _, pkg := range pkgs {
+			m[pkg.Name+"."+pkg.Arch] = true
+		}
+		return m
+	}
+	want := packageNames(t, removePackages(t, 3))
+
+	modes := []struct {
+		name        string
+		consistency Consistency
+	}{
+		{name: "none", consistency: ConsistencyNone},
+		{name: "lock", consistency: ConsistencyLock},
+		{name: "snapshot", consistency: ConsistencySnapshot},
+	}
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			db, err := OpenWithOptions(p, OpenOptions{Consistency: mode.consistency, IncludeWAL: true})
+			require.NoError(t, err)
+
+			status, ok := db.WAL()
+			require.True(t, ok)
+			assert.True(t, status.Present)
+			assert.NotZero(t, status.Applied)
+			assert.Zero(t, status.Ignored)
+
+			assert.Equal(t, want, names(listPackages(t, db)))
+		})
+	}
+
+	t.Run("unfinished transaction", func(t *testing.T) {
+		// cut off the commit frame of the second transaction
+		b, err := os.ReadFile(p + "-wal")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(p+"-wal", b[:len(b)-100], 0o644))
+
+		db, err := OpenWithOptions(p, OpenOptions{IncludeWAL: true})
+		require.NoError(t, err)
+
+		status, ok := db.WAL()
+		require.True(t, ok)
+		assert.True(t, status.Present)
+		assert.NotZero(t, status.Applied)
+		assert.NotZero(t, status.Ignored)
+
+		assert.Equal(t, packageNames(t, removePackages(t, 2)), names(listPackages(t, db)))
+	})
+
+	t.Run("corrupt log", func(t *testing.T) {
+		b, err := os.ReadFile(p + "-wal")
+		require.NoError(t, err)
+		b[len(b)/2] ^= 0xff
+		require.NoError(t, os.WriteFile(p+"-wal", b, 0o644))
+
+		db, err := OpenWithOptions(p, OpenOptions{IncludeWAL: true})
+		require.NoError(t, err)
+
+		status, ok := db.WAL()
+		require.True(t, ok)
+		assert.NotZero(t, status.Ignored)
+		assert.Less(t, len(want), len(listPackages(t, db)))
+	})
+
+	t.Run("no log", func(t *testing.T) {
+		require.NoError(t, os.Remove(p+"-wal"))
+
+		db, err := OpenWithOptions(p, OpenOptions{IncludeWAL: true})
+		require.NoError(t, err)
+
+		status, ok := db.WAL()
+		require.True(t, ok)
+		assert.Equal(t, sqlite3.WALStatus{}, status)
+		assert.Len(t, listPackages(t, db), 129)
+	})
+
+	t.Run("other formats", func(t *testing.T) {
+		db, err := OpenWithOptions("testdata/libuuid/Packages", OpenOptions{IncludeWAL: true})
+		require.NoError(t, err)
+
+		_, ok := db.WAL()
+		assert.False(t, ok)
+		assert.Len(t, listPackages(t, db), 1)
+	})
+}
@@ -0,0 +1,94 @@
+package dbi
+
+import (
+	"fmt"
+
+	"golang.org/x/xerrors"
+)
+
+// Limits bounds what reading a database from an untrusted source may cost.
+// Zero fields are not limited.
+type Limits struct {
+	// MaxHeaderSize is the size in bytes of the largest header that is read.
+	MaxHeaderSize int64
+	// MaxPages is the most pages one read of the database visits, overflow
+	// pages included. NDB counts its slot pages.
+	MaxPages int64
+	// MaxPackages is the most packages one read of the database returns.
+	MaxPackages int
+	// MaxFilesPerPackage is the most files a header may list.
+	MaxFilesPerPackage int
+	// MaxTotalBytes is the most header bytes one read of the database reads.
+	MaxTotalBytes int64
+	// MaxFileSize is the size in bytes of the largest file that is read
+	// whole, such as a decompressed container image or a database file in one
+	// of its layers.
+	MaxFileSize int64
+}
+
+// LimitError reports that reading a database exceeded one of its Limits.
+type LimitError struct {
+	// Limit is the name of the field of Limits that was exceeded.
+	Limit string
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s of %d exceeded", e.Limit, e.Max)
+}
+
+// Budget tracks one read of a database against its Limits. A nil *Budget is
+// not limited.
+type Budget struct {
+	limits Limits
+	pages  int64
+	bytes  int64
+}
+
+// NewBudget returns a budget for one read of a database, or nil if limits is
+// zero.
+func NewBudget(limits Limits) *Budget {
+	if limits == (Limits{}) {
+		return nil
+	}
+	return &Budget{limits: limits}
+}
+
+// Page counts a page that is about to be visited.
+func (b *Budget) Page() error {
+	return b.Pages(1)
+}
+
+// Pages counts n pages that are about to be visited.
+func (b *Budget) Pages(n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.pages += n
+	if b.limits.MaxPages > 0 && b.pages > b.limits.MaxPages {
+		return &LimitError{Limit: "MaxPages", Max: b.limits.MaxPages}
+	}
+	return nil
+}
+
+// Header counts a header of n bytes that is about to be read.
+func (b *Budget) Header(n int64) error {
+	if b == nil {
+		return nil
+	}
+	if b.limits.MaxHeaderSize > 0 && n > b.limits.MaxHeaderSize {
+		return &LimitError{Limit: "MaxHeaderSize", Max: b.limits.MaxHeaderSize}
+	}
+	b.bytes += n
+	if b.limits.MaxTotalBytes > 0 && b.bytes > b.limits.MaxTotalBytes {
+		return &LimitError{Limit: "MaxTotalBytes", Max: b.limits.MaxTotalBytes}
+	}
+	return nil
+}
+
+// LimitExceeded reports whether err is or wraps a *LimitError, which ends a
+// read even in salvage mode.
+func LimitExceeded(err error) bool {
+	var limitErr *LimitError
+	return xerrors.As(err, &limitErr)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package dbi
+
+import (
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+func mmap(file *os.File, size int64) ([]byte, error) {
+	return nil, xerrors.New("mmap is not supported")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,158 @@
+package dbi
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+// PageSource gives random access to the pages of a database file. Where the
+// platform supports it the file is memory mapped, so pages are sliced from
+// the mapping without a syscall or a copy. Otherwise they are read with
+// ReadAt.
+type PageSource struct {
+	r      io.ReaderAt
+	size   int64
+	data   []byte // the mapped file, nil when reading with ReadAt
+	closer io.Closer
+}
+
+// NewPageSource serves the size bytes of r with ReadAt. Closing it does not
+// close r.
+func NewPageSource(r io.ReaderAt, size int64) *PageSource {
+	return &PageSource{r: r, size: size}
+}
+
+// MapFile maps the size bytes of file into memory, falling back to ReadAt
+// where that is not possible. The PageSource takes ownership of file and
+// closes it on Close.
+//
+// A mapped file that is truncated by another process while it is being read
+// faults on access, as with any mmap.
+func MapFile(file *os.File, size int64) *PageSource {
+	data, err := mmap(file, size)
+	if err != nil {
+		data = nil
+	}
+	return &PageSource{r: file, size: size, data: data, closer: file}
+}
+
+// OpenNoFollow opens the file at path for reading like os.Open, but fails with
+// ErrSymlink if it is a symlink, as a symlink next to a database may point
+// anywhere.
+func OpenNoFollow(path string) (*os.File, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil, xerrors.Errorf("%s: %w", path, ErrSymlink)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// the file may have been replaced since Lstat
+	opened, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if !os.SameFile(info, opened) {
+		_ = file.Close()
+		return nil, xerrors.Errorf("%s changed while being opened", path)
+	}
+	return file, nil
+}
+
+// Size returns the size of the file in bytes.
+func (s *PageSource) Size() int64 {
+	return s.size
+}
+
+// Slice returns the n bytes at off. When the file is mapped the result
+// aliases the mapping, so it must not be modified nor used after Close.
+func (s *PageSource) Slice(off int64, n int) ([]byte, error) {
+	if off < 0 || n < 0 || off > s.size || int64(n) > s.size-off {
+		return nil, xerrors.Errorf("read of %d bytes at offset %d beyond end of file (%d bytes): %w",
+			n, off, s.size, io.ErrUnexpectedEOF)
+	}
+	if s.data != nil {
+		return s.data[off : off+int64(n) : off+int64(n)], nil
+	}
+	return readFull(s.r, off, n)
+}
+
+// ReadAt implements io.ReaderAt.
+func (s *PageSource) ReadAt(p []byte, off int64) (int, error) {
+	if s.data == nil {
+		return s.r.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, xerrors.Errorf("negative offset: %d", off)
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close unmaps the file and closes it if it is owned by s. Slices returned by
+// Slice must not be used afterwards.
+func (s *PageSource) Close() error {
+	var err error
+	if s.data != nil {
+		err = munmap(s.data)
+		s.data = nil
+	}
+	if s.closer != nil {
+		if cerr := s.closer.Close(); err == nil {
+			err = cerr
+		}
+		s.closer = nil
+	}
+	return err
+}
+
+// ReadSlice returns the n bytes of r at off. If r is a PageSource the result
+// may alias its mapping, see PageSource.Slice.
+func ReadSlice(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	if s, ok := r.(*PageSource); ok {
+		return s.Slice(off, n)
+	}
+	return readFull(r, off, n)
+}
+
+// ReadBytes is like ReadSlice, but the result is always a copy owned by the
+// caller, for values that outlive the PageSource.
+func ReadBytes(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	if s, ok := r.(*PageSource); ok && s.data != nil {
+		b, err := s.Slice(off, n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	}
+	return readFull(r, off, n)
+}
+
+func readFull(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, xerrors.Errorf("invalid read of %d bytes", n)
+	}
+	b := make([]byte, n)
+	read, err := r.ReadAt(b, off)
+	if read == n {
+		return b, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, xerrors.Errorf("read of %d bytes at offset %d, got %d: %w", n, off, read, err)
+}
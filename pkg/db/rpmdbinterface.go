@@ -1,9 +1,24 @@
 package dbi
 
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+)
+
 type Entry struct {
-	Value                []byte
-	Err                  error
+	Value []byte
+	Err   error
+	// Instance is rpm's header number of the package: hnum in SQLite, the
+	// package index in NDB and the hash key in Berkeley DB.
+	Instance             uint32
 	BdbFirstOverflowPgNo uint32
+	// Corruption is set if Value failed validation but was read anyway, as
+	// asked for by a lenient backend.
+	Corruption error
+	// Location is where the entry was read from, such as "page 12" or "slot
+	// 40", for diagnostics. It is set at least on entries with Err.
+	Location string
 }
 
 type RpmDBInterface interface {
@@ -12,3 +27,155 @@ type RpmDBInterface interface {
 	GetPgSize() uint32
 	GetLastPgNo() uint32
 }
+
+// ContextReader is implemented by backends that can stop reading early.
+type ContextReader interface {
+	// ReadContext is like Read, but stops producing entries and closes the
+	// channel as soon as ctx is done, so a reader can stop early without
+	// leaking the producer.
+	ReadContext(ctx context.Context) <-chan Entry
+}
+
+// Salvager is implemented by backends that can keep reading past a damaged
+// page, slot or row.
+type Salvager interface {
+	// SalvageContext is like ReadContext, but sends an entry with Err and
+	// Location for every part of the database it cannot read, and goes on
+	// with the rest.
+	SalvageContext(ctx context.Context) <-chan Entry
+}
+
+// Send delivers entry unless ctx is done first, and reports whether the
+// producer should keep going.
+func Send(ctx context.Context, entries chan<- Entry, entry Entry) bool {
+	select {
+	case entries <- entry:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Index names one of rpm's secondary indexes, which map a key to the
+// instances of the headers that contain it.
+type Index string
+
+const (
+	IndexName        Index = "Name"
+	IndexProvidename Index = "Providename"
+	IndexRequirename Index = "Requirename"
+	IndexBasenames   Index = "Basenames"
+	IndexDirnames    Index = "Dirnames"
+	// the keys of Installtid and Sigmd5 are binary: the install transaction
+	// id as a uint32 in the byte order of the database, and the raw digest.
+	// Those of Sha1header are hex strings.
+	IndexInstalltid Index = "Installtid"
+	IndexSha1header Index = "Sha1header"
+	IndexSigmd5     Index = "Sigmd5"
+
+	IndexGroup                Index = "Group"
+	IndexConflictname         Index = "Conflictname"
+	IndexObsoletename         Index = "Obsoletename"
+	IndexTriggername          Index = "Triggername"
+	IndexFiletriggername      Index = "Filetriggername"
+	IndexTransfiletriggername Index = "Transfiletriggername"
+	IndexRecommendname        Index = "Recommendname"
+	IndexSuggestname          Index = "Suggestname"
+	IndexSupplementname       Index = "Supplementname"
+	IndexEnhancename          Index = "Enhancename"
+)
+
+// Indexes are the indexes rpm 4.16 keeps, in the order rpm creates them.
+var Indexes = []Index{
+	IndexName, IndexBasenames, IndexGroup, IndexRequirename, IndexProvidename,
+	IndexConflictname, IndexObsoletename, IndexTriggername, IndexDirnames,
+	IndexInstalltid, IndexSigmd5, IndexSha1header, IndexFiletriggername,
+	IndexTransfiletriggername, IndexRecommendname, IndexSuggestname,
+	IndexSupplementname, IndexEnhancename,
+}
+
+// Binary reports whether the keys of index are binary rather than text.
+func (index Index) Binary() bool {
+	return index == IndexInstalltid || index == IndexSigmd5
+}
+
+// Array reports whether index is of an array tag, whose header adds several
+// keys to it.
+func (index Index) Array() bool {
+	switch index {
+	case IndexName, IndexGroup, IndexInstalltid, IndexSigmd5, IndexSha1header:
+		return false
+	}
+	return true
+}
+
+var (
+	// ErrNoIndex is returned by IndexLookup.LookupIndex when the database has
+	// no such index.
+	ErrNoIndex = xerrors.New("no such index")
+	// ErrNotFound is returned by IndexLookup.ReadInstance when there is no
+	// header with the instance.
+	ErrNotFound = xerrors.New("no such instance")
+	// ErrSymlink is returned by OpenNoFollow for a symlink.
+	ErrSymlink = xerrors.New("refusing to follow symlink")
+)
+
+// IndexMatch is a header that an index refers to for a key.
+type IndexMatch struct {
+	// Instance is the header number, as in Entry.Instance.
+	Instance uint32
+	// TagIndex is the position of the key in the indexed tag of the header,
+	// e.g. which of its base names it is.
+	TagIndex uint32
+}
+
+// IndexLookup is implemented by backends that can use rpm's indexes to find
+// headers without reading all of them.
+type IndexLookup interface {
+	// LookupIndex returns the headers that index refers to for key.
+	LookupIndex(ctx context.Context, index Index, key string) ([]IndexMatch, error)
+	// ReadInstance returns the entry of the header with the given instance
+	// number, as Read would.
+	ReadInstance(ctx context.Context, instance uint32) (Entry, error)
+}
+
+// Extent is a byte range of a database file.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// Region is a part of a database file that no live package refers to. Data
+// holds the bytes of Extents, in order, so that what was stored across pages
+// reads as one.
+type Region struct {
+	Extents []Extent
+	Data    []byte
+}
+
+// RemnantSource is implemented by backends that can tell which parts of the
+// database file are not reachable from the live database, where the headers
+// of erased packages may remain.
+type RemnantSource interface {
+	// UnreferencedRegions returns the unreachable parts of the file, in file
+	// order.
+	UnreferencedRegions(ctx context.Context) ([]Region, error)
+}
+
+// IndexKey is a key that a header adds to an index.
+type IndexKey struct {
+	Key []byte
+	// TagIndex is the position of the key in the indexed tag, as in
+	// IndexMatch.
+	TagIndex uint32
+}
+
+// Writer is implemented by backends that can create a database.
+type Writer interface {
+	// Put stores the header blob with the given instance, along with the
+	// keys it adds to each index.
+	Put(instance uint32, blob []byte, keys map[Index][]IndexKey) error
+	// Close finishes the database. Nothing is guaranteed to be written
+	// before it returns.
+	Close() error
+}
@@ -120,6 +120,11 @@ func HdrblobInit(data []byte) (*Hdrblob, error) {
 	if blob.il < 1 {
 		return nil, xerrors.New("region no tags error")
 	}
+	// checked before the index is allocated, and in 64 bits as pvlen may
+	// overflow
+	if size := 8 + 16*int64(blob.il) + int64(blob.dl); blob.dl < 0 || size > int64(len(data)) {
+		return nil, xerrors.Errorf("blob size(%d) BAD, 8 + 16 * il(%d) + dl(%d) exceeds %d bytes", size, blob.il, blob.dl, len(data))
+	}
 
 	blob.PeList = make([]EntryInfo, blob.il)
 	for i := 0; i < int(blob.il); i++ {
@@ -165,6 +170,9 @@ func hdrblobImport(blob Hdrblob, data []byte) ([]IndexEntry, error) {
 		if entry.Offset == 0 {
 			ril = blob.il
 		}
+		if ril < 1 {
+			return nil, xerrors.New("missing header region")
+		}
 
 		// ref. https://github.com/rpm-software-management/rpm/blob/rpm-4.14.3-release/lib/header.c#L917
 		indexEntries, rdlen, err = regionSwab(data, blob.PeList[1:ril], 0, blob.dataStart, blob.dataEnd)
@@ -410,10 +418,14 @@ func strtaglen(data []byte, count uint32, start, dataEnd int32) int {
 
 	for c := count; c > 0; c-- {
 		offset := start + int32(length)
-		if offset > int32(len(data)) {
+		if offset >= dataEnd {
+			return -1
+		}
+		n := bytes.IndexByte(data[offset:dataEnd], byte(0x00))
+		if n < 0 {
 			return -1
 		}
-		length += bytes.IndexByte(data[offset:dataEnd], byte(0x00)) + 1
+		length += n + 1
 	}
 	return length
 }
@@ -0,0 +1,181 @@
+package rpmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/ZafranSecurity/go-rpmdb/pkg/bdb"
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/lmdb"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/sqlite3"
+	"golang.org/x/xerrors"
+)
+
+// FormatKind identifies the on-disk format of an rpm database.
+type FormatKind int
+
+const (
+	FormatUnknown FormatKind = iota
+	FormatSQLite3
+	FormatNDB
+	FormatBDBHash
+	FormatBDBBtree
+	FormatLMDB
+)
+
+func (k FormatKind) String() string {
+	switch k {
+	case FormatSQLite3:
+		return "sqlite3"
+	case FormatNDB:
+		return "ndb"
+	case FormatBDBHash:
+		return "bdb-hash"
+	case FormatBDBBtree:
+		return "bdb-btree"
+	case FormatLMDB:
+		return "lmdb"
+	}
+	return "unknown"
+}
+
+// Format is the result of DetectFormat. Depending on Kind, exactly one of the
+// backend specific headers is set.
+type Format struct {
+	Kind FormatKind
+
+	// SQLite3 holds the database header, including the schema format and
+	// user_version.
+	SQLite3 *sqlite3.Header
+	// NDB holds the NDB Header, including NDBVersion and NDBGeneration.
+	NDB *ndb.Header
+	// BDB holds the metadata page of a Berkeley DB hash or btree database,
+	// including its version, page size and byte order.
+	BDB *bdb.Metadata
+	// LMDB holds the first meta page of an LMDB data.mdb, including its page
+	// size, byte order and word size.
+	LMDB *lmdb.Meta
+}
+
+var ErrUnknownFormat = xerrors.New("unknown rpm database format")
+
+// formatProbeSize is enough to hold the header of every supported format.
+const formatProbeSize = 512
+
+// DetectFormat identifies the format of the database at path by its magic
+// number, without opening it with any backend.
+func DetectFormat(path string) (*Format, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := DetectFormatReaderAt(file, info.Size())
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", path, err)
+	}
+	return format, nil
+}
+
+// DetectFormatReaderAt is like DetectFormat for a database of the given size
+// held by r.
+func DetectFormatReaderAt(r io.ReaderAt, size int64) (*Format, error) {
+	buf := make([]byte, formatProbeSize)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("failed to read header: %w", err)
+	}
+	buf = buf[:n]
+
+	switch {
+	case len(buf) == 0:
+		return nil, xerrors.Errorf("%w: empty file", ErrUnknownFormat)
+	case bytes.HasPrefix(buf, sqlite3.SQLite3_HeaderMagic) || bytes.HasPrefix(sqlite3.SQLite3_HeaderMagic, buf):
+		hdr, err := sqlite3.ParseHeader(buf)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid SQLite3 database: %w", err)
+		}
+		if hdr.VersionValid && int64(hdr.Pages)*int64(hdr.PageSize) > size {
+			return nil, xerrors.Errorf("truncated SQLite3 database: header declares %d pages of %d bytes, found %d bytes",
+				hdr.Pages, hdr.PageSize, size)
+		}
+		return &Format{Kind: FormatSQLite3, SQLite3: hdr}, nil
+	case len(buf) >= 4 && binary.LittleEndian.Uint32(buf) == ndb.NDB_HeaderMagic:
+		hdr, err := ndb.ReadHeader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, xerrors.Errorf("invalid NDB database: %w", err)
+		}
+		return &Format{Kind: FormatNDB, NDB: hdr}, nil
+	}
+
+	if meta, err := lmdb.ParseMeta(buf); err == nil {
+		return &Format{Kind: FormatLMDB, LMDB: meta}, nil
+	}
+
+	if metadata, err := bdb.ParseMetadata(buf); err == nil {
+		kind := FormatBDBHash
+		if metadata.IsBtree() {
+			kind = FormatBDBBtree
+		}
+		return &Format{Kind: kind, BDB: metadata}, nil
+	}
+
+	return nil, xerrors.Errorf("%w: no SQLite3, NDB, LMDB or Berkeley DB magic in the first %d bytes", ErrUnknownFormat, len(buf))
+}
+
+// OpenWithFormat opens the database at path with the backend for kind,
+// skipping format detection.
+func OpenWithFormat(path string, kind FormatKind) (*RpmDB, error) {
+	var db dbi.RpmDBInterface
+	var err error
+
+	switch kind {
+	case FormatSQLite3:
+		db, err = sqlite3.Open(path)
+	case FormatNDB:
+		db, err = ndb.Open(path)
+	case FormatBDBHash, FormatBDBBtree:
+		db, err = bdb.Open(path)
+	case FormatLMDB:
+		db, err = lmdb.Open(path)
+	default:
+		return nil, xerrors.Errorf("unsupported rpm database format: %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &RpmDB{Db: db}, nil
+}
+
+func openReaderAtWithFormat(r io.ReaderAt, size int64, kind FormatKind) (*RpmDB, error) {
+	var db dbi.RpmDBInterface
+	var err error
+
+	switch kind {
+	case FormatSQLite3:
+		db, err = sqlite3.OpenReaderAt(r, size)
+	case FormatNDB:
+		db, err = ndb.OpenReaderAt(r, size)
+	case FormatBDBHash, FormatBDBBtree:
+		db, err = bdb.OpenReaderAt(r, size)
+	case FormatLMDB:
+		db, err = lmdb.OpenReaderAt(r, size)
+	default:
+		return nil, xerrors.Errorf("unsupported rpm database format: %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &RpmDB{Db: db}, nil
+}
@@ -0,0 +1,153 @@
+package rpmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/ZafranSecurity/go-rpmdb/pkg/bdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want func(t *testing.T, format *Format)
+	}{
+		{
+			name: "SQLite3",
+			file: "testdata/cbl-mariner-2.0/rpmdb.sqlite",
+			want: func(t *testing.T, format *Format) {
+				assert.Equal(t, FormatSQLite3, format.Kind)
+				require.NotNil(t, format.SQLite3)
+				assert.Equal(t, uint32(4096), format.SQLite3.PageSize)
+				assert.Equal(t, uint32(4), format.SQLite3.SchemaFormat)
+				assert.Equal(t, uint32(0), format.SQLite3.UserVersion)
+				assert.Equal(t, uint32(880), format.SQLite3.Pages)
+				assert.Nil(t, format.NDB)
+				assert.Nil(t, format.BDB)
+			},
+		},
+		{
+			name: "NDB",
+			file: "testdata/sle15-bci/Packages.db",
+			want: func(t *testing.T, format *Format) {
+				assert.Equal(t, FormatNDB, format.Kind)
+				require.NotNil(t, format.NDB)
+				assert.Equal(t, uint32(0), format.NDB.NDBVersion)
+				assert.Equal(t, uint32(46), format.NDB.NDBGeneration)
+				assert.Equal(t, uint32(1), format.NDB.SlotNPages)
+				assert.Equal(t, uint32(41), format.NDB.NextPkgIndex)
+			},
+		},
+		{
+			name: "Berkeley DB hash",
+			file: "testdata/libuuid/Packages",
+			want: func(t *testing.T, format *Format) {
+				assert.Equal(t, FormatBDBHash, format.Kind)
+				require.NotNil(t, format.BDB)
+				assert.Equal(t, uint32(9), format.BDB.Version)
+				assert.Equal(t, uint32(4096), format.BDB.PageSize)
+				assert.False(t, format.BDB.Swapped)
+				assert.Equal(t, binary.LittleEndian, format.BDB.ByteOrder())
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := DetectFormat(tt.file)
+			require.NoError(t, err)
+			tt.want(t, format)
+
+			db, err := OpenWithFormat(tt.file, format.Kind)
+			require.NoError(t, err)
+			assert.NotEmpty(t, listPackages(t, db))
+		})
+	}
+}
+
+func TestDetectFormat_Btree(t *testing.T) {
+	// a big-endian btree metadata page, as written on s390x
+	page := make([]byte, 512)
+	binary.BigEndian.PutUint32(page[12:], bdb.BtreeMagicNumber)
+	binary.BigEndian.PutUint32(page[16:], 9)
+	binary.BigEndian.PutUint32(page[20:], 8192)
+	page[25] = bdb.BtreeMetadataPageType
+
+	format, err := DetectFormatReaderAt(bytes.NewReader(page), int64(len(page)))
+	require.NoError(t, err)
+	assert.Equal(t, FormatBDBBtree, format.Kind)
+	assert.True(t, format.BDB.Swapped)
+	assert.True(t, format.BDB.IsBtree())
+	assert.Equal(t, uint32(9), format.BDB.Version)
+	assert.Equal(t, uint32(8192), format.BDB.PageSize)
+}
+
+func TestDetectFormat_Errors(t *testing.T) {
+	sqlite, err := os.ReadFile("testdata/cbl-mariner-2.0/rpmdb.sqlite")
+	require.NoError(t, err)
+	ndb, err := os.ReadFile("testdata/sle15-bci/Packages.db")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+		unknown bool
+	}{
+		{
+			name:    "empty",
+			data:    []byte{},
+			wantErr: "empty file",
+			unknown: true,
+		},
+		{
+			name:    "truncated SQLite3 magic",
+			data:    sqlite[:10],
+			wantErr: "invalid SQLite3 database: truncated sqlite3 header: 10 bytes",
+		},
+		{
+			name:    "truncated SQLite3 header",
+			data:    sqlite[:64],
+			wantErr: "invalid SQLite3 database: truncated sqlite3 header: 64 bytes",
+		},
+		{
+			name:    "truncated SQLite3 database",
+			data:    sqlite[:8192],
+			wantErr: "truncated SQLite3 database: header declares 880 pages of 4096 bytes, found 8192 bytes",
+		},
+		{
+			name:    "unsupported NDB version",
+			data:    append(append(ndb[:4:4], 1, 0, 0, 0), ndb[8:64]...),
+			wantErr: "invalid NDB database: invalid or unsupported NDB format",
+		},
+		{
+			name:    "not an rpmdb",
+			data:    []byte("#!/bin/sh\necho hello\n"),
+			wantErr: "no SQLite3, NDB, LMDB or Berkeley DB magic in the first 21 bytes",
+			unknown: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DetectFormatReaderAt(bytes.NewReader(tt.data), int64(len(tt.data)))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+			assert.Equal(t, tt.unknown, xerrors.Is(err, ErrUnknownFormat))
+
+			_, err = OpenReaderAt(bytes.NewReader(tt.data), int64(len(tt.data)))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestOpenWithFormat_Unsupported(t *testing.T) {
+	_, err := OpenWithFormat("testdata/libuuid/Packages", FormatUnknown)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported rpm database format: unknown")
+}
@@ -0,0 +1,103 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ZafranSecurity/go-rpmdb/pkg/bdb"
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/sqlite3"
+)
+
+// fuzzLimits keeps the fuzz targets from spending their time on inputs that
+// claim huge headers or chains
+var fuzzLimits = dbi.Limits{
+	MaxHeaderSize:      1 << 20,
+	MaxPages:           1 << 12,
+	MaxPackages:        1 << 10,
+	MaxFilesPerPackage: 1 << 12,
+	MaxTotalBytes:      1 << 24,
+}
+
+func addSeed(f *testing.F, path string) {
+	f.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(f, err)
+	f.Add(data)
+}
+
+// fuzzRead lists and salvages the packages of db, which must not panic or
+// hang whatever the input
+func fuzzRead(t *testing.T, db dbi.RpmDBInterface) {
+	d := &RpmDB{Db: db}
+	d.SetLimits(fuzzLimits)
+	defer d.Close()
+	_, _ = d.ListPackages()
+	_, _, _ = d.SalvagePackages(context.Background(), ListOptions{})
+}
+
+func FuzzHeaderImport(f *testing.F) {
+	addSeed(f, "testdata/blob.bin")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		indexEntries, err := headerImport(data)
+		if err != nil {
+			return
+		}
+		_, _ = getNEVRA(indexEntries)
+	})
+}
+
+func FuzzBDB(f *testing.F) {
+	addSeed(f, "testdata/libuuid/Packages")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := bdb.OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		fuzzRead(t, db)
+	})
+}
+
+func FuzzNDB(f *testing.F) {
+	// a database of a single package is small enough to mutate
+	blob, err := os.ReadFile("testdata/blob.bin")
+	require.NoError(f, err)
+	path := filepath.Join(f.TempDir(), "Packages.db")
+	w, err := ndb.Create(path)
+	require.NoError(f, err)
+	require.NoError(f, w.Put(1, blob, nil))
+	require.NoError(f, w.Close())
+	addSeed(f, path)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := ndb.OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		fuzzRead(t, db)
+	})
+}
+
+// FuzzSQLiteBlob reads the Packages table with the pure Go decoder, which
+// follows the b-tree and overflow pages to each blob
+func FuzzSQLiteBlob(f *testing.F) {
+	// the schema page and a Packages page holding a single package
+	const pageSize = 8192
+	blob, err := os.ReadFile("testdata/blob.bin")
+	require.NoError(f, err)
+	f.Add(sqliteFile(pageSize, 0,
+		sqliteSchema(pageSize, 0, sqliteObject{"table", "Packages", 2}),
+		sqliteBtreePage(pageSize, 0, 2, 0x0d, 0, sqliteTableCell(1, sqliteRecord(nil, blob)))))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := sqlite3.OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		fuzzRead(t, db)
+	})
+}
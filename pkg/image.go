@@ -0,0 +1,566 @@
+package rpmdb
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// https://github.com/opencontainers/image-spec/blob/v1.1.0/layer.md#whiteouts
+	whiteoutPrefix = ".wh."
+	whiteoutMeta   = ".wh..wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Layer is one layer of a container image.
+type Layer struct {
+	// Digest is the digest of the layer blob, for example "sha256:...".
+	Digest string
+	// DiffID is the digest of the uncompressed layer, from the image config.
+	DiffID string
+	// CreatedBy is the command that created the layer, from the image history.
+	CreatedBy string
+	// Path is the location of the layer blob within the image.
+	Path string
+	// Err tells why the rpm database could not be read after this layer was
+	// applied. Its packages are then attributed to later layers.
+	Err error
+}
+
+// PackageOrigin tells which layers of an image installed a package.
+type PackageOrigin struct {
+	// Introduced is the index in Image.Layers of the first layer that had a
+	// package of the same name and architecture.
+	Introduced int
+	// Changed is the index of the last layer that changed the package, for
+	// example by upgrading or reinstalling it. It is Introduced for packages
+	// that were never changed.
+	Changed int
+}
+
+// Image is the rpm database of a container image, as seen after applying all
+// of its layers. Its packages are read through the embedded RpmDB.
+type Image struct {
+	*RpmDB
+
+	// Layers lists the layers of the image, bottom-most first.
+	Layers []Layer
+	// Discovery explains which database of the final filesystem was chosen.
+	Discovery *Discovery
+
+	origins map[string]PackageOrigin
+}
+
+// OpenImage reads the container image at path, either an OCI image layout
+// directory or a docker save tarball, optionally gzip compressed. The layers
+// are applied in order, honouring whiteouts and opaque directories, and the
+// rpm database of the result is located like OpenRoot does.
+//
+// Only the files that may hold an rpm database are kept in memory, so the
+// returned Image does not reference path once OpenImage returns.
+func OpenImage(path string) (*Image, error) {
+	return OpenImageWithOptions(path, ImageOptions{})
+}
+
+// ImageOptions controls how OpenImageWithOptions reads an image.
+type ImageOptions struct {
+	// Limits bounds what reading the image may cost, for images from
+	// untrusted sources. MaxFileSize bounds the decompressed size of a docker
+	// save tarball and the size of the database files in its layers; the
+	// other limits apply to reading the databases. Exceeding a limit fails
+	// with a *dbi.LimitError.
+	Limits dbi.Limits
+}
+
+// OpenImageWithOptions is like OpenImage, with the bounds selected by opts.
+func OpenImageWithOptions(path string, opts ImageOptions) (*Image, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return OpenImageFSWithOptions(os.DirFS(path), opts)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.ReaderAt = file
+	size := info.Size()
+
+	magic := make([]byte, len(gzipMagic))
+	if _, err := file.ReadAt(magic, 0); err == nil && bytes.Equal(magic, gzipMagic) {
+		// tar entries are read in place, which needs the archive uncompressed
+		tmp, err := os.CreateTemp("", "rpmdb-image-*.tar")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to decompress %s: %w", path, err)
+		}
+		var src io.Reader = gz
+		if limit := opts.Limits.MaxFileSize; limit > 0 {
+			src = io.LimitReader(gz, limit+1)
+		}
+		if size, err = io.Copy(tmp, src); err != nil {
+			return nil, xerrors.Errorf("failed to decompress %s: %w", path, err)
+		}
+		if limit := opts.Limits.MaxFileSize; limit > 0 && size > limit {
+			return nil, xerrors.Errorf("failed to decompress %s: %w", path,
+				&dbi.LimitError{Limit: "MaxFileSize", Max: limit})
+		}
+		r = tmp
+	}
+
+	fsys, err := newTarFS(r, size)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", path, err)
+	}
+	return OpenImageFSWithOptions(fsys, opts)
+}
+
+// OpenImageFS is like OpenImage for an OCI image layout or an extracted docker
+// save tarball held by fsys.
+func OpenImageFS(fsys fs.FS) (*Image, error) {
+	return OpenImageFSWithOptions(fsys, ImageOptions{})
+}
+
+// OpenImageFSWithOptions is like OpenImageFS, with the bounds selected by opts.
+func OpenImageFSWithOptions(fsys fs.FS, opts ImageOptions) (*Image, error) {
+	layers, err := imageLayers(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	root := newImageFS(opts.Limits)
+	var state []layerPackage
+	var current *imageNode
+
+	for i := range layers {
+		if err := applyLayerBlob(fsys, root, &layers[i]); err != nil {
+			return nil, xerrors.Errorf("layer %d (%s): %w", i, layers[i].Path, err)
+		}
+
+		node, db, _, err := root.openDB()
+		if err != nil {
+			if !xerrors.Is(err, fs.ErrNotExist) {
+				layers[i].Err = err
+				continue
+			}
+			// the database was removed
+			state, current = nil, nil
+			continue
+		}
+		if node == current {
+			_ = db.Close()
+			continue
+		}
+
+		next, err := layerPackages(db)
+		_ = db.Close()
+		if err != nil {
+			layers[i].Err = err
+			continue
+		}
+		state, current = attribute(state, next, i), node
+	}
+
+	_, db, discovery, err := root.openDB()
+	if err != nil {
+		return nil, err
+	}
+
+	origins := make(map[string]PackageOrigin, len(state))
+	for _, p := range state {
+		origins[p.nevra] = p.origin
+	}
+
+	return &Image{
+		RpmDB:     db,
+		Layers:    layers,
+		Discovery: discovery,
+		origins:   origins,
+	}, nil
+}
+
+// Origin returns the layers that installed pkg, a package of the image.
+func (img *Image) Origin(pkg *PackageInfo) (PackageOrigin, bool) {
+	origin, ok := img.origins[nevraKey(pkg)]
+	return origin, ok
+}
+
+func applyLayerBlob(fsys fs.FS, root *imageFS, layer *Layer) error {
+	f, err := fsys.Open(layer.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	digest := sha256.New()
+	br := bufio.NewReader(io.TeeReader(f, digest))
+
+	var r io.Reader = br
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case bytes.HasPrefix(magic, zstdMagic):
+		return xerrors.New("zstd compressed layers are not supported")
+	}
+
+	if err := root.applyLayer(r); err != nil {
+		return err
+	}
+	// consume any padding after the end of the archive, so the digest is complete
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return err
+	}
+
+	return checkDigest(layer, digest)
+}
+
+func checkDigest(layer *Layer, digest hash.Hash) error {
+	sum := "sha256:" + hex.EncodeToString(digest.Sum(nil))
+	if layer.Digest == "" {
+		layer.Digest = sum
+		return nil
+	}
+	if strings.HasPrefix(layer.Digest, "sha256:") && layer.Digest != sum {
+		return xerrors.Errorf("digest mismatch: expected %s, got %s", layer.Digest, sum)
+	}
+	return nil
+}
+
+// imageFS is the merged filesystem of the layers applied so far. Only the
+// content of files named like an rpm database is kept.
+type imageFS struct {
+	root    *imageNode
+	dbNames map[string]bool
+	limits  dbi.Limits
+}
+
+type imageNode struct {
+	mode     fs.FileMode
+	target   string // of symlinks
+	size     int64
+	data     []byte
+	children map[string]*imageNode // of directories
+}
+
+func newImageFS(limits dbi.Limits) *imageFS {
+	dbNames := make(map[string]bool)
+	for _, p := range DBPaths {
+		dbNames[path.Base(p)] = true
+	}
+	return &imageFS{
+		root:    &imageNode{mode: fs.ModeDir | 0o755, children: map[string]*imageNode{}},
+		dbNames: dbNames,
+		limits:  limits,
+	}
+}
+
+// layerChange is one entry of a layer.
+type layerChange struct {
+	name     string
+	whiteout bool
+	opaque   bool
+	node     *imageNode
+	link     string // target of hard links
+}
+
+func (fsys *imageFS) applyLayer(r io.Reader) error {
+	var changes []layerChange
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return xerrors.Errorf("failed to read layer: %w", err)
+		}
+
+		name := cleanLayerPath(hdr.Name)
+		if name == "." {
+			continue
+		}
+		dir, base := path.Dir(name), path.Base(name)
+
+		switch {
+		case base == whiteoutOpaque:
+			changes = append(changes, layerChange{name: dir, opaque: true})
+			continue
+		case strings.HasPrefix(base, whiteoutMeta):
+			// other AUFS metadata, e.g. hard link directories
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			changes = append(changes, layerChange{name: path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), whiteout: true})
+			continue
+		}
+
+		change := layerChange{name: name}
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			change.link = cleanLayerPath(hdr.Linkname)
+		case tar.TypeSymlink:
+			change.node = &imageNode{mode: fs.ModeSymlink | 0o777, target: hdr.Linkname}
+		default:
+			change.node = &imageNode{mode: hdr.FileInfo().Mode(), size: hdr.Size}
+			if change.node.mode.IsRegular() && fsys.dbNames[base] {
+				if limit := fsys.limits.MaxFileSize; limit > 0 && hdr.Size > limit {
+					return xerrors.Errorf("failed to read %s: %w", name,
+						&dbi.LimitError{Limit: "MaxFileSize", Max: limit})
+				}
+				if change.node.data, err = io.ReadAll(tr); err != nil {
+					return xerrors.Errorf("failed to read %s: %w", name, err)
+				}
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	// whiteouts only hide the lower layers, whatever their position in the archive
+	for _, c := range changes {
+		switch {
+		case c.whiteout:
+			fsys.remove(c.name)
+		case c.opaque:
+			if node, err := fsys.lookup(c.name); err == nil && node.mode.IsDir() {
+				node.children = map[string]*imageNode{}
+			}
+		}
+	}
+	for _, c := range changes {
+		switch {
+		case c.whiteout, c.opaque:
+		case c.link != "":
+			target, err := fsys.lookup(c.link)
+			if err != nil || !target.mode.IsRegular() {
+				// a dangling hard link, keep an empty file in its place
+				target = &imageNode{mode: 0o644}
+			}
+			fsys.add(c.name, &imageNode{mode: target.mode, size: target.size, data: target.data})
+		default:
+			fsys.add(c.name, c.node)
+		}
+	}
+
+	return nil
+}
+
+func (fsys *imageFS) add(name string, node *imageNode) {
+	parent := fsys.mkdirAll(path.Dir(name))
+	base := path.Base(name)
+
+	if old, ok := parent.children[base]; ok && old.mode.IsDir() && node.mode.IsDir() {
+		// directories are merged with the lower layers
+		old.mode = node.mode
+		return
+	}
+	if node.mode.IsDir() {
+		node.children = map[string]*imageNode{}
+	}
+	parent.children[base] = node
+}
+
+func (fsys *imageFS) mkdirAll(name string) *imageNode {
+	node := fsys.root
+	if name == "." {
+		return node
+	}
+	for _, part := range strings.Split(name, "/") {
+		child, ok := node.children[part]
+		if !ok || !child.mode.IsDir() {
+			child = &imageNode{mode: fs.ModeDir | 0o755, children: map[string]*imageNode{}}
+			node.children[part] = child
+		}
+		node = child
+	}
+	return node
+}
+
+func (fsys *imageFS) remove(name string) {
+	parent, err := fsys.lookup(path.Dir(name))
+	if err != nil || !parent.mode.IsDir() {
+		return
+	}
+	delete(parent.children, path.Base(name))
+}
+
+// lookup returns the node at name without following symlinks.
+func (fsys *imageFS) lookup(name string) (*imageNode, error) {
+	node := fsys.root
+	if name == "." {
+		return node, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		child, ok := node.children[part]
+		if !ok {
+			return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+func (fsys *imageFS) Lstat(name string) (fs.FileInfo, error) {
+	node, err := fsys.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return imageFileInfo{name: path.Base(name), node: node}, nil
+}
+
+func (fsys *imageFS) Readlink(name string) (string, error) {
+	node, err := fsys.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return node.target, nil
+}
+
+// openDB opens the database of the filesystem, like OpenRoot.
+func (fsys *imageFS) openDB() (*imageNode, *RpmDB, *Discovery, error) {
+	var chosen *imageNode
+	db, discovery, err := openRoot(fsys, func(name string) (*RpmDB, error) {
+		node, err := fsys.lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if !node.mode.IsRegular() {
+			return nil, xerrors.Errorf("%s: not a regular file", name)
+		}
+		db, err := OpenReaderAt(bytes.NewReader(node.data), int64(len(node.data)))
+		if err != nil {
+			return nil, err
+		}
+		db.SetLimits(fsys.limits)
+		chosen = node
+		return db, nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return chosen, db, discovery, nil
+}
+
+// layerPackage is a package of the database as of some layer.
+type layerPackage struct {
+	nameArch string
+	nevra    string
+	digest   string
+	origin   PackageOrigin
+}
+
+func layerPackages(db *RpmDB) ([]layerPackage, error) {
+	it := db.PackagesWithOptions(context.Background(), ListOptions{Fields: FieldNEVRA | FieldRawHeader})
+	defer it.Close()
+
+	var pkgs []layerPackage
+	for it.Next() {
+		pkg := it.Package()
+		digest := sha256.Sum256(pkg.RawHeader)
+		pkgs = append(pkgs, layerPackage{
+			nameArch: pkg.Name + "." + pkg.Arch,
+			nevra:    nevraKey(pkg),
+			digest:   string(digest[:]),
+		})
+	}
+	return pkgs, it.Err()
+}
+
+// attribute sets the origin of the packages of next, the database as of
+// layer, from the packages of the previous database. Identical headers keep
+// their origin; packages reinstalled with the same NEVRA, or upgraded to a new
+// one, were changed by layer; anything else was introduced by it.
+func attribute(prev, next []layerPackage, layer int) []layerPackage {
+	used := make([]bool, len(prev))
+	matched := make([]bool, len(next))
+
+	match := func(key func(layerPackage) string, origin func(PackageOrigin) PackageOrigin) {
+		byKey := make(map[string][]int)
+		for i, p := range prev {
+			if !used[i] {
+				byKey[key(p)] = append(byKey[key(p)], i)
+			}
+		}
+		for i := range next {
+			if matched[i] {
+				continue
+			}
+			candidates := byKey[key(next[i])]
+			if len(candidates) == 0 {
+				continue
+			}
+			j := candidates[0]
+			byKey[key(next[i])] = candidates[1:]
+			used[j], matched[i] = true, true
+			next[i].origin = origin(prev[j].origin)
+		}
+	}
+
+	unchanged := func(o PackageOrigin) PackageOrigin { return o }
+	changed := func(o PackageOrigin) PackageOrigin { return PackageOrigin{Introduced: o.Introduced, Changed: layer} }
+
+	match(func(p layerPackage) string { return p.digest }, unchanged)
+	match(func(p layerPackage) string { return p.nevra }, changed)
+	match(func(p layerPackage) string { return p.nameArch }, changed)
+
+	for i := range next {
+		if !matched[i] {
+			next[i].origin = PackageOrigin{Introduced: layer, Changed: layer}
+		}
+	}
+	return next
+}
+
+func nevraKey(pkg *PackageInfo) string {
+	return fmt.Sprintf("%s-%d:%s-%s.%s", pkg.Name, pkg.EpochNum(), pkg.Version, pkg.Release, pkg.Arch)
+}
+
+// cleanLayerPath turns the name of a tar entry into a clean path relative to
+// the root of the image, which never leaves it.
+func cleanLayerPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
@@ -0,0 +1,270 @@
+package rpmdb
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// maxIndexDepth bounds how many nested image indexes are followed.
+const maxIndexDepth = 8
+
+// https://github.com/opencontainers/image-spec/blob/v1.1.0/descriptor.md
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ociManifest holds the fields of both image manifests and image indexes.
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Config    ociDescriptor   `json:"config"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// dockerManifest is an entry of the manifest.json of a docker save tarball.
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// https://github.com/opencontainers/image-spec/blob/v1.1.0/config.md
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []struct {
+		CreatedBy  string `json:"created_by"`
+		EmptyLayer bool   `json:"empty_layer"`
+	} `json:"history"`
+}
+
+// imageLayers lists the layers of the image in fsys, bottom-most first. A
+// docker save manifest.json takes precedence over an OCI index.json, as
+// recent Docker versions write both.
+func imageLayers(fsys fs.FS) ([]Layer, error) {
+	if b, err := fs.ReadFile(fsys, "manifest.json"); err == nil {
+		return dockerLayers(fsys, b)
+	} else if !xerrors.Is(err, fs.ErrNotExist) {
+		return nil, xerrors.Errorf("failed to read manifest.json: %w", err)
+	}
+
+	b, err := fs.ReadFile(fsys, "index.json")
+	if err != nil {
+		if xerrors.Is(err, fs.ErrNotExist) {
+			return nil, xerrors.New("not an OCI image layout or docker save tarball: no index.json or manifest.json")
+		}
+		return nil, xerrors.Errorf("failed to read index.json: %w", err)
+	}
+	return ociLayers(fsys, b)
+}
+
+func dockerLayers(fsys fs.FS, b []byte) ([]Layer, error) {
+	var manifests []dockerManifest
+	if err := json.Unmarshal(b, &manifests); err != nil {
+		return nil, xerrors.Errorf("invalid manifest.json: %w", err)
+	}
+	if len(manifests) == 0 {
+		return nil, xerrors.New("manifest.json lists no images")
+	}
+	// like docker load, only the first image is used
+	manifest := manifests[0]
+
+	var layers []Layer
+	for _, name := range manifest.Layers {
+		if !fs.ValidPath(name) {
+			return nil, xerrors.Errorf("invalid layer path: %q", name)
+		}
+		layers = append(layers, Layer{Path: name})
+	}
+
+	if manifest.Config != "" {
+		if !fs.ValidPath(manifest.Config) {
+			return nil, xerrors.Errorf("invalid config path: %q", manifest.Config)
+		}
+		if err := readImageConfig(fsys, manifest.Config, layers); err != nil {
+			return nil, err
+		}
+	}
+
+	return layers, nil
+}
+
+func ociLayers(fsys fs.FS, b []byte) ([]Layer, error) {
+	var manifest ociManifest
+	for depth := 0; ; depth++ {
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, xerrors.Errorf("invalid image manifest: %w", err)
+		}
+		if len(manifest.Manifests) == 0 {
+			break
+		}
+		if depth == maxIndexDepth {
+			return nil, xerrors.New("too many nested image indexes")
+		}
+
+		// images with several manifests, e.g. one per platform, use the first
+		name, err := blobPath(manifest.Manifests[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+		b, err = fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read manifest: %w", err)
+		}
+		manifest = ociManifest{}
+	}
+
+	var layers []Layer
+	for _, desc := range manifest.Layers {
+		name, err := blobPath(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, Layer{Digest: desc.Digest, Path: name})
+	}
+
+	if manifest.Config.Digest != "" {
+		name, err := blobPath(manifest.Config.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if err := readImageConfig(fsys, name, layers); err != nil {
+			return nil, err
+		}
+	}
+
+	return layers, nil
+}
+
+// readImageConfig fills in the DiffID and CreatedBy of layers.
+func readImageConfig(fsys fs.FS, name string, layers []Layer) error {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return xerrors.Errorf("failed to read image config: %w", err)
+	}
+
+	var config imageConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return xerrors.Errorf("invalid image config: %w", err)
+	}
+
+	for i, diffID := range config.RootFS.DiffIDs {
+		if i < len(layers) {
+			layers[i].DiffID = diffID
+		}
+	}
+
+	// history has an entry for every layer, plus the empty ones
+	i := 0
+	for _, h := range config.History {
+		if h.EmptyLayer {
+			continue
+		}
+		if i < len(layers) {
+			layers[i].CreatedBy = h.CreatedBy
+		}
+		i++
+	}
+
+	return nil
+}
+
+// blobPath returns the path of the blob with the given digest in an OCI
+// image layout.
+func blobPath(digest string) (string, error) {
+	algorithm, hex, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || hex == "" || strings.ContainsAny(digest, "/\\.") {
+		return "", xerrors.Errorf("invalid digest: %q", digest)
+	}
+	return path.Join("blobs", algorithm, hex), nil
+}
+
+// tarFS is a read-only fs.FS over the regular files of an uncompressed tar
+// archive, which are read in place.
+type tarFS struct {
+	r     io.ReaderAt
+	files map[string]tarEntry
+}
+
+type tarEntry struct {
+	offset int64
+	hdr    *tar.Header
+}
+
+func newTarFS(r io.ReaderAt, size int64) (*tarFS, error) {
+	// tar.Reader seeks over the content of entries, so only headers are read
+	sr := io.NewSectionReader(r, 0, size)
+	tr := tar.NewReader(sr)
+
+	files := make(map[string]tarEntry)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read tar archive: %w", err)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		offset, err := sr.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		files[cleanLayerPath(hdr.Name)] = tarEntry{offset: offset, hdr: hdr}
+	}
+
+	return &tarFS{r: r, files: files}, nil
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, ok := t.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &tarFile{
+		SectionReader: io.NewSectionReader(t.r, entry.offset, entry.hdr.Size),
+		info:          entry.hdr.FileInfo(),
+	}, nil
+}
+
+type tarFile struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *tarFile) Close() error {
+	return nil
+}
+
+// imageFileInfo describes a file of the merged filesystem of an image.
+type imageFileInfo struct {
+	name string
+	node *imageNode
+}
+
+func (i imageFileInfo) Name() string       { return i.name }
+func (i imageFileInfo) Size() int64        { return i.node.size }
+func (i imageFileInfo) Mode() fs.FileMode  { return i.node.mode }
+func (i imageFileInfo) ModTime() time.Time { return time.Time{} }
+func (i imageFileInfo) IsDir() bool        { return i.node.mode.IsDir() }
+func (i imageFileInfo) Sys() any           { return nil }
@@ -0,0 +1,373 @@
+package rpmdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+type layerFile struct {
+	name    string
+	data    []byte
+	symlink string
+	dir     bool
+}
+
+func makeLayer(t *testing.T, files ...layerFile) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(f.data))}
+		switch {
+		case f.dir:
+			hdr = &tar.Header{Name: f.name + "/", Mode: 0o755, Typeflag: tar.TypeDir}
+		case f.symlink != "":
+			hdr = &tar.Header{Name: f.name, Mode: 0o777, Typeflag: tar.TypeSymlink, Linkname: f.symlink}
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(f.data)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipData(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func imageConfigJSON(t *testing.T, layers [][]byte) []byte {
+	t.Helper()
+
+	config := map[string]any{
+		"rootfs":  map[string]any{"type": "layers", "diff_ids": []string{}},
+		"history": []map[string]any{{"created_by": "ENV A=B", "empty_layer": true}},
+	}
+	for i, layer := range layers {
+		config["rootfs"].(map[string]any)["diff_ids"] = append(config["rootfs"].(map[string]any)["diff_ids"].([]string), digestOf(layer))
+		config["history"] = append(config["history"].([]map[string]any), map[string]any{"created_by": fmt.Sprintf("RUN layer %d", i)})
+	}
+	b, err := json.Marshal(config)
+	require.NoError(t, err)
+	return b
+}
+
+// writeOCILayout writes an OCI image layout with gzip compressed layers to dir.
+func writeOCILayout(t *testing.T, dir string, layers [][]byte) {
+	t.Helper()
+
+	writeBlob := func(b []byte) map[string]any {
+		digest := digestOf(b)
+		p := filepath.Join(dir, "blobs", "sha256", digest[len("sha256:"):])
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, b, 0o644))
+		return map[string]any{"digest": digest, "size": len(b)}
+	}
+
+	var descs []map[string]any
+	for _, layer := range layers {
+		desc := writeBlob(gzipData(t, layer))
+		desc["mediaType"] = "application/vnd.oci.image.layer.v1.tar+gzip"
+		descs = append(descs, desc)
+	}
+	config := writeBlob(imageConfigJSON(t, layers))
+	config["mediaType"] = "application/vnd.oci.image.config.v1+json"
+
+	manifest, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        config,
+		"layers":        descs,
+	})
+	require.NoError(t, err)
+	desc := writeBlob(manifest)
+	desc["mediaType"] = "application/vnd.oci.image.manifest.v1+json"
+
+	index, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"manifests":     []any{desc},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), index, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644))
+}
+
+// dockerSave returns a tarball in the format of docker save.
+func dockerSave(t *testing.T, layers [][]byte) []byte {
+	t.Helper()
+
+	files := []layerFile{{name: "config.json", data: imageConfigJSON(t, layers)}}
+	var paths []string
+	for i, layer := range layers {
+		name := fmt.Sprintf("%064d/layer.tar", i)
+		paths = append(paths, name)
+		files = append(files, layerFile{name: name, data: layer})
+	}
+	manifest, err := json.Marshal([]map[string]any{{
+		"Config":   "config.json",
+		"RepoTags": []string{"test:latest"},
+		"Layers":   paths,
+	}})
+	require.NoError(t, err)
+	files = append(files, layerFile{name: "manifest.json", data: manifest})
+
+	return makeLayer(t, files...)
+}
+
+// removePackages returns a copy of the rpmdb.sqlite fixture without its first
+// n packages.
+func removePackages(t *testing.T, n int) []byte {
+	t.Helper()
+
+	b, err := os.ReadFile("testdata/cbl-mariner-2.0/rpmdb.sqlite")
+	require.NoError(t, err)
+	p := filepath.Join(t.TempDir(), "rpmdb.sqlite")
+	require.NoError(t, os.WriteFile(p, b, 0o644))
+
+	db, err := sql.Open("sqlite", p)
+	require.NoError(t, err)
+	_, err = db.Exec("DELETE FROM Packages WHERE hnum IN (SELECT hnum FROM Packages ORDER BY hnum LIMIT ?)", n)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	b, err = os.ReadFile(p)
+	require.NoError(t, err)
+	return b
+}
+
+func packageNames(t *testing.T, b []byte) map[string]bool {
+	t.Helper()
+
+	db, err := OpenReaderAt(bytes.NewReader(b), int64(len(b)))
+	require.NoError(t, err)
+	pkgs, err := db.ListPackages()
+	require.NoError(t, err)
+
+	names := make(map[string]bool)
+	for _, pkg := range pkgs {
+		names[pkg.Name+"."+pkg.Arch] = true
+	}
+	return names
+}
+
+func TestOpenImage(t *testing.T) {
+	ndb, err := os.ReadFile("testdata/sle15-bci/Packages.db")
+	require.NoError(t, err)
+	sqlite, err := os.ReadFile("testdata/cbl-mariner-2.0/rpmdb.sqlite")
+	require.NoError(t, err)
+	partial := removePackages(t, 3)
+
+	layers := [][]byte{
+		makeLayer(t,
+			layerFile{name: "etc/os-release", data: []byte("ID=sles\n")},
+			layerFile{name: "var/lib/rpm", dir: true},
+			layerFile{name: "var/lib/rpm/Packages.db", data: ndb},
+		),
+		// migrate to /usr/lib/sysimage, dropping 3 packages
+		makeLayer(t,
+			layerFile{name: "var/lib/.wh.rpm"},
+			layerFile{name: "var/lib/rpm", symlink: "../../usr/lib/sysimage/rpm"},
+			layerFile{name: "usr/lib/sysimage/rpm/rpmdb.sqlite", data: partial},
+		),
+		// reinstate them; the opaque marker only hides the lower layers
+		makeLayer(t,
+			layerFile{name: "usr/lib/sysimage/rpm/rpmdb.sqlite", data: sqlite},
+			layerFile{name: "usr/lib/sysimage/rpm/.wh..wh..opq"},
+		),
+	}
+
+	ndbNames := packageNames(t, ndb)
+	partialNames := packageNames(t, partial)
+
+	dir := t.TempDir()
+	layout := filepath.Join(dir, "oci")
+	writeOCILayout(t, layout, layers)
+
+	tarball := filepath.Join(dir, "image.tar")
+	require.NoError(t, os.WriteFile(tarball, dockerSave(t, layers), 0o644))
+	compressed := filepath.Join(dir, "image.tar.gz")
+	require.NoError(t, os.WriteFile(compressed, gzipData(t, dockerSave(t, layers)), 0o644))
+
+	for name, p := range map[string]string{
+		"OCI layout":          layout,
+		"docker save":         tarball,
+		"gzipped docker save": compressed,
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, err := OpenImage(p)
+			require.NoError(t, err)
+			defer img.Close()
+
+			require.Len(t, img.Layers, 3)
+			for i, layer := range img.Layers {
+				assert.Equal(t, digestOf(layers[i]), layer.DiffID)
+				assert.Equal(t, fmt.Sprintf("RUN layer %d", i), layer.CreatedBy)
+				assert.NotEmpty(t, layer.Digest)
+				assert.NoError(t, layer.Err)
+			}
+			assert.Equal(t, "usr/lib/sysimage/rpm/rpmdb.sqlite", img.Discovery.Path)
+
+			pkgs, err := img.ListPackages()
+			require.NoError(t, err)
+			require.Len(t, pkgs, 129)
+
+			for _, pkg := range pkgs {
+				key := pkg.Name + "." + pkg.Arch
+				want := PackageOrigin{Introduced: 1, Changed: 1}
+				switch {
+				case !partialNames[key]:
+					want = PackageOrigin{Introduced: 2, Changed: 2}
+				case ndbNames[key]:
+					want = PackageOrigin{Introduced: 0, Changed: 1}
+				}
+
+				got, ok := img.Origin(pkg)
+				require.True(t, ok, key)
+				assert.Equal(t, want, got, key)
+			}
+		})
+	}
+}
+
+func TestOpenImage_Whiteout(t *testing.T) {
+	ndb, err := os.ReadFile("testdata/sle15-bci/Packages.db")
+	require.NoError(t, err)
+	bdb, err := os.ReadFile("testdata/libuuid/Packages")
+	require.NoError(t, err)
+
+	base := makeLayer(t,
+		layerFile{name: "var/lib/rpm/Packages.db", data: ndb},
+		layerFile{name: "var/lib/rpm/Packages", data: bdb},
+	)
+
+	tests := []struct {
+		name     string
+		layer    []byte
+		wantPath string
+		wantErr  error
+	}{
+		{
+			name:     "file",
+			layer:    makeLayer(t, layerFile{name: "var/lib/rpm/.wh.Packages.db"}),
+			wantPath: "var/lib/rpm/Packages",
+		},
+		{
+			name:    "directory",
+			layer:   makeLayer(t, layerFile{name: "var/lib/.wh.rpm"}),
+			wantErr: fs.ErrNotExist,
+		},
+		{
+			name: "opaque directory",
+			layer: makeLayer(t,
+				layerFile{name: "var/lib/rpm/.wh..wh..opq"},
+				layerFile{name: "var/lib/rpm/Packages", data: bdb},
+			),
+			wantPath: "var/lib/rpm/Packages",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout := t.TempDir()
+			writeOCILayout(t, layout, [][]byte{base, tt.layer})
+
+			img, err := OpenImage(layout)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer img.Close()
+
+			assert.Equal(t, tt.wantPath, img.Discovery.Path)
+
+			pkgs, err := img.ListPackages()
+			require.NoError(t, err)
+			require.Len(t, pkgs, 1)
+
+			// the database only became effective in the second layer
+			origin, ok := img.Origin(pkgs[0])
+			require.True(t, ok)
+			assert.Equal(t, PackageOrigin{Introduced: 1, Changed: 1}, origin)
+		})
+	}
+}
+
+func TestOpenImage_Errors(t *testing.T) {
+	layout := t.TempDir()
+	writeOCILayout(t, layout, [][]byte{makeLayer(t, layerFile{name: "etc/os-release"})})
+
+	// corrupt the layer
+	blobs, err := filepath.Glob(filepath.Join(layout, "blobs", "sha256", "*"))
+	require.NoError(t, err)
+	for _, blob := range blobs {
+		b, err := os.ReadFile(blob)
+		require.NoError(t, err)
+		if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+			require.NoError(t, os.WriteFile(blob, append(b, 0), 0o644))
+		}
+	}
+
+	_, err = OpenImage(layout)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "digest mismatch")
+
+	_, err = OpenImage(t.TempDir())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not an OCI image layout or docker save tarball")
+}
+
+func TestOpenImage_Limits(t *testing.T) {
+	dir := t.TempDir()
+	bomb := filepath.Join(dir, "bomb.tar.gz")
+	require.NoError(t, os.WriteFile(bomb, gzipData(t, make([]byte, 1<<20)), 0o644))
+
+	_, err := OpenImageWithOptions(bomb, ImageOptions{Limits: dbi.Limits{MaxFileSize: 64 << 10}})
+	var limitErr *dbi.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "MaxFileSize", limitErr.Limit)
+
+	// a database file larger than the limit, even if a later layer removes it
+	layout := filepath.Join(dir, "oci")
+	writeOCILayout(t, layout, [][]byte{
+		makeLayer(t, layerFile{name: "var/lib/rpm/Packages", data: make([]byte, 128<<10)}),
+		makeLayer(t, layerFile{name: "var/lib/rpm/.wh.Packages"}),
+	})
+
+	_, err = OpenImageWithOptions(layout, ImageOptions{Limits: dbi.Limits{MaxFileSize: 64 << 10}})
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "MaxFileSize", limitErr.Limit)
+
+	img, err := OpenImageWithOptions(layout, ImageOptions{Limits: dbi.Limits{MaxFileSize: 256 << 10}})
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Nil(t, img)
+}
@@ -0,0 +1,237 @@
+package rpmdb
+
+import (
+	"context"
+	"sync"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+// PackageIterator decodes the packages of a database one header at a time,
+// so only the current package is held in memory:
+//
+//	it := db.Packages(ctx)
+//	defer it.Close()
+//	for it.Next() {
+//		pkg := it.Package()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type PackageIterator struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	entries <-chan dbi.Entry
+	fields  Fields
+	limits  dbi.Limits
+	// packages returned so far, against limits.MaxPackages
+	count int
+
+	// set when headers are decoded by a worker pool, in database order
+	pending <-chan chan decoded
+
+	salvage     bool
+	diagnostics []Diagnostic
+
+	pkg  *PackageInfo
+	err  error
+	done bool
+}
+
+type decoded struct {
+	pkg      *PackageInfo
+	err      error
+	location string
+}
+
+// Packages returns an iterator over the installed packages. The iterator
+// stops with ctx.Err() once ctx is done. Close must be called if the
+// iteration is abandoned before Next returns false.
+func (d *RpmDB) Packages(ctx context.Context) *PackageIterator {
+	return d.PackagesWithOptions(ctx, ListOptions{})
+}
+
+// PackagesWithOptions is like Packages, but only decodes the fields selected
+// by opts, using opts.Concurrency workers.
+func (d *RpmDB) PackagesWithOptions(ctx context.Context, opts ListOptions) *PackageIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	it := &PackageIterator{
+		ctx:     ctx,
+		cancel:  cancel,
+		fields:  opts.fields(),
+		limits:  d.limits,
+		salvage: opts.Salvage,
+	}
+	salvager, canSalvage := d.Db.(dbi.Salvager)
+	reader, canStop := d.Db.(dbi.ContextReader)
+	switch {
+	case canSalvage && opts.Salvage:
+		it.entries = salvager.SalvageContext(ctx)
+	case canStop:
+		it.entries = reader.ReadContext(ctx)
+	default:
+		// the backend reads to the end, and Close drains it
+		it.entries = d.Db.Read()
+	}
+	if opts.Concurrency > 1 {
+		it.pending = decodeParallel(ctx, it.entries, it.fields, it.limits, opts.Concurrency)
+	}
+	return it
+}
+
+// Next decodes the next package and reports whether there is one. It returns
+// false at the end of the database or on the first error, see Err. In salvage
+// mode, errors are recorded as diagnostics and skipped, see Diagnostics,
+// except for a *dbi.LimitError.
+func (it *PackageIterator) Next() bool {
+	// drop the previous package so the caller decides whether it is retained
+	it.pkg = nil
+	if it.done {
+		return false
+	}
+
+	for {
+		result, ok := it.decode()
+		if !ok {
+			it.stop(it.ctx.Err())
+			return false
+		}
+		if result.err != nil {
+			// a backend may fail because ctx was cancelled under it
+			if ctxErr := it.ctx.Err(); ctxErr != nil {
+				it.stop(ctxErr)
+				return false
+			}
+			if it.salvage && !dbi.LimitExceeded(result.err) {
+				it.diagnostics = append(it.diagnostics, Diagnostic{Location: result.location, Err: result.err})
+				continue
+			}
+			it.stop(result.err)
+			return false
+		}
+
+		if it.limits.MaxPackages > 0 && it.count >= it.limits.MaxPackages {
+			it.stop(&dbi.LimitError{Limit: "MaxPackages", Max: int64(it.limits.MaxPackages)})
+			return false
+		}
+		it.count++
+		it.pkg = result.pkg
+		return true
+	}
+}
+
+// decode returns the next package in database order, or false once there are
+// no more packages or ctx is done.
+func (it *PackageIterator) decode() (decoded, bool) {
+	if it.pending == nil {
+		entry, ok := <-it.entries
+		if !ok {
+			return decoded{}, false
+		}
+		pkg, err := parseEntry(entry, it.fields, it.limits)
+		return decoded{pkg: pkg, err: err, location: entryLocation(entry)}, true
+	}
+
+	result, ok := <-it.pending
+	if !ok {
+		return decoded{}, false
+	}
+	select {
+	case r := <-result:
+		return r, true
+	case <-it.ctx.Done():
+		return decoded{}, false
+	}
+}
+
+// decodeParallel decodes entries with n workers. Every entry gets a result
+// channel that is queued in database order before the entry is handed to a
+// worker, so at most n decoded packages are buffered ahead of the reader.
+func decodeParallel(ctx context.Context, entries <-chan dbi.Entry, fields Fields, limits dbi.Limits, n int) <-chan chan decoded {
+	type job struct {
+		entry  dbi.Entry
+		result chan<- decoded
+	}
+
+	pending := make(chan chan decoded, n)
+	jobs := make(chan job)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				pkg, err := parseEntry(j.entry, fields, limits)
+				// buffered, never blocks
+				j.result <- decoded{pkg: pkg, err: err, location: entryLocation(j.entry)}
+			}
+		}()
+	}
+
+	go func() {
+		// pending is closed last, so that draining it waits for the workers
+		defer close(pending)
+		defer wg.Wait()
+		defer close(jobs)
+
+		for entry := range entries {
+			result := make(chan decoded, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- job{entry: entry, result: result}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return pending
+}
+
+// Package returns the package decoded by the last call to Next.
+func (it *PackageIterator) Package() *PackageInfo {
+	return it.pkg
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *PackageIterator) Err() error {
+	return it.err
+}
+
+// Diagnostics returns the errors skipped so far in salvage mode, in database
+// order.
+func (it *PackageIterator) Diagnostics() []Diagnostic {
+	return it.diagnostics
+}
+
+// Close stops the iteration and waits for the backend reader to return. It is
+// safe to call Close more than once.
+func (it *PackageIterator) Close() error {
+	it.pkg = nil
+	it.stop(nil)
+	return nil
+}
+
+func (it *PackageIterator) stop(err error) {
+	if it.done {
+		return
+	}
+	it.done = true
+	it.err = err
+	it.cancel()
+
+	// wait for the backend to stop reading, as the pages it reads may be
+	// unmapped as soon as the database is closed
+	if it.pending != nil {
+		for range it.pending {
+		}
+	}
+	for range it.entries {
+	}
+}
@@ -0,0 +1,118 @@
+package rpmdb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+func TestPackages(t *testing.T) {
+	for _, tt := range readerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(tt.file)
+			require.NoError(t, err)
+			want := listPackages(t, db)
+
+			db, err = Open(tt.file)
+			require.NoError(t, err)
+			defer db.Close()
+
+			var got []*PackageInfo
+			it := db.Packages(context.Background())
+			for it.Next() {
+				pkg := it.Package()
+				pkg.IndexEntries = nil
+				got = append(got, pkg)
+			}
+			require.NoError(t, it.Err())
+			require.NoError(t, it.Close())
+
+			assert.Equal(t, want, got)
+			assert.False(t, it.Next())
+			assert.Nil(t, it.Package())
+		})
+	}
+}
+
+func TestPackages_Stop(t *testing.T) {
+	b, err := os.ReadFile("testdata/blob.bin")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		entries []dbi.Entry
+		stop    func(it *PackageIterator, cancel context.CancelFunc)
+		want    int
+		wantErr error
+	}{
+		{
+			name:    "Close",
+			entries: []dbi.Entry{{Value: b}, {Value: b}, {Value: b}},
+			stop: func(it *PackageIterator, _ context.CancelFunc) {
+				require.NoError(t, it.Close())
+			},
+			want: 1,
+		},
+		{
+			name:    "cancel",
+			entries: []dbi.Entry{{Value: b}, {Value: b}, {Value: b}},
+			stop: func(_ *PackageIterator, cancel context.CancelFunc) {
+				cancel()
+			},
+			want:    1,
+			wantErr: context.Canceled,
+		},
+		{
+			name:    "backend error",
+			entries: []dbi.Entry{{Value: b}, {Err: xerrors.New("broken")}, {Value: b}},
+			stop:    func(*PackageIterator, context.CancelFunc) {},
+			want:    1,
+			wantErr: xerrors.New("broken"),
+		},
+		{
+			name:    "invalid header",
+			entries: []dbi.Entry{{Value: []byte{1, 2, 3}}, {Value: b}},
+			stop:    func(*PackageIterator, context.CancelFunc) {},
+			wantErr: xerrors.New("error during importing header"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			fake := &fakeDB{entries: tt.entries, done: make(chan struct{})}
+			it := (&RpmDB{Db: fake}).Packages(ctx)
+			defer it.Close()
+
+			var got int
+			for it.Next() {
+				got++
+				tt.stop(it, cancel)
+			}
+			assert.Equal(t, tt.want, got)
+
+			switch {
+			case tt.wantErr == context.Canceled:
+				assert.ErrorIs(t, it.Err(), context.Canceled)
+			case tt.wantErr != nil:
+				require.Error(t, it.Err())
+				assert.Contains(t, it.Err().Error(), tt.wantErr.Error())
+			default:
+				assert.NoError(t, it.Err())
+			}
+
+			select {
+			case <-fake.done:
+			default:
+				t.Fatal("reader goroutine still running")
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/ZafranSecurity/go-rpmdb/pkg/bdb"
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+func TestLimits(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	headers := ndbHeaders(t, file)
+	var largest, total int64
+	for _, h := range headers {
+		largest = max(largest, int64(len(h.Value)))
+		total += int64(len(h.Value))
+	}
+
+	ndbData, err := os.ReadFile(file)
+	require.NoError(t, err)
+	sqlitePath, _ := sqlitePackages(t, 4096, headers)
+	sqliteData, err := os.ReadFile(sqlitePath)
+	require.NoError(t, err)
+	databases := map[string][]byte{
+		"ndb":       ndbData,
+		"bdb hash":  bdbHash(t, 1024, binary.LittleEndian, instancePairs(headers, binary.LittleEndian)),
+		"bdb btree": bdbBtree(t, 1024, binary.BigEndian, instancePairs(headers, binary.BigEndian)),
+		"lmdb":      lmdbEnv(512, binary.LittleEndian, 8, instancePairs(headers, binary.LittleEndian)),
+		"sqlite":    sqliteData,
+	}
+
+	tests := []struct {
+		name   string
+		limits dbi.Limits
+		// skip lists the databases the limit is not reached on
+		skip []string
+	}{
+		{
+			name:   "MaxHeaderSize",
+			limits: dbi.Limits{MaxHeaderSize: largest - 1},
+		},
+		{
+			name:   "MaxPages",
+			limits: dbi.Limits{MaxPages: 2},
+			// the fixture has a single slot page
+			skip: []string{"ndb"},
+		},
+		{
+			name:   "MaxPackages",
+			limits: dbi.Limits{MaxPackages: 3},
+		},
+		{
+			name:   "MaxFilesPerPackage",
+			limits: dbi.Limits{MaxFilesPerPackage: 1},
+		},
+		{
+			name:   "MaxTotalBytes",
+			limits: dbi.Limits{MaxTotalBytes: total / 2},
+		},
+	}
+	for _, tt := range tests {
+		for name, data := range databases {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+				require.NoError(t, err)
+				defer db.Close()
+
+				pkgs, err := db.ListPackages()
+				require.NoError(t, err)
+				require.Len(t, pkgs, len(headers))
+
+				db.SetLimits(tt.limits)
+				_, err = db.ListPackages()
+				if lo.Contains(tt.skip, name) {
+					require.NoError(t, err)
+					return
+				}
+				var limitErr *dbi.LimitError
+				require.True(t, xerrors.As(err, &limitErr), "%v", err)
+				assert.Equal(t, tt.name, limitErr.Limit)
+				assert.True(t, dbi.LimitExceeded(err))
+
+				// salvaging does not skip past a limit
+				_, _, err = db.SalvagePackages(context.Background(), ListOptions{Concurrency: 4})
+				assert.True(t, dbi.LimitExceeded(err), "%v", err)
+			})
+		}
+	}
+
+	t.Run("OpenWithOptions", func(t *testing.T) {
+		for _, path := range []string{file, sqlitePath} {
+			db, err := OpenWithOptions(path, OpenOptions{Limits: dbi.Limits{MaxTotalBytes: total / 2}})
+			require.NoError(t, err)
+			_, err = db.ListPackages()
+			assert.True(t, dbi.LimitExceeded(err), "%s: %v", path, err)
+			require.NoError(t, db.Close())
+		}
+	})
+
+	t.Run("bdb last page beyond the file", func(t *testing.T) {
+		for _, name := range []string{"bdb hash", "bdb btree"} {
+			data := bytes.Clone(databases[name])
+			order := binary.ByteOrder(binary.LittleEndian)
+			if name == "bdb btree" {
+				order = binary.BigEndian
+			}
+			order.PutUint32(data[32:], 0xfffffff0)
+			_, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+			assert.ErrorContains(t, err, "exceeds the file", name)
+		}
+	})
+
+	// bdbOverflow returns a database holding the first header on overflow
+	// pages, and the first of them
+	const pageSize = 512
+	order := binary.LittleEndian
+	bdbOverflow := func(t *testing.T) ([]byte, uint32) {
+		data := bdbHash(t, pageSize, order, instancePairs(headers[:1], order))
+		for pgNo := uint32(1); int(pgNo) < len(data)/pageSize; pgNo++ {
+			page := data[pgNo*pageSize:]
+			if page[25] == bdb.OverflowPageType && order.Uint32(page[12:]) == 0 {
+				return data, pgNo
+			}
+		}
+		t.Fatal("no overflow pages")
+		return nil, 0
+	}
+
+	t.Run("bdb overflow larger than the file", func(t *testing.T) {
+		data, head := bdbOverflow(t)
+		// the HOFFPAGE item: type, 3 unused bytes, first page and length
+		item := append([]byte{bdb.HashOffIndexPageType, 0, 0, 0}, order.AppendUint32(nil, head)...)
+		i := bytes.Index(data, item)
+		require.GreaterOrEqual(t, i, 0)
+		order.PutUint32(data[i+8:], uint32(len(data)))
+
+		db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		_, err = db.ListPackages()
+		assert.ErrorContains(t, err, "larger than the database")
+	})
+
+	t.Run("bdb overflow cycle", func(t *testing.T) {
+		data, head := bdbOverflow(t)
+		page := func(pgNo uint32) []byte {
+			return data[pgNo*pageSize : (pgNo+1)*pageSize]
+		}
+		// point the last page of the chain back at its first page
+		tail := head
+		for order.Uint32(page(tail)[16:]) != 0 {
+			tail = order.Uint32(page(tail)[16:])
+		}
+		order.PutUint32(page(tail)[16:], head)
+
+		db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		_, err = db.ListPackages()
+		assert.ErrorContains(t, err, "overflow chain")
+	})
+}
@@ -0,0 +1,264 @@
+package lmdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* rpm 4.15 to 4.17 could keep its database in an LMDB environment, data.mdb
+   next to lock.mdb, with one named database per rpm database:
+
+   https://github.com/rpm-software-management/rpm/blob/rpm-4.17.0-release/lib/backend/lmdb.c
+   https://github.com/LMDB/lmdb/blob/LMDB_0.9.29/libraries/liblmdb/mdb.c
+
+   data.mdb is an array of pages. Pages 0 and 1 are meta pages, and the one
+   with the higher transaction id is current. Its main database maps the
+   names of the named databases to their MDB_db records, which hold the root
+   page of their B+tree.
+
+   Branch pages hold the page number of each of their children, and leaf
+   pages the pairs. Both start with a header followed by an array of node
+   offsets, in key order. Values too large for a leaf page are stored on
+   contiguous overflow pages. Like Berkeley DB, LMDB writes in the byte order
+   of the platform, which also sizes page numbers.
+
+   The packages are in the Packages database, keyed by their instance.
+
+   The environment is read without lock.mdb, so the reader table is left
+   alone.
+*/
+
+const (
+	LMDB_Magic   = 0xBEEFC0DE
+	LMDB_Version = 1
+
+	// pages are at least as large as the 512 bytes of a meta page
+	minPageSize = 512
+	maxPageSize = 65536
+
+	// page flags
+	pageBranch   = 0x01
+	pageLeaf     = 0x02
+	pageOverflow = 0x04
+	pageMeta     = 0x08
+	pageLeaf2    = 0x20
+	pageSub      = 0x40
+
+	// node flags
+	nodeBigData = 0x01
+	nodeSubData = 0x02
+	nodeDupData = 0x04
+
+	// NODESIZE: the data size, flags and key size
+	nodeSize = 8
+
+	packagesDB = "Packages"
+)
+
+var ErrorInvalidLMDB = xerrors.New("invalid or unsupported LMDB format")
+
+type LMDB struct {
+	file   io.ReaderAt
+	closer io.Closer
+	layout layout
+	// Meta is the current meta page.
+	Meta     *Meta
+	packages DB
+
+	// Limits must be set before the database is read.
+	Limits dbi.Limits
+}
+
+func Open(path string) (*LMDB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	// pages are sliced straight from the mapped file
+	source := dbi.MapFile(file, info.Size())
+	db, err := OpenReaderAt(source, info.Size())
+	if err != nil {
+		_ = source.Close()
+		return nil, err
+	}
+	db.closer = source
+
+	return db, nil
+}
+
+// OpenReaderAt parses an LMDB data.mdb of the given size from r, and finds its
+// Packages database. Closing the returned database does not close r.
+func OpenReaderAt(r io.ReaderAt, size int64) (*LMDB, error) {
+	buf := make([]byte, minPageSize)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("failed to read meta page: %w", err)
+	}
+
+	l, ok := detectLayout(buf[:n])
+	if !ok {
+		return nil, ErrorInvalidLMDB
+	}
+	meta, err := l.parseMeta(buf[:n])
+	if err != nil {
+		return nil, xerrors.Errorf("meta page 0: %w", err)
+	}
+
+	// the second meta page wins if it was committed later
+	n, err = r.ReadAt(buf, int64(meta.PageSize))
+	if err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("failed to read meta page: %w", err)
+	}
+	if meta1, err := l.parseMeta(buf[:n]); err == nil && meta1.TxnID > meta.TxnID && meta1.PageSize == meta.PageSize {
+		meta = meta1
+	}
+
+	if pages := uint64(size) / uint64(meta.PageSize); meta.LastPageNo >= pages {
+		return nil, xerrors.Errorf("truncated LMDB environment: last page is %d, found %d pages", meta.LastPageNo, pages)
+	}
+
+	db := &LMDB{
+		file:   r,
+		layout: l,
+		Meta:   meta,
+	}
+	db.packages, err = db.namedDB(packagesDB)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+var errStopWalk = xerrors.New("stop walk")
+
+// namedDB finds the MDB_db record of the named database in the main database.
+func (db *LMDB) namedDB(name string) (DB, error) {
+	var d DB
+	var found bool
+	err := db.walk(context.Background(), db.Meta.Main, nil, func(n node) error {
+		if string(n.key) != name {
+			return nil
+		}
+		if n.flags&nodeSubData == 0 || len(n.data) != db.layout.dbSize() {
+			return xerrors.Errorf("%s is not a named database: flags %#x", name, n.flags)
+		}
+		d, found = db.layout.parseDB(n.data), true
+		return errStopWalk
+	}, nil)
+	if err != nil && err != errStopWalk {
+		return DB{}, xerrors.Errorf("failed to read the main database: %w", err)
+	}
+	if !found {
+		return DB{}, xerrors.Errorf("no %s database in the environment", name)
+	}
+	return d, nil
+}
+
+func (db *LMDB) GetPgSize() uint32 {
+	return db.Meta.PageSize
+}
+
+func (db *LMDB) GetLastPgNo() uint32 {
+	return uint32(min(db.Meta.LastPageNo, math.MaxUint32))
+}
+
+func (db *LMDB) Close() error {
+	if db.closer == nil {
+		return nil
+	}
+	return db.closer.Close()
+}
+
+func (db *LMDB) Read() <-chan dbi.Entry {
+	return db.ReadContext(context.Background())
+}
+
+func (db *LMDB) ReadContext(ctx context.Context) <-chan dbi.Entry {
+	return db.read(ctx, false)
+}
+
+var _ dbi.Salvager = (*LMDB)(nil)
+
+// SalvageContext implements dbi.Salvager. Pages and nodes that cannot be read
+// are reported and skipped, along with the subtree below a damaged branch
+// page.
+func (db *LMDB) SalvageContext(ctx context.Context) <-chan dbi.Entry {
+	return db.read(ctx, true)
+}
+
+func (db *LMDB) read(ctx context.Context, salvage bool) <-chan dbi.Entry {
+	entries := make(chan dbi.Entry)
+
+	go func() {
+		defer close(entries)
+
+		var damaged func(pgNo uint64, err error) error
+		if salvage {
+			damaged = func(pgNo uint64, err error) error {
+				if !dbi.Send(ctx, entries, dbi.Entry{Err: err, Location: fmt.Sprintf("page %d", pgNo)}) {
+					return errStopWalk
+				}
+				return nil
+			}
+		}
+
+		budget := dbi.NewBudget(db.Limits)
+		err := db.walk(ctx, db.packages, budget, func(n node) error {
+			entry, err := db.entry(n, budget)
+			if err != nil {
+				if damaged == nil || dbi.LimitExceeded(err) {
+					return err
+				}
+				return damaged(n.pgNo, err)
+			}
+			if entry.Instance == 0 {
+				// key 0 holds the next free instance rather than a header
+				return nil
+			}
+			if !dbi.Send(ctx, entries, entry) {
+				return errStopWalk
+			}
+			return nil
+		}, damaged)
+		if err != nil && err != errStopWalk && ctx.Err() == nil {
+			dbi.Send(ctx, entries, dbi.Entry{
+				Err: err,
+			})
+		}
+	}()
+
+	return entries
+}
+
+// entry reads the package of a node of the Packages database.
+func (db *LMDB) entry(n node, budget *dbi.Budget) (dbi.Entry, error) {
+	if len(n.key) != 4 || n.flags&(nodeSubData|nodeDupData) != 0 {
+		return dbi.Entry{}, xerrors.Errorf("unexpected Packages key of %d bytes with flags %#x", len(n.key), n.flags)
+	}
+	instance := db.layout.order.Uint32(n.key)
+	if instance == 0 {
+		return dbi.Entry{}, nil
+	}
+
+	value, err := db.value(n, budget)
+	if err != nil {
+		return dbi.Entry{}, xerrors.Errorf("failed to read package %d: %w", instance, err)
+	}
+	return dbi.Entry{
+		Value:    value,
+		Instance: instance,
+	}, nil
+}
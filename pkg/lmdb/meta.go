@@ -0,0 +1,161 @@
+package lmdb
+
+import (
+	"encoding/binary"
+	"math"
+
+	"golang.org/x/xerrors"
+)
+
+// DB is the MDB_db record of a database: its root page and statistics.
+type DB struct {
+	// Pad is the page size of the free-list database, and unused otherwise.
+	Pad           uint32
+	Flags         uint16
+	Depth         uint16
+	BranchPages   uint64
+	LeafPages     uint64
+	OverflowPages uint64
+	Entries       uint64
+	Root          uint64
+}
+
+// Meta is the MDB_meta record of a meta page.
+type Meta struct {
+	Magic   uint32
+	Version uint32
+	MapSize uint64
+	// Free and Main are the free-list and the main database, whose keys are
+	// the names of the named databases.
+	Free       DB
+	Main       DB
+	LastPageNo uint64
+	TxnID      uint64
+
+	// PageSize is recorded as the Pad of the free-list database.
+	PageSize uint32
+	// WordSize is the size of a pointer on the platform that wrote the
+	// environment, 4 or 8 bytes, which sizes page numbers and the headers.
+	WordSize int
+	// BigEndian is set if the environment was written by a big-endian
+	// platform.
+	BigEndian bool
+}
+
+// layout is how the platform that wrote the environment lays out its pages.
+type layout struct {
+	order    binary.ByteOrder
+	wordSize int
+}
+
+// headerSize is PAGEHDRSZ: the page number, 2 bytes of padding, the flags and
+// either the bounds of the free space or the number of overflow pages.
+func (l layout) headerSize() int {
+	return l.wordSize + 8
+}
+
+// dbSize is the size of an MDB_db record.
+func (l layout) dbSize() int {
+	return 8 + 5*l.wordSize
+}
+
+func (l layout) word(b []byte) uint64 {
+	if l.wordSize == 8 {
+		return l.order.Uint64(b)
+	}
+	return uint64(l.order.Uint32(b))
+}
+
+// invalidPgNo is P_INVALID, the root of an empty database.
+func (l layout) invalidPgNo() uint64 {
+	if l.wordSize == 8 {
+		return math.MaxUint64
+	}
+	return math.MaxUint32
+}
+
+func (l layout) parseDB(b []byte) DB {
+	w := l.wordSize
+	return DB{
+		Pad:           l.order.Uint32(b),
+		Flags:         l.order.Uint16(b[4:]),
+		Depth:         l.order.Uint16(b[6:]),
+		BranchPages:   l.word(b[8:]),
+		LeafPages:     l.word(b[8+w:]),
+		OverflowPages: l.word(b[8+2*w:]),
+		Entries:       l.word(b[8+3*w:]),
+		Root:          l.word(b[8+4*w:]),
+	}
+}
+
+// metaLayouts are the layouts a meta page is tried with, 64-bit first.
+var metaLayouts = []layout{
+	{order: binary.LittleEndian, wordSize: 8},
+	{order: binary.BigEndian, wordSize: 8},
+	{order: binary.LittleEndian, wordSize: 4},
+	{order: binary.BigEndian, wordSize: 4},
+}
+
+// detectLayout finds the layout in which buf starts with a meta page.
+func detectLayout(buf []byte) (layout, bool) {
+	for _, l := range metaLayouts {
+		hdr := l.headerSize()
+		if len(buf) < hdr+8 {
+			continue
+		}
+		if l.order.Uint16(buf[l.wordSize+2:])&pageMeta != 0 && l.order.Uint32(buf[hdr:]) == LMDB_Magic {
+			return l, true
+		}
+	}
+	return layout{}, false
+}
+
+// ParseMeta parses the meta page at the start of data.mdb, in whichever byte
+// order and word size it was written.
+func ParseMeta(buf []byte) (*Meta, error) {
+	l, ok := detectLayout(buf)
+	if !ok {
+		return nil, ErrorInvalidLMDB
+	}
+	return l.parseMeta(buf)
+}
+
+func (l layout) metaSize() int {
+	// magic, version, address, map size, two databases, last page, txn id
+	return l.headerSize() + 8 + 2*l.wordSize + 2*l.dbSize() + 2*l.wordSize
+}
+
+// parseMeta parses the meta page in buf, which is known to be in layout l.
+func (l layout) parseMeta(buf []byte) (*Meta, error) {
+	if len(buf) < l.metaSize() {
+		return nil, xerrors.Errorf("short meta page: %d bytes", len(buf))
+	}
+	if l.order.Uint16(buf[l.wordSize+2:])&pageMeta == 0 {
+		return nil, xerrors.Errorf("unexpected meta page flags: %#x", l.order.Uint16(buf[l.wordSize+2:]))
+	}
+
+	w := l.wordSize
+	b := buf[l.headerSize():]
+	meta := &Meta{
+		Magic:     l.order.Uint32(b),
+		Version:   l.order.Uint32(b[4:]),
+		MapSize:   l.word(b[8+w:]),
+		WordSize:  w,
+		BigEndian: l.order == binary.BigEndian,
+	}
+	b = b[8+2*w:]
+	meta.Free = l.parseDB(b)
+	meta.Main = l.parseDB(b[l.dbSize():])
+	b = b[2*l.dbSize():]
+	meta.LastPageNo = l.word(b)
+	meta.TxnID = l.word(b[w:])
+	meta.PageSize = meta.Free.Pad
+
+	if meta.Magic != LMDB_Magic || meta.Version != LMDB_Version {
+		return nil, xerrors.Errorf("%w: magic %x, version %d", ErrorInvalidLMDB, meta.Magic, meta.Version)
+	}
+	if meta.PageSize < minPageSize || meta.PageSize > maxPageSize || meta.PageSize&(meta.PageSize-1) != 0 {
+		return nil, xerrors.Errorf("unexpected page size: %d", meta.PageSize)
+	}
+	return meta, nil
+}
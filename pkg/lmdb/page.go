@@ -0,0 +1,220 @@
+package lmdb
+
+import (
+	"context"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+// page is a branch or leaf page of a B+tree.
+type page struct {
+	pgNo  uint64
+	data  []byte
+	flags uint16
+	// offsets of the nodes, in key order
+	nodes []int
+}
+
+// node is a node of a leaf page.
+type node struct {
+	// pgNo is the leaf page the node is on
+	pgNo  uint64
+	flags uint16
+	key   []byte
+	// data is the value, or the page number of its first overflow page if
+	// flags has nodeBigData
+	data     []byte
+	dataSize uint32
+}
+
+// readPage reads the branch or leaf page pgNo.
+func (db *LMDB) readPage(pgNo uint64) (*page, error) {
+	if pgNo < 2 || pgNo > db.Meta.LastPageNo {
+		return nil, xerrors.Errorf("page %d out of range: last page is %d", pgNo, db.Meta.LastPageNo)
+	}
+
+	pageSize := int(db.Meta.PageSize)
+	data, err := dbi.ReadSlice(db.file, int64(pgNo)*int64(pageSize), pageSize)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read page %d: %w", pgNo, err)
+	}
+
+	l := db.layout
+	if got := l.word(data); got != pgNo {
+		return nil, xerrors.Errorf("page %d claims to be page %d", pgNo, got)
+	}
+	flags := l.order.Uint16(data[l.wordSize+2:])
+	if flags&(pageBranch|pageLeaf) == 0 || flags&(pageLeaf2|pageSub) != 0 {
+		return nil, xerrors.Errorf("unexpected flags of page %d: %#x", pgNo, flags)
+	}
+
+	hdr := l.headerSize()
+	lower := int(l.order.Uint16(data[l.wordSize+4:]))
+	upper := int(l.order.Uint16(data[l.wordSize+6:]))
+	if lower < hdr || lower > upper || upper > pageSize {
+		return nil, xerrors.Errorf("invalid free space of page %d: %d-%d", pgNo, lower, upper)
+	}
+
+	nodes := make([]int, (lower-hdr)/2)
+	for i := range nodes {
+		off := int(l.order.Uint16(data[hdr+2*i:]))
+		if off < upper || off+nodeSize > pageSize {
+			return nil, xerrors.Errorf("node %d of page %d out of bounds: %d", i, pgNo, off)
+		}
+		nodes[i] = off
+	}
+
+	return &page{pgNo: pgNo, data: data, flags: flags, nodes: nodes}, nil
+}
+
+// child returns the page number of the i-th child of a branch page, see
+// NODEPGNO.
+func (db *LMDB) child(p *page, i int) uint64 {
+	n := p.data[p.nodes[i]:]
+	pgNo := uint64(db.layout.order.Uint32(n))
+	if db.layout.wordSize == 8 {
+		pgNo |= uint64(db.layout.order.Uint16(n[4:])) << 32
+	}
+	return pgNo
+}
+
+// leafNode decodes the i-th node of a leaf page.
+func (db *LMDB) leafNode(p *page, i int) (node, error) {
+	off := p.nodes[i]
+	order := db.layout.order
+	// the data size is mn_lo and mn_hi, which are swapped on big-endian
+	// platforms, so it reads as a uint32 in either byte order
+	n := node{
+		pgNo:     p.pgNo,
+		dataSize: order.Uint32(p.data[off:]),
+		flags:    order.Uint16(p.data[off+4:]),
+	}
+	keySize := int(order.Uint16(p.data[off+6:]))
+
+	dataSize := int(n.dataSize)
+	if n.flags&nodeBigData != 0 {
+		dataSize = db.layout.wordSize
+	}
+	start := off + nodeSize
+	if uint64(start)+uint64(keySize)+uint64(dataSize) > uint64(len(p.data)) {
+		return node{}, xerrors.Errorf("node %d of page %d out of bounds: %d key and %d data bytes at %d",
+			i, p.pgNo, keySize, dataSize, off)
+	}
+	n.key = p.data[start : start+keySize]
+	n.data = p.data[start+keySize : start+keySize+dataSize]
+	return n, nil
+}
+
+// value returns a copy of the value of a leaf node, reading it from its
+// overflow pages if need be. The value and its pages are charged to budget.
+func (db *LMDB) value(n node, budget *dbi.Budget) ([]byte, error) {
+	if err := budget.Header(int64(n.dataSize)); err != nil {
+		return nil, err
+	}
+	if n.flags&nodeBigData == 0 {
+		return append([]byte(nil), n.data...), nil
+	}
+
+	l := db.layout
+	pgNo := l.word(n.data)
+	if pgNo < 2 || pgNo > db.Meta.LastPageNo {
+		return nil, xerrors.Errorf("overflow page %d out of range: last page is %d", pgNo, db.Meta.LastPageNo)
+	}
+	pageSize := int64(db.Meta.PageSize)
+	hdr, err := dbi.ReadSlice(db.file, int64(pgNo)*pageSize, l.headerSize())
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read overflow page %d: %w", pgNo, err)
+	}
+	if got := l.word(hdr); got != pgNo {
+		return nil, xerrors.Errorf("overflow page %d claims to be page %d", pgNo, got)
+	}
+	if flags := l.order.Uint16(hdr[l.wordSize+2:]); flags&pageOverflow == 0 {
+		return nil, xerrors.Errorf("unexpected flags of overflow page %d: %#x", pgNo, flags)
+	}
+
+	// the overflow pages are contiguous, and only the first has a header
+	pages := uint64(l.order.Uint32(hdr[l.wordSize+4:]))
+	if pgNo+pages-1 > db.Meta.LastPageNo || int64(l.headerSize())+int64(n.dataSize) > int64(pages)*pageSize {
+		return nil, xerrors.Errorf("%d bytes on %d overflow pages at page %d out of range", n.dataSize, pages, pgNo)
+	}
+	if err := budget.Pages(int64(pages)); err != nil {
+		return nil, err
+	}
+	return dbi.ReadBytes(db.file, int64(pgNo)*pageSize+int64(l.headerSize()), int(n.dataSize))
+}
+
+// walk calls fn with the nodes of the leaf pages of the tree of d, in key
+// order, charging the pages to budget. If damaged is set, it is called with
+// the pages and nodes that cannot be read, which are skipped unless it returns
+// an error.
+func (db *LMDB) walk(ctx context.Context, d DB, budget *dbi.Budget, fn func(n node) error,
+	damaged func(pgNo uint64, err error) error) error {
+	if d.Root == db.layout.invalidPgNo() {
+		// empty
+		return nil
+	}
+
+	fail := func(pgNo uint64, err error) error {
+		if damaged == nil {
+			return err
+		}
+		return damaged(pgNo, err)
+	}
+
+	type frame struct {
+		pgNo  uint64
+		level int
+	}
+	stack := []frame{{pgNo: d.Root, level: 1}}
+	for visited := uint64(0); len(stack) > 0; visited++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if visited > db.Meta.LastPageNo {
+			return xerrors.Errorf("cycle in the tree at page %d", stack[len(stack)-1].pgNo)
+		}
+
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if f.level > int(d.Depth) {
+			if err := fail(f.pgNo, xerrors.Errorf("page %d is deeper than the tree: %d levels", f.pgNo, d.Depth)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := budget.Page(); err != nil {
+			return err
+		}
+		p, err := db.readPage(f.pgNo)
+		if err != nil {
+			if err := fail(f.pgNo, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if p.flags&pageBranch != 0 {
+			// children are pushed last to first, to be walked first to last
+			for i := len(p.nodes) - 1; i >= 0; i-- {
+				stack = append(stack, frame{pgNo: db.child(p, i), level: f.level + 1})
+			}
+			continue
+		}
+
+		for i := range p.nodes {
+			n, err := db.leafNode(p, i)
+			if err != nil {
+				if err := fail(f.pgNo, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package rpmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/lmdb"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+)
+
+// lmdbBuilder lays out the pages of an LMDB data.mdb. Pages 0 and 1 are the
+// meta pages.
+type lmdbBuilder struct {
+	pageSize int
+	order    binary.ByteOrder
+	wordSize int
+	pages    [][]byte
+}
+
+func newLMDBBuilder(pageSize int, order binary.ByteOrder, wordSize int) *lmdbBuilder {
+	return &lmdbBuilder{
+		pageSize: pageSize,
+		order:    order,
+		wordSize: wordSize,
+		pages:    [][]byte{make([]byte, pageSize), make([]byte, pageSize)},
+	}
+}
+
+func (b *lmdbBuilder) putWord(buf []byte, v uint64) {
+	if b.wordSize == 8 {
+		b.order.PutUint64(buf, v)
+	} else {
+		b.order.PutUint32(buf, uint32(v))
+	}
+}
+
+func (b *lmdbBuilder) headerSize() int {
+	return b.wordSize + 8
+}
+
+// newPages allocates n contiguous pages, of which only the first has a
+// header.
+func (b *lmdbBuilder) newPages(flags uint16, n int) (uint64, []byte) {
+	pgNo := uint64(len(b.pages))
+	page := make([]byte, n*b.pageSize)
+	b.putWord(page, pgNo)
+	b.order.PutUint16(page[b.wordSize+2:], flags)
+	for i := 0; i < n; i++ {
+		b.pages = append(b.pages, page[i*b.pageSize:(i+1)*b.pageSize])
+	}
+	return pgNo, page
+}
+
+// lmdbNode is a node of a branch or leaf page: the key and, on leaf pages,
+// the data, with the node flags.
+type lmdbNode struct {
+	key, data []byte
+	flags     uint16
+	// child is the page number of branch nodes
+	child uint64
+}
+
+// nodeMax is me_nodemax, the size above which values go to overflow pages.
+func (b *lmdbBuilder) nodeMax() int {
+	return ((b.pageSize-b.headerSize())/2)&^1 - 2
+}
+
+// leafNode stores the value on overflow pages if it is too large.
+func (b *lmdbBuilder) leafNode(key, value []byte) lmdbNode {
+	if 8+len(key)+len(value) <= b.nodeMax() {
+		return lmdbNode{key: key, data: value}
+	}
+	pages := (b.headerSize() + len(value) + b.pageSize - 1) / b.pageSize
+	pgNo, page := b.newPages(0x04, pages)
+	b.order.PutUint32(page[b.wordSize+4:], uint32(pages))
+	copy(page[b.headerSize():], value)
+
+	ptr := make([]byte, b.wordSize)
+	b.putWord(ptr, pgNo)
+	return lmdbNode{key: key, data: ptr, flags: 0x01, child: uint64(len(value))}
+}
+
+// level packs the nodes onto pages with the given flags, and returns the
+// branch nodes pointing to them.
+func (b *lmdbBuilder) level(flags uint16, nodes []lmdbNode) []lmdbNode {
+	var parents []lmdbNode
+	var page []byte
+	var pgNo uint64
+	var lower, upper int
+	for _, n := range nodes {
+		size := 8 + len(n.key)
+		if flags == 0x02 {
+			size += len(n.data)
+		}
+		size += size & 1
+		if page == nil || lower+2 > upper-size {
+			pgNo, page = b.newPages(flags, 1)
+			lower, upper = b.headerSize(), b.pageSize
+			// the first key of a branch page is left out
+			parents = append(parents, lmdbNode{key: n.key, child: pgNo})
+			if flags == 0x01 {
+				n.key = nil
+				size = 8
+			}
+		}
+
+		upper -= size
+		b.order.PutUint16(page[lower:], uint16(upper))
+		lower += 2
+		node := page[upper:]
+		switch flags {
+		case 0x01:
+			b.order.PutUint32(node, uint32(n.child))
+			b.order.PutUint16(node[4:], uint16(n.child>>32))
+		case 0x02:
+			size := uint32(len(n.data))
+			if n.flags&0x01 != 0 {
+				size = uint32(n.child)
+			}
+			b.order.PutUint32(node, size)
+			b.order.PutUint16(node[4:], n.flags)
+		}
+		b.order.PutUint16(node[6:], uint16(len(n.key)))
+		copy(node[8:], n.key)
+		copy(node[8+len(n.key):], n.data)
+		b.order.PutUint16(page[b.wordSize+4:], uint16(lower))
+		b.order.PutUint16(page[b.wordSize+6:], uint16(upper))
+	}
+	return parents
+}
+
+// tree stores the sorted pairs in a B+tree and returns its MDB_db record.
+func (b *lmdbBuilder) tree(pairs []bdbPair) []byte {
+	db := make([]byte, 8+5*b.wordSize)
+	if len(pairs) == 0 {
+		b.putWord(db[8+4*b.wordSize:], 1<<(8*b.wordSize)-1)
+		return db
+	}
+
+	nodes := lo.Map(pairs, func(p bdbPair, _ int) lmdbNode {
+		return b.leafNode(p.key, p.value)
+	})
+	nodes = b.level(0x02, nodes)
+	depth := 1
+	for len(nodes) > 1 {
+		nodes = b.level(0x01, nodes)
+		depth++
+	}
+
+	b.order.PutUint16(db[6:], uint16(depth))
+	b.putWord(db[8+3*b.wordSize:], uint64(len(pairs)))
+	b.putWord(db[8+4*b.wordSize:], nodes[0].child)
+	return db
+}
+
+// meta fills in meta page i, with main as the main database.
+func (b *lmdbBuilder) meta(i int, txnID uint64, main []byte) {
+	page := b.pages[i]
+	b.putWord(page, uint64(i))
+	b.order.PutUint16(page[b.wordSize+2:], 0x08)
+
+	m := page[b.headerSize():]
+	b.order.PutUint32(m, lmdb.LMDB_Magic)
+	b.order.PutUint32(m[4:], lmdb.LMDB_Version)
+	b.putWord(m[8+b.wordSize:], 1<<20) // map size
+	dbs := m[8+2*b.wordSize:]
+	dbSize := 8 + 5*b.wordSize
+	// the free-list database is empty, and records the page size
+	b.order.PutUint32(dbs, uint32(b.pageSize))
+	b.putWord(dbs[8+4*b.wordSize:], 1<<(8*b.wordSize)-1)
+	copy(dbs[dbSize:], main)
+	b.putWord(dbs[2*dbSize:], uint64(len(b.pages)-1))
+	b.putWord(dbs[2*dbSize+b.wordSize:], txnID)
+}
+
+// lmdbEnv builds a data.mdb whose Packages database holds pairs. The first
+// meta page is stale and has an empty Packages database.
+func lmdbEnv(pageSize int, order binary.ByteOrder, wordSize int, pairs []bdbPair) []byte {
+	b := newLMDBBuilder(pageSize, order, wordSize)
+	stale := b.mainDB(b.tree(nil))
+	current := b.mainDB(b.tree(pairs))
+	b.meta(0, 1, stale)
+	b.meta(1, 2, current)
+	return bytes.Join(b.pages, nil)
+}
+
+// mainDB builds the main database naming packages and a few empty databases.
+func (b *lmdbBuilder) mainDB(packages []byte) []byte {
+	var nodes []lmdbNode
+	for _, name := range []string{"Basenames", "Name", "Packages"} {
+		db := packages
+		if name != "Packages" {
+			db = b.tree(nil)
+		}
+		nodes = append(nodes, lmdbNode{key: []byte(name), data: db, flags: 0x02})
+	}
+
+	main := make([]byte, 8+5*b.wordSize)
+	parents := b.level(0x02, nodes)
+	b.order.PutUint16(main[6:], 1)
+	b.putWord(main[8+3*b.wordSize:], uint64(len(nodes)))
+	b.putWord(main[8+4*b.wordSize:], parents[0].child)
+	return main
+}
+
+func TestLMDB(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	db, err := Open(file)
+	require.NoError(t, err)
+	want := listPackages(t, db)
+	sort.Slice(want, func(i, j int) bool {
+		return want[i].Instance < want[j].Instance
+	})
+
+	source, err := ndb.Open(file)
+	require.NoError(t, err)
+	defer source.Close()
+	var headers []dbi.Entry
+	for entry := range source.Read() {
+		require.NoError(t, entry.Err)
+		headers = append(headers, dbi.Entry{Value: bytes.Clone(entry.Value), Instance: entry.Instance})
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].Instance < headers[j].Instance
+	})
+
+	tests := []struct {
+		name     string
+		pageSize int
+		order    binary.ByteOrder
+		wordSize int
+	}{
+		{name: "64-bit little endian", pageSize: 4096, order: binary.LittleEndian, wordSize: 8},
+		{name: "64-bit big endian", pageSize: 4096, order: binary.BigEndian, wordSize: 8},
+		{name: "32-bit little endian", pageSize: 4096, order: binary.LittleEndian, wordSize: 4},
+		{name: "32-bit big endian", pageSize: 4096, order: binary.BigEndian, wordSize: 4},
+		// deeper trees, with every header on overflow pages
+		{name: "small pages", pageSize: 512, order: binary.LittleEndian, wordSize: 8},
+		// most headers fit on the leaf pages
+		{name: "large pages", pageSize: 65536, order: binary.BigEndian, wordSize: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := func(instance uint32) []byte {
+				k := make([]byte, 4)
+				tt.order.PutUint32(k, instance)
+				return k
+			}
+			// key 0 holds the next free instance
+			pairs := []bdbPair{{key: key(0), value: key(want[len(want)-1].Instance + 1)}}
+			for _, header := range headers {
+				pairs = append(pairs, bdbPair{key: key(header.Instance), value: header.Value})
+			}
+
+			path := filepath.Join(t.TempDir(), "data.mdb")
+			require.NoError(t, os.WriteFile(path, lmdbEnv(tt.pageSize, tt.order, tt.wordSize, pairs), 0o644))
+
+			format, err := DetectFormat(path)
+			require.NoError(t, err)
+			assert.Equal(t, FormatLMDB, format.Kind)
+			assert.Equal(t, tt.order == binary.BigEndian, format.LMDB.BigEndian)
+			assert.Equal(t, tt.wordSize, format.LMDB.WordSize)
+			assert.Equal(t, uint32(tt.pageSize), format.LMDB.PageSize)
+
+			db, err := Open(path)
+			require.NoError(t, err)
+			defer db.Close()
+			// the second meta page is current
+			assert.Equal(t, uint64(2), db.Db.(*lmdb.LMDB).Meta.TxnID)
+
+			got := listPackages(t, db)
+			assert.Equal(t, want, got)
+		})
+	}
+
+	t.Run("root", func(t *testing.T) {
+		root := t.TempDir()
+		dir := filepath.Join(root, "var", "lib", "rpm")
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		pairs := lo.Map(headers, func(header dbi.Entry, _ int) bdbPair {
+			return bdbPair{key: binary.LittleEndian.AppendUint32(nil, header.Instance), value: header.Value}
+		})
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "data.mdb"),
+			lmdbEnv(4096, binary.LittleEndian, 8, pairs), 0o644))
+
+		db, discovery, err := OpenRoot(root)
+		require.NoError(t, err)
+		defer db.Close()
+		assert.Equal(t, "var/lib/rpm/data.mdb", discovery.Path)
+		assert.Len(t, listPackages(t, db), len(want))
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		pairs := lo.Map(headers, func(header dbi.Entry, _ int) bdbPair {
+			return bdbPair{key: binary.LittleEndian.AppendUint32(nil, header.Instance), value: header.Value}
+		})
+		env := lmdbEnv(4096, binary.LittleEndian, 8, pairs)
+
+		tests := []struct {
+			name    string
+			corrupt func(env []byte) []byte
+			wantErr string
+		}{
+			{
+				name: "truncated",
+				corrupt: func(env []byte) []byte {
+					return env[:len(env)-4096]
+				},
+				wantErr: "truncated LMDB environment",
+			},
+			{
+				name: "no Packages",
+				corrupt: func(env []byte) []byte {
+					// rename it in the main database of both meta pages
+					return bytes.ReplaceAll(env, []byte("Packages"), []byte("Packagez"))
+				},
+				wantErr: "no Packages database in the environment",
+			},
+			{
+				name: "page number",
+				corrupt: func(env []byte) []byte {
+					// the last page is the leaf page of the current main database
+					binary.LittleEndian.PutUint64(env[len(env)-4096:], 1)
+					return env
+				},
+				wantErr: "claims to be page 1",
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				env := tt.corrupt(bytes.Clone(env))
+				db, err := OpenReaderAt(bytes.NewReader(env), int64(len(env)))
+				if err == nil {
+					_, err = db.ListPackages()
+				}
+				assert.ErrorContains(t, err, tt.wantErr)
+			})
+		}
+	})
+}
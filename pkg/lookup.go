@@ -0,0 +1,152 @@
+package rpmdb
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/samber/lo"
+	"golang.org/x/xerrors"
+)
+
+// WhatProvides returns the packages that provide the capability name.
+func (d *RpmDB) WhatProvides(name string) ([]*PackageInfo, error) {
+	return d.WhatProvidesContext(context.Background(), name)
+}
+
+// WhatProvidesContext is like WhatProvides, but gives up with ctx.Err() once
+// ctx is done.
+func (d *RpmDB) WhatProvidesContext(ctx context.Context, name string) ([]*PackageInfo, error) {
+	return d.find(ctx, dbi.IndexProvidename, name, false, func(pkg *PackageInfo) bool {
+		return lo.Contains(pkg.Provides, name)
+	})
+}
+
+// WhatRequires returns the packages that require the capability name.
+func (d *RpmDB) WhatRequires(name string) ([]*PackageInfo, error) {
+	return d.WhatRequiresContext(context.Background(), name)
+}
+
+// WhatRequiresContext is like WhatRequires, but gives up with ctx.Err() once
+// ctx is done.
+func (d *RpmDB) WhatRequiresContext(ctx context.Context, name string) ([]*PackageInfo, error) {
+	return d.find(ctx, dbi.IndexRequirename, name, false, func(pkg *PackageInfo) bool {
+		return lo.Contains(pkg.Requires, name)
+	})
+}
+
+// FileOwner returns the packages that installed the file at the absolute
+// path. Directories and files shared by several packages have more than one
+// owner.
+func (d *RpmDB) FileOwner(filePath string) ([]*PackageInfo, error) {
+	return d.FileOwnerContext(context.Background(), filePath)
+}
+
+// FileOwnerContext is like FileOwner, but gives up with ctx.Err() once ctx is
+// done.
+func (d *RpmDB) FileOwnerContext(ctx context.Context, filePath string) ([]*PackageInfo, error) {
+	dir, base := path.Split(filePath)
+	return d.find(ctx, dbi.IndexBasenames, base, false, func(pkg *PackageInfo) bool {
+		for i := range pkg.BaseNames {
+			if ownsFile(pkg, i, dir, base) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ownsFile reports whether the i-th file of pkg is dir + base.
+func ownsFile(pkg *PackageInfo, i int, dir, base string) bool {
+	if i >= len(pkg.BaseNames) || i >= len(pkg.DirIndexes) || pkg.BaseNames[i] != base {
+		return false
+	}
+	dirIndex := int(pkg.DirIndexes[i])
+	return dirIndex >= 0 && dirIndex < len(pkg.DirNames) && pkg.DirNames[dirIndex] == dir
+}
+
+// find returns the packages that index refers to for key and that match.
+// Only the headers the index refers to are decoded; if the backend has no
+// such index, every package is scanned instead. If first is set, find stops
+// at the first match. Packages are returned in database order.
+func (d *RpmDB) find(ctx context.Context, index dbi.Index, key string, first bool,
+	match func(pkg *PackageInfo) bool) ([]*PackageInfo, error) {
+	pkgs, err := d.findIndexed(ctx, index, key, first, match)
+	if !xerrors.Is(err, dbi.ErrNoIndex) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return pkgs, err
+	}
+
+	it := d.Packages(ctx)
+	defer it.Close()
+
+	for it.Next() {
+		if pkg := it.Package(); match(pkg) {
+			pkgs = append(pkgs, pkg)
+			if first {
+				break
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, xerrors.Errorf("unable to list packages: %w", err)
+	}
+
+	return pkgs, nil
+}
+
+// findIndexed is find for backends with indexes. It returns dbi.ErrNoIndex
+// if the backend has no such index.
+func (d *RpmDB) findIndexed(ctx context.Context, index dbi.Index, key string, first bool,
+	match func(pkg *PackageInfo) bool) ([]*PackageInfo, error) {
+	lookup, ok := d.Db.(dbi.IndexLookup)
+	if !ok {
+		return nil, dbi.ErrNoIndex
+	}
+
+	matches, err := lookup.LookupIndex(ctx, index, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// instances grow as packages are installed, which is also database order
+	instances := lo.Uniq(lo.Map(matches, func(m dbi.IndexMatch, _ int) uint32 {
+		return m.Instance
+	}))
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i] < instances[j]
+	})
+
+	var pkgs []*PackageInfo
+	for _, instance := range instances {
+		pkg, err := d.readInstance(ctx, lookup, instance)
+		if xerrors.Is(err, dbi.ErrNotFound) {
+			// a stale index entry, which rpm ignores as well
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if match(pkg) {
+			pkgs = append(pkgs, pkg)
+			if first {
+				break
+			}
+		}
+	}
+
+	return pkgs, nil
+}
+
+func (d *RpmDB) readInstance(ctx context.Context, lookup dbi.IndexLookup, instance uint32) (*PackageInfo, error) {
+	entry, err := lookup.ReadInstance(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+	return parseEntry(entry, FieldAll, d.limits)
+}
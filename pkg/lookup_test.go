@@ -0,0 +1,203 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/sqlite3"
+)
+
+// indexOnlyDB fails every full read of the database, so lookups must use the
+// indexes.
+type indexOnlyDB struct {
+	indexedDB
+}
+
+type indexedDB interface {
+	dbi.RpmDBInterface
+	dbi.IndexLookup
+}
+
+func (db indexOnlyDB) Read() <-chan dbi.Entry {
+	return db.ReadContext(context.Background())
+}
+
+func (db indexOnlyDB) ReadContext(context.Context) <-chan dbi.Entry {
+	entries := make(chan dbi.Entry, 1)
+	entries <- dbi.Entry{Err: xerrors.New("database scanned")}
+	close(entries)
+	return entries
+}
+
+func TestLookup(t *testing.T) {
+	openers := []struct {
+		name string
+		open func(t *testing.T, file string) *RpmDB
+	}{
+		{
+			name: "scan",
+			open: func(t *testing.T, file string) *RpmDB {
+				b, err := os.ReadFile(file)
+				require.NoError(t, err)
+				db, err := sqlite3.OpenReaderAt(bytes.NewReader(b), int64(len(b)))
+				require.NoError(t, err)
+				// hide the indexes
+				return &RpmDB{Db: struct{ dbi.RpmDBInterface }{db}}
+			},
+		},
+		{
+			name: "SQL",
+			open: func(t *testing.T, file string) *RpmDB {
+				db, err := sqlite3.Open(file)
+				require.NoError(t, err)
+				return &RpmDB{Db: indexOnlyDB{db}}
+			},
+		},
+		{
+			name: "pages",
+			open: func(t *testing.T, file string) *RpmDB {
+				b, err := os.ReadFile(file)
+				require.NoError(t, err)
+				db, err := sqlite3.OpenReaderAt(bytes.NewReader(b), int64(len(b)))
+				require.NoError(t, err)
+				return &RpmDB{Db: indexOnlyDB{db}}
+			},
+		},
+	}
+
+	const file = "testdata/cbl-mariner-2.0/rpmdb.sqlite"
+	db, err := Open(file)
+	require.NoError(t, err)
+	all := listPackages(t, db)
+
+	filter := func(match func(pkg *PackageInfo) bool) []string {
+		return lo.FilterMap(all, func(pkg *PackageInfo, _ int) (string, bool) {
+			return pkg.Name, match(pkg)
+		})
+	}
+	names := func(pkgs []*PackageInfo) []string {
+		return lo.Map(pkgs, func(pkg *PackageInfo, _ int) string {
+			return pkg.Name
+		})
+	}
+	ownedBy := func(filePath string) func(pkg *PackageInfo) bool {
+		return func(pkg *PackageInfo) bool {
+			files, err := pkg.InstalledFileNames()
+			require.NoError(t, err)
+			return lo.Contains(files, filePath)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		lookup func(db *RpmDB) ([]*PackageInfo, error)
+		want   []string
+	}{
+		{
+			name: "WhatProvides",
+			lookup: func(db *RpmDB) ([]*PackageInfo, error) {
+				return db.WhatProvides("/bin/sh")
+			},
+			want: []string{"bash"},
+		},
+		{
+			name: "WhatRequires",
+			lookup: func(db *RpmDB) ([]*PackageInfo, error) {
+				return db.WhatRequires("libc.so.6()(64bit)")
+			},
+			want: filter(func(pkg *PackageInfo) bool {
+				return lo.Contains(pkg.Requires, "libc.so.6()(64bit)")
+			}),
+		},
+		{
+			name: "FileOwner",
+			lookup: func(db *RpmDB) ([]*PackageInfo, error) {
+				return db.FileOwner("/bin/bash")
+			},
+			want: []string{"bash"},
+		},
+		{
+			name: "FileOwner directory",
+			lookup: func(db *RpmDB) ([]*PackageInfo, error) {
+				return db.FileOwner("/etc")
+			},
+			want: filter(ownedBy("/etc")),
+		},
+		{
+			name: "no match",
+			lookup: func(db *RpmDB) ([]*PackageInfo, error) {
+				return db.WhatProvides("no-such-capability")
+			},
+			want: []string{},
+		},
+	}
+
+	for _, opener := range openers {
+		t.Run(opener.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					db := opener.open(t, file)
+					defer db.Close()
+
+					pkgs, err := tt.lookup(db)
+					require.NoError(t, err)
+					assert.Equal(t, tt.want, names(pkgs))
+				})
+			}
+
+			t.Run("Package", func(t *testing.T) {
+				db := opener.open(t, file)
+				defer db.Close()
+
+				pkg, err := db.Package("glibc")
+				require.NoError(t, err)
+				pkg.IndexEntries = nil
+				want, _ := lo.Find(all, func(pkg *PackageInfo) bool {
+					return pkg.Name == "glibc"
+				})
+				assert.Equal(t, want, pkg)
+
+				_, err = db.Package("no-such-package")
+				assert.ErrorContains(t, err, "no-such-package is not installed")
+			})
+
+			t.Run("PackageByInstance", func(t *testing.T) {
+				db := opener.open(t, file)
+				defer db.Close()
+
+				pkg, err := db.PackageByInstance(all[5].Instance)
+				require.NoError(t, err)
+				pkg.IndexEntries = nil
+				assert.Equal(t, all[5], pkg)
+			})
+		})
+	}
+
+	t.Run("other formats", func(t *testing.T) {
+		db, err := Open("testdata/libuuid/Packages")
+		require.NoError(t, err)
+		defer db.Close()
+
+		pkgs, err := db.FileOwner("/usr/lib64/libuuid.so.1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"libuuid"}, names(pkgs))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		db := openers[2].open(t, file)
+		defer db.Close()
+		_, err := db.WhatRequiresContext(ctx, "libc.so.6()(64bit)")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
@@ -0,0 +1,212 @@
+package ndb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* Every index is a blob of Index.db in the idx format, tagged with the rpm
+   tag it indexes:
+
+   https://github.com/rpm-software-management/rpm/blob/rpm-4.17.0-release/lib/backend/ndb/rpmidx.c
+
+   The 64 byte idx header is followed by a hash table of NSlots slots, and then
+   by the keys. A slot has 8 bytes, the offset of its key and its data. The
+   bits of XMask are too high for a key offset, and hold those bits of the key
+   hash instead. The 4 bytes of overflow data
+   of every slot follow the last slot. A key offset of 0 marks a free slot and
+   1 a deleted one. Collisions are resolved by probing further and further
+   away. Keys are stored once, prefixed by their length in 1, 3 or 7 bytes.
+
+   The data packs the package index and the tag index of the key, and spills
+   into the overflow data if either is too large.
+*/
+
+// IDXHeader is the header of an index blob.
+type IDXHeader struct {
+	Magic      uint32
+	Version    uint32
+	Generation uint32
+	NSlots     uint32
+	UsedSlots  uint32
+	Dummy      uint32
+	XMask      uint32
+	KeyEnd     uint32
+	KeyExcess  uint32
+	_          [7]uint32
+}
+
+const (
+	IDX_Magic      = 'R' | 'p'<<8 | 'm'<<16 | 'I'<<24
+	IDX_Version    = 0
+	IDX_HeaderSize = 64
+	IDX_SlotSize   = 8 + 4 // the slot and its overflow data
+
+	// IDX_XDBSubtag is the xdb subtag of the indexes in use, rather than
+	// being rebuilt.
+	IDX_XDBSubtag = 0
+)
+
+// idxDB is a read-only index blob at offset off of file.
+type idxDB struct {
+	file   io.ReaderAt
+	header IDXHeader
+	slots  int64 // offset of the slots
+	keys   int64 // offset of the keys
+}
+
+func openIdx(r io.ReaderAt, off, size int64) (*idxDB, error) {
+	var header IDXHeader
+	if err := binary.Read(io.NewSectionReader(r, off, size), binary.LittleEndian, &header); err != nil {
+		return nil, xerrors.Errorf("failed to read idx header: %w", err)
+	}
+	if header.Magic != IDX_Magic || header.Version != IDX_Version {
+		return nil, xerrors.Errorf("invalid or unsupported idx format: magic %x, version %d", header.Magic, header.Version)
+	}
+	if header.NSlots == 0 || header.NSlots&(header.NSlots-1) != 0 {
+		return nil, xerrors.Errorf("unexpected idx slot count: %d", header.NSlots)
+	}
+
+	keys := IDX_HeaderSize + int64(header.NSlots)*IDX_SlotSize
+	if keys+int64(header.KeyEnd) > size {
+		return nil, xerrors.Errorf("idx of %d slots and %d bytes of keys exceeds its blob of %d bytes",
+			header.NSlots, header.KeyEnd, size)
+	}
+
+	return &idxDB{
+		file:   r,
+		header: header,
+		slots:  off + IDX_HeaderSize,
+		keys:   off + keys,
+	}, nil
+}
+
+// lookup returns the package and tag indexes of key, like rpmidxGet.
+func (idx *idxDB) lookup(ctx context.Context, key []byte) ([]dbi.IndexMatch, error) {
+	nslots := idx.header.NSlots
+	hmask := nslots - 1
+
+	xmask := idx.header.XMask
+
+	var matches []dbi.IndexMatch
+	keyh := murmurHash(key)
+	h, hh := keyh&hmask, uint32(7)
+	for probe := uint32(0); probe < nslots; probe, h, hh = probe+1, (h+hh)&hmask, hh+1 {
+		if probe%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		slot, err := dbi.ReadSlice(idx.file, idx.slots+8*int64(h), 8)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read idx slot %d: %w", h, err)
+		}
+		x := binary.LittleEndian.Uint32(slot)
+		if x == 0 {
+			break
+		}
+		if x == 1 {
+			// deleted
+			continue
+		}
+
+		if x&xmask != keyh&xmask {
+			continue
+		}
+
+		k, err := idx.key(x &^ xmask)
+		if err != nil {
+			return nil, xerrors.Errorf("idx slot %d: %w", h, err)
+		}
+		if !bytes.Equal(k, key) {
+			continue
+		}
+
+		data := binary.LittleEndian.Uint32(slot[4:])
+		var ovlData uint32
+		if data&0x80000000 != 0 {
+			ovl, err := dbi.ReadSlice(idx.file, idx.slots+8*int64(nslots)+4*int64(h), 4)
+			if err != nil {
+				return nil, xerrors.Errorf("failed to read idx overflow data %d: %w", h, err)
+			}
+			ovlData = binary.LittleEndian.Uint32(ovl)
+		}
+		matches = append(matches, decodeIdxData(data, ovlData))
+	}
+
+	return matches, nil
+}
+
+// key returns the key at offset off, see decodekeyl.
+func (idx *idxDB) key(off uint32) ([]byte, error) {
+	keyEnd := idx.header.KeyEnd
+	if off == 0 || off >= keyEnd {
+		return nil, xerrors.Errorf("idx key offset %d out of bounds: %d", off, keyEnd)
+	}
+
+	prefix, err := dbi.ReadSlice(idx.file, idx.keys+int64(off), int(min(keyEnd-off, 7)))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read idx key: %w", err)
+	}
+	var keyl, hl uint32
+	switch {
+	case prefix[0] != 255:
+		keyl, hl = uint32(prefix[0]), 1
+	case len(prefix) >= 3 && (prefix[1] != 255 || prefix[2] != 255):
+		keyl, hl = uint32(prefix[1])|uint32(prefix[2])<<8, 3
+	case len(prefix) == 7:
+		keyl, hl = binary.LittleEndian.Uint32(prefix[3:]), 7
+	default:
+		return nil, xerrors.Errorf("truncated idx key length at offset %d", off)
+	}
+	if uint64(off)+uint64(hl)+uint64(keyl) > uint64(keyEnd) {
+		return nil, xerrors.Errorf("idx key at offset %d of %d bytes out of bounds: %d", off, keyl, keyEnd)
+	}
+
+	return dbi.ReadSlice(idx.file, idx.keys+int64(off+hl), int(keyl))
+}
+
+// decodeIdxData unpacks the data of a slot, see decodedata.
+func decodeIdxData(data, ovlData uint32) dbi.IndexMatch {
+	if data&0x80000000 == 0 {
+		return dbi.IndexMatch{Instance: data & 0x000fffff, TagIndex: data >> 20}
+	}
+	if data&0x40000000 != 0 {
+		return dbi.IndexMatch{Instance: ovlData, TagIndex: data ^ 0xc0000000}
+	}
+	return dbi.IndexMatch{Instance: ovlData & 0x00ffffff, TagIndex: (data^0x80000000)<<8 | ovlData>>24}
+}
+
+// murmurHash is the variant of MurmurHash2 that rpmidx.c hashes keys with.
+func murmurHash(s []byte) uint32 {
+	const m = 0x5bd1e995
+	h := uint32(len(s)) * m
+	for ; len(s) >= 4; s = s[4:] {
+		h += binary.LittleEndian.Uint32(s)
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(s) {
+	case 3:
+		h += uint32(s[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(s[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(s[0])
+		h *= m
+		h ^= h >> 16
+	}
+	h *= m
+	h ^= h >> 10
+	h *= m
+	h ^= h >> 17
+	return h
+}
@@ -0,0 +1,138 @@
+package ndb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+// indexTags are the rpm tags that tag the index blobs in Index.db.
+var indexTags = map[dbi.Index]uint32{
+	dbi.IndexName:        1000, // RPMTAG_NAME
+	dbi.IndexProvidename: 1047, // RPMTAG_PROVIDENAME
+	dbi.IndexRequirename: 1049, // RPMTAG_REQUIRENAME
+	dbi.IndexBasenames:   1117, // RPMTAG_BASENAMES
+	dbi.IndexDirnames:    1118, // RPMTAG_DIRNAMES
+	dbi.IndexInstalltid:  1128, // RPMTAG_INSTALLTID
+	dbi.IndexSha1header:  269,  // RPMTAG_SHA1HEADER
+	dbi.IndexSigmd5:      261,  // RPMTAG_SIGMD5
+}
+
+var _ dbi.IndexLookup = (*RpmNDB)(nil)
+
+// LookupIndex implements dbi.IndexLookup with the indexes in Index.db next to
+// Packages.db. It returns dbi.ErrNoIndex if the database was not opened from
+// a path, if there is no such index, or if the indexes are out of sync with
+// Packages.db and rpm would rebuild them.
+func (db *RpmNDB) LookupIndex(ctx context.Context, index dbi.Index, key string) ([]dbi.IndexMatch, error) {
+	idx, err := db.openIndex(index)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := idx.lookup(ctx, []byte(key))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to look up %s: %w", index, err)
+	}
+	return matches, nil
+}
+
+// ReadInstance implements dbi.IndexLookup. The slots are kept in memory, so
+// only the blob of the package is read.
+func (db *RpmNDB) ReadInstance(ctx context.Context, instance uint32) (dbi.Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return dbi.Entry{}, err
+	}
+
+	for i, slot := range db.slots {
+		if slot.SlotMagic != NDB_SlotMagic || slot.PkgIndex == 0 || slot.PkgIndex != instance {
+			continue
+		}
+		entry := db.entry(i, slot, nil)
+		if entry.Err != nil {
+			return dbi.Entry{}, xerrors.Errorf("failed to read package %d: %w", instance, entry.Err)
+		}
+		return entry, nil
+	}
+	return dbi.Entry{}, xerrors.Errorf("%d: %w", instance, dbi.ErrNotFound)
+}
+
+// openIndex opens the index blob for index, and keeps Index.db open until db
+// is closed.
+func (db *RpmNDB) openIndex(index dbi.Index) (*idxDB, error) {
+	tag, ok := indexTags[index]
+	if !ok || (db.dir == "" && db.OpenIndexFile == nil) {
+		return nil, xerrors.Errorf("%s: %w", index, dbi.ErrNoIndex)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if idx, ok := db.indexes[index]; ok {
+		return idx, nil
+	}
+
+	if db.xdb == nil {
+		open := db.OpenIndexFile
+		if open == nil {
+			open = func(name string) (*os.File, error) {
+				return dbi.OpenNoFollow(filepath.Join(db.dir, name))
+			}
+		}
+		file, err := open("Index.db")
+		switch {
+		case xerrors.Is(err, os.ErrNotExist):
+			return nil, xerrors.Errorf("%s: %w", index, dbi.ErrNoIndex)
+		case xerrors.Is(err, dbi.ErrSymlink):
+			// used as if it was missing, so that lookups read Packages.db instead
+			return nil, xerrors.Errorf("Index.db is a symlink: %w", dbi.ErrNoIndex)
+		case err != nil:
+			return nil, xerrors.Errorf("failed to open Index.db: %w", err)
+		}
+		x, err := openXDBFile(file)
+		if err != nil {
+			return nil, err
+		}
+		db.xdb = x
+	}
+	if db.xdb.header.UserGeneration != db.generation {
+		return nil, xerrors.Errorf("Index.db is of generation %d, Packages.db of %d: %w",
+			db.xdb.header.UserGeneration, db.generation, dbi.ErrNoIndex)
+	}
+
+	off, size, ok := db.xdb.blob(tag, IDX_XDBSubtag)
+	if !ok {
+		return nil, xerrors.Errorf("%s: %w", index, dbi.ErrNoIndex)
+	}
+	idx, err := openIdx(db.xdb.file, off, size)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open %s: %w", index, err)
+	}
+
+	if db.indexes == nil {
+		db.indexes = make(map[dbi.Index]*idxDB)
+	}
+	db.indexes[index] = idx
+	return idx, nil
+}
+
+// openXDBFile opens the Index.db in file, and closes it with the xdb.
+func openXDBFile(file *os.File) (*xdb, error) {
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	source := dbi.MapFile(file, info.Size())
+	x, err := openXDB(source, info.Size())
+	if err != nil {
+		_ = source.Close()
+		return nil, xerrors.Errorf("failed to open %s: %w", file.Name(), err)
+	}
+	x.closer = source
+	return x, nil
+}
@@ -22,10 +22,14 @@ SOFTWARE.
 package ndb
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/adler32"
 	"io"
 	"os"
+	"path/filepath"
+	"sync"
 	"unsafe"
 
 	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
@@ -52,17 +56,20 @@ import (
    index is zero). If a Slot Entry is non-free, the BlkOffset points to the "Block".
 
    The "Block" has a "Blob Header", directly followed by the "Blob" (the actual package headers) and
-   a Blob "tail" of up to 16 bytes. The "Blob" is checksummed using Adler32 from RFC1950.
+   a Blob "Tail" at the end of the last of BlkCount 16 byte blocks. The Tail holds the Adler32 from
+   RFC1950 of everything before it, the blob length again and its own magic.
 
-   This implementation is currently not validating the blob checksum.
+   Blobs are validated against all of these; see Validation for what happens to those that fail.
 */
 
-type ndbHeader struct {
+// Header is the NDB Header at the start of Packages.db.
+type Header struct {
 	HeaderMagic   uint32
 	NDBVersion    uint32
 	NDBGeneration uint32
 	SlotNPages    uint32
-	_             [4]uint32
+	NextPkgIndex  uint32
+	_             [3]uint32
 }
 
 type ndbSlotEntry struct {
@@ -75,19 +82,87 @@ type ndbSlotEntry struct {
 type ndbBlobHeader struct {
 	BlobMagic uint32
 	PkgIndex  uint32
+	// rpm stores a timestamp here, the checksum is in the tail
 	BlobCkSum uint32
 	BlobLen   uint32
 }
 
+type ndbBlobTail struct {
+	BlobCkSum uint32
+	BlobLen   uint32
+	TailMagic uint32
+}
+
+// Validation selects what Read does with a blob that fails validation.
+type Validation int
+
+const (
+	// ValidationStrict replaces the entry of the blob with a
+	// *CorruptionError.
+	ValidationStrict Validation = iota
+	// ValidationLenient reads the blob anyway, if its length can be read, and
+	// sets Entry.Corruption to the *CorruptionError.
+	ValidationLenient
+)
+
+// CorruptionError reports a blob that failed validation.
+type CorruptionError struct {
+	// Slot is the position of the slot in the slot pages, where the NDB
+	// Header takes the first two.
+	Slot      int
+	PkgIndex  uint32
+	BlkOffset uint32
+	Reason    string
+	// Err is the error reading the blob, if it could not be read at all.
+	Err error
+}
+
+func (e *CorruptionError) Error() string {
+	msg := fmt.Sprintf("corrupt NDB blob for pkg %d in slot %d at block %d: %s", e.PkgIndex, e.Slot, e.BlkOffset, e.Reason)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
 type RpmNDB struct {
-	file  *os.File
-	slots []ndbSlotEntry
+	file   io.ReaderAt
+	lock   *os.File
+	closer io.Closer
+	size   int64
+	slots  []ndbSlotEntry
+
+	// Validation and Limits must be set before the database is read.
+	Validation Validation
+	Limits     dbi.Limits
+	// OpenIndexFile opens Index.db next to Packages.db by name, and must be
+	// set before the indexes are used. By default it is opened from the
+	// directory of Packages.db, and a symlink is refused.
+	OpenIndexFile func(name string) (*os.File, error)
+
+	// directory of Packages.db, where Index.db is found
+	dir        string
+	generation uint32
+	mu         sync.Mutex
+	xdb        *xdb
+	indexes    map[dbi.Index]*idxDB
 }
 
 const (
 	NDB_SlotEntriesPerPage = 4096 / 16 /* 16 == unsafe.Sizeof(NDBSlotEntry) */
 	NDB_HeaderMagic        = 'R' | 'p'<<8 | 'm'<<16 | 'P'<<24
 	NDB_DBVersion          = 0
+
+	NDB_SlotMagic      = 'S' | 'l'<<8 | 'o'<<16 | 't'<<24
+	NDB_BlobMagic      = 'B' | 'l'<<8 | 'b'<<16 | 'S'<<24
+	NDB_BlobTailMagic  = 'B' | 'l'<<8 | 'b'<<16 | 'E'<<24
+	NDB_BlkSize        = 16
+	NDB_BlobHeaderSize = int64(unsafe.Sizeof(ndbBlobHeader{}))
+	NDB_BlobTailSize   = int64(unsafe.Sizeof(ndbBlobTail{}))
 )
 
 var ErrorInvalidNDB = xerrors.Errorf("invalid or unsupported NDB format")
@@ -100,18 +175,40 @@ func Open(path string) (*RpmNDB, error) {
 
 	err = syscallFlock(int(file.Fd()), syscallLOCK_SH)
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 
-	hdrBuff := ndbHeader{}
-	err = binary.Read(file, binary.LittleEndian, &hdrBuff)
+	info, err := file.Stat()
 	if err != nil {
-		return nil, xerrors.Errorf("failed to read metadata: %w", err)
+		_ = syscallFlock(int(file.Fd()), syscallLOCK_UN)
+		_ = file.Close()
+		return nil, err
 	}
 
-	if hdrBuff.HeaderMagic != NDB_HeaderMagic || hdrBuff.SlotNPages == 0 ||
-		hdrBuff.NDBVersion != NDB_DBVersion {
-		return nil, ErrorInvalidNDB
+	// blobs are sliced straight from the mapped file
+	source := dbi.MapFile(file, info.Size())
+	db, err := OpenReaderAt(source, info.Size())
+	if err != nil {
+		_ = syscallFlock(int(file.Fd()), syscallLOCK_UN)
+		_ = source.Close()
+		return nil, err
+	}
+	db.lock = file
+	db.closer = source
+	db.dir = filepath.Dir(path)
+
+	return db, nil
+}
+
+// OpenReaderAt parses an NDB Packages.db from r. No lock is taken and closing
+// the returned database does not close r.
+func OpenReaderAt(r io.ReaderAt, size int64) (*RpmNDB, error) {
+	file := io.NewSectionReader(r, 0, size)
+
+	hdrBuff, err := ReadHeader(file)
+	if err != nil {
+		return nil, err
 	}
 
 	// Sanity check against excessive memory usage
@@ -127,11 +224,29 @@ func Open(path string) (*RpmNDB, error) {
 	}
 
 	return &RpmNDB{
-		file:  file,
-		slots: slots,
+		file:       r,
+		size:       size,
+		slots:      slots,
+		generation: hdrBuff.NDBGeneration,
 	}, nil
 }
 
+// ReadHeader reads and validates the NDB Header of a Packages.db.
+func ReadHeader(r io.Reader) (*Header, error) {
+	hdrBuff := Header{}
+	err := binary.Read(r, binary.LittleEndian, &hdrBuff)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read metadata: %w", err)
+	}
+
+	if hdrBuff.HeaderMagic != NDB_HeaderMagic || hdrBuff.SlotNPages == 0 ||
+		hdrBuff.NDBVersion != NDB_DBVersion {
+		return nil, ErrorInvalidNDB
+	}
+
+	return &hdrBuff, nil
+}
+
 func (db *RpmNDB) GetPgSize() uint32 {
 	return 0
 }
@@ -141,71 +256,189 @@ func (db *RpmNDB) GetLastPgNo() uint32 {
 }
 
 func (db *RpmNDB) Close() error {
-	_ = syscallFlock(int(db.file.Fd()), syscallLOCK_UN)
-	return db.file.Close()
+	db.mu.Lock()
+	if db.xdb != nil {
+		_ = db.xdb.Close()
+		db.xdb = nil
+	}
+	db.indexes = nil
+	db.mu.Unlock()
+
+	if db.lock != nil {
+		_ = syscallFlock(int(db.lock.Fd()), syscallLOCK_UN)
+	}
+	if db.closer == nil {
+		return nil
+	}
+	return db.closer.Close()
 }
 
 func (db *RpmNDB) Read() <-chan dbi.Entry {
+	return db.ReadContext(context.Background())
+}
+
+func (db *RpmNDB) ReadContext(ctx context.Context) <-chan dbi.Entry {
+	return db.read(ctx, false)
+}
+
+var _ dbi.Salvager = (*RpmNDB)(nil)
+
+// SalvageContext implements dbi.Salvager. Slots with a bad magic and blobs
+// that cannot be read are reported and skipped.
+func (db *RpmNDB) SalvageContext(ctx context.Context) <-chan dbi.Entry {
+	return db.read(ctx, true)
+}
+
+func (db *RpmNDB) read(ctx context.Context, salvage bool) <-chan dbi.Entry {
 	entries := make(chan dbi.Entry)
 
 	go func() {
 		defer close(entries)
 
-		const NDB_BlobHeaderSize = int64(unsafe.Sizeof(ndbBlobHeader{}))
+		// the slot pages are all read up front
+		budget := dbi.NewBudget(db.Limits)
+		if err := budget.Pages(int64(len(db.slots)+2) / NDB_SlotEntriesPerPage); err != nil {
+			dbi.Send(ctx, entries, dbi.Entry{Err: err})
+			return
+		}
+
+		for i, slot := range db.slots {
+			if ctx.Err() != nil {
+				return
+			}
 
-		for _, slot := range db.slots {
-			const NDB_SlotMagic = 'S' | 'l'<<8 | 'o'<<16 | 't'<<24
 			if slot.SlotMagic != NDB_SlotMagic {
-				fmt.Println("bad slot magic", slot.SlotMagic)
-				entries <- dbi.Entry{
-					Err: xerrors.Errorf("bad slot Magic: %x", slot.SlotMagic),
+				if !dbi.Send(ctx, entries, dbi.Entry{
+					Err:      xerrors.Errorf("bad slot Magic: %x", slot.SlotMagic),
+					Location: slotLocation(i + 2),
+				}) || !salvage {
+					return
 				}
-				return
+				continue
 			}
 			// Empty slot?
 			if slot.PkgIndex == 0 {
 				continue
 			}
-			// Seek to Blob
-			_, err := db.file.Seek(int64(slot.BlkOffset)*NDB_BlobHeaderSize, io.SeekStart)
-			if err != nil {
-				entries <- dbi.Entry{
-					Err: err,
-				}
-				return
-			}
 
-			// Read Blob Header
-			blobHeaderBuff := ndbBlobHeader{}
-			err = binary.Read(db.file, binary.LittleEndian, &blobHeaderBuff)
-			if err != nil {
-				entries <- dbi.Entry{
-					Err: err,
-				}
+			entry := db.entry(i, slot, budget)
+			if !dbi.Send(ctx, entries, entry) || dbi.LimitExceeded(entry.Err) {
 				return
 			}
-			const NDB_BlobMagic = 'B' | 'l'<<8 | 'b'<<16 | 'S'<<24
-			if blobHeaderBuff.BlobMagic != NDB_BlobMagic {
-				entries <- dbi.Entry{
-					Err: xerrors.Errorf("unexpected NDB blob Magic for pkg %d: %x", slot.PkgIndex, blobHeaderBuff.BlobMagic),
-				}
-			}
-			if blobHeaderBuff.PkgIndex != slot.PkgIndex {
-				entries <- dbi.Entry{
-					Err: xerrors.Errorf("failed to find NDB blob for pkg %d", slot.PkgIndex),
-				}
-			}
-			// ### check that BlkCnt == (BLOBHEAD_SIZE + bloblen + BLOBTAIL_SIZE + PKGDB_BLK_SIZE - 1) / PKGDB_BLK_SIZE)
-
-			// Read Blob Content
-			BlobEntry := make([]byte, blobHeaderBuff.BlobLen)
-			_, err = db.file.Read(BlobEntry)
-			entries <- dbi.Entry{
-				Value: BlobEntry,
-				Err:   err,
-			}
 		}
 	}()
 
 	return entries
 }
+
+func slotLocation(slotNo int) string {
+	return fmt.Sprintf("slot %d", slotNo)
+}
+
+// entry reads the blob of the i-th slot, charging it to budget.
+func (db *RpmNDB) entry(i int, slot ndbSlotEntry, budget *dbi.Budget) dbi.Entry {
+	// the first two slots are the NDB Header
+	blob, err := db.readBlob(i+2, slot, budget)
+	entry := dbi.Entry{
+		Value:    blob,
+		Instance: slot.PkgIndex,
+		Location: slotLocation(i + 2),
+	}
+	if err != nil {
+		if blob != nil {
+			// only in lenient mode
+			entry.Corruption = err
+		} else {
+			entry = dbi.Entry{Err: err, Location: entry.Location}
+		}
+	}
+	return entry
+}
+
+// readBlob reads the blob of the slot at position slotNo and validates it,
+// like rpmpkgReadBlob does. In lenient mode, a blob that fails validation is
+// returned along with a *CorruptionError, unless it could not be read at all.
+func (db *RpmNDB) readBlob(slotNo int, slot ndbSlotEntry, budget *dbi.Budget) ([]byte, error) {
+	var corruption *CorruptionError
+	corrupt := func(err error, format string, args ...any) {
+		if corruption == nil {
+			corruption = &CorruptionError{
+				Slot:      slotNo,
+				PkgIndex:  slot.PkgIndex,
+				BlkOffset: slot.BlkOffset,
+				Reason:    fmt.Sprintf(format, args...),
+				Err:       err,
+			}
+		}
+	}
+	blobOffset := int64(slot.BlkOffset) * NDB_BlkSize
+
+	// Read Blob Header
+	blobHeader, err := dbi.ReadSlice(db.file, blobOffset, int(NDB_BlobHeaderSize))
+	if err != nil {
+		corrupt(err, "failed to read the blob header")
+		return nil, corruption
+	}
+	blobHeaderBuff := ndbBlobHeader{
+		BlobMagic: binary.LittleEndian.Uint32(blobHeader[0:]),
+		PkgIndex:  binary.LittleEndian.Uint32(blobHeader[4:]),
+		BlobCkSum: binary.LittleEndian.Uint32(blobHeader[8:]),
+		BlobLen:   binary.LittleEndian.Uint32(blobHeader[12:]),
+	}
+	if blobHeaderBuff.BlobMagic != NDB_BlobMagic {
+		corrupt(nil, "unexpected blob magic %x", blobHeaderBuff.BlobMagic)
+	}
+	if blobHeaderBuff.PkgIndex != slot.PkgIndex {
+		corrupt(nil, "blob belongs to pkg %d", blobHeaderBuff.PkgIndex)
+	}
+
+	blkCount := blobBlocks(int(blobHeaderBuff.BlobLen))
+	if blobOffset+blkCount*NDB_BlkSize > db.size {
+		corrupt(nil, "a blob of %d bytes runs past the end of the file", blobHeaderBuff.BlobLen)
+		return nil, corruption
+	}
+	if err := budget.Header(int64(blobHeaderBuff.BlobLen)); err != nil {
+		return nil, err
+	}
+	if int64(slot.BlkCount) != blkCount {
+		corrupt(nil, "%d blocks, but a blob of %d bytes takes %d", slot.BlkCount, blobHeaderBuff.BlobLen, blkCount)
+	} else {
+		// the tail is at the end of the last block, and the checksum covers
+		// everything before it
+		block, err := dbi.ReadSlice(db.file, blobOffset, int(blkCount*NDB_BlkSize))
+		if err != nil {
+			corrupt(err, "failed to read %d blocks", blkCount)
+			return nil, corruption
+		}
+		tailOffset := len(block) - int(NDB_BlobTailSize)
+		tail := ndbBlobTail{
+			BlobCkSum: binary.LittleEndian.Uint32(block[tailOffset:]),
+			BlobLen:   binary.LittleEndian.Uint32(block[tailOffset+4:]),
+			TailMagic: binary.LittleEndian.Uint32(block[tailOffset+8:]),
+		}
+		if tail.TailMagic != NDB_BlobTailMagic {
+			corrupt(nil, "unexpected blob tail magic %x", tail.TailMagic)
+		}
+		if tail.BlobLen != blobHeaderBuff.BlobLen {
+			corrupt(nil, "blob length %d in the tail, %d in the header", tail.BlobLen, blobHeaderBuff.BlobLen)
+		}
+		if sum := adler32.Checksum(block[:tailOffset]); sum != tail.BlobCkSum {
+			corrupt(nil, "Adler32 checksum %08x, expected %08x", sum, tail.BlobCkSum)
+		}
+	}
+
+	if corruption != nil && db.Validation != ValidationLenient {
+		return nil, corruption
+	}
+
+	// Read Blob Content, copied as it outlives the mapping
+	blob, err := dbi.ReadBytes(db.file, blobOffset+NDB_BlobHeaderSize, int(blobHeaderBuff.BlobLen))
+	if err != nil {
+		corrupt(err, "failed to read the blob")
+		return nil, corruption
+	}
+	if corruption != nil {
+		return blob, corruption
+	}
+	return blob, nil
+}
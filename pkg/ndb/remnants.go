@@ -0,0 +1,59 @@
+package ndb
+
+import (
+	"context"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+var _ dbi.RemnantSource = (*RpmNDB)(nil)
+
+// UnreferencedRegions implements dbi.RemnantSource. The blocks after the slot
+// pages that no slot refers to are returned, one region per run of
+// consecutive blocks. Slots with a bad magic are taken to refer to nothing.
+func (db *RpmNDB) UnreferencedRegions(ctx context.Context) ([]dbi.Region, error) {
+	blocks := db.size / NDB_BlkSize
+	// the slot pages, including the NDB Header
+	first := int64(len(db.slots) + 2)
+	if first >= blocks {
+		return nil, nil
+	}
+
+	live := make([]bool, blocks-first)
+	for _, slot := range db.slots {
+		if slot.SlotMagic != NDB_SlotMagic || slot.PkgIndex == 0 {
+			continue
+		}
+		start := max(int64(slot.BlkOffset), first)
+		end := min(int64(slot.BlkOffset)+int64(slot.BlkCount), blocks)
+		for blk := start; blk < end; blk++ {
+			live[blk-first] = true
+		}
+	}
+
+	var regions []dbi.Region
+	for i := 0; i < len(live); {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if live[i] {
+			i++
+			continue
+		}
+		start := i
+		for i < len(live) && !live[i] {
+			i++
+		}
+
+		extent := dbi.Extent{
+			Offset: (first + int64(start)) * NDB_BlkSize,
+			Length: int64(i-start) * NDB_BlkSize,
+		}
+		data, err := dbi.ReadBytes(db.file, extent.Offset, int(extent.Length))
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, dbi.Region{Extents: []dbi.Extent{extent}, Data: data})
+	}
+	return regions, nil
+}
@@ -0,0 +1,164 @@
+package ndb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"os"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* Writer lays out Packages.db the way rpmpkg.c leaves it after adding each
+   package to an empty database: just enough slot pages for the packages, the
+   slots in the order the packages were put, and their blobs packed after the
+   slot pages in the same order, without gaps. Every slot page is filled with
+   slot magics, so unused slots read as free.
+
+   Index.db is not written. rpm builds the indexes from Packages.db when it
+   does not find them.
+*/
+
+// Writer creates a Packages.db. It implements dbi.Writer.
+type Writer struct {
+	path  string
+	file  *os.File
+	blobs []writerBlob
+	// instances put so far
+	instances map[uint32]bool
+}
+
+type writerBlob struct {
+	instance uint32
+	blob     []byte
+}
+
+var _ dbi.Writer = (*Writer)(nil)
+
+// Create creates a Packages.db at path, which must not exist yet. The
+// packages are kept in memory and written by Close. Remove any Index.db left
+// next to path, as it does not describe the new database.
+func Create(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		path:      path,
+		file:      file,
+		instances: map[uint32]bool{},
+	}, nil
+}
+
+// Put implements dbi.Writer. The keys are not used, as rpm rebuilds Index.db.
+func (w *Writer) Put(instance uint32, blob []byte, _ map[dbi.Index][]dbi.IndexKey) error {
+	switch {
+	case instance == 0:
+		return xerrors.New("instance 0 is reserved")
+	case w.instances[instance]:
+		return xerrors.Errorf("instance %d is already taken", instance)
+	case int64(len(blob)) > int64(^uint32(0))-NDB_BlobHeaderSize-NDB_BlobTailSize:
+		return xerrors.Errorf("blob of %d bytes is too large", len(blob))
+	}
+
+	w.instances[instance] = true
+	w.blobs = append(w.blobs, writerBlob{instance: instance, blob: bytes.Clone(blob)})
+	return nil
+}
+
+// Close implements dbi.Writer. It writes the database and closes the file,
+// which is removed if that fails.
+func (w *Writer) Close() error {
+	err := w.write()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(w.path)
+	}
+	return err
+}
+
+func (w *Writer) write() error {
+	const pageSize = NDB_SlotEntriesPerPage * NDB_BlkSize
+	slotNPages := (len(w.blobs) + 2 + NDB_SlotEntriesPerPage - 1) / NDB_SlotEntriesPerPage
+	if slotNPages > 2048 {
+		// the limit OpenReaderAt enforces
+		return xerrors.Errorf("too many packages: %d", len(w.blobs))
+	}
+	slotPages := make([]byte, slotNPages*pageSize)
+
+	header := Header{
+		HeaderMagic: NDB_HeaderMagic,
+		NDBVersion:  NDB_DBVersion,
+		// rpm counts a generation for every package it adds
+		NDBGeneration: uint32(len(w.blobs)),
+		SlotNPages:    uint32(slotNPages),
+		NextPkgIndex:  1,
+	}
+	for _, b := range w.blobs {
+		header.NextPkgIndex = max(header.NextPkgIndex, b.instance+1)
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+		return xerrors.Errorf("failed to encode NDB header: %w", err)
+	}
+	copy(slotPages, buf.Bytes())
+
+	// the first two slots are the NDB Header
+	for i := 2; i < slotNPages*NDB_SlotEntriesPerPage; i++ {
+		binary.LittleEndian.PutUint32(slotPages[i*NDB_BlkSize:], NDB_SlotMagic)
+	}
+
+	blkOffset := uint32(slotNPages * pageSize / NDB_BlkSize)
+	for i, b := range w.blobs {
+		blkCount := uint32(blobBlocks(len(b.blob)))
+		slot := slotPages[(i+2)*NDB_BlkSize:]
+		binary.LittleEndian.PutUint32(slot[4:], b.instance)
+		binary.LittleEndian.PutUint32(slot[8:], blkOffset)
+		binary.LittleEndian.PutUint32(slot[12:], blkCount)
+		if blkOffset+blkCount < blkOffset {
+			return xerrors.New("the blobs do not fit in the database")
+		}
+		blkOffset += blkCount
+	}
+
+	if _, err := w.file.Write(slotPages); err != nil {
+		return xerrors.Errorf("failed to write slot pages: %w", err)
+	}
+	for i, b := range w.blobs {
+		if _, err := w.file.Write(blobBlock(b, uint32(i+1))); err != nil {
+			return xerrors.Errorf("failed to write blob of pkg %d: %w", b.instance, err)
+		}
+	}
+	if err := w.file.Sync(); err != nil {
+		return xerrors.Errorf("failed to sync: %w", err)
+	}
+	return nil
+}
+
+// blobBlock returns the blocks of a blob: its header, the blob, zero padding and
+// the tail at the end of the last block, as rpmpkgWriteBlob writes them. Like
+// in the blobs rpm writes, the header holds the generation the blob was added
+// with.
+func blobBlock(b writerBlob, generation uint32) []byte {
+	block := make([]byte, blobBlocks(len(b.blob))*NDB_BlkSize)
+
+	binary.LittleEndian.PutUint32(block[0:], NDB_BlobMagic)
+	binary.LittleEndian.PutUint32(block[4:], b.instance)
+	binary.LittleEndian.PutUint32(block[8:], generation)
+	binary.LittleEndian.PutUint32(block[12:], uint32(len(b.blob)))
+	copy(block[NDB_BlobHeaderSize:], b.blob)
+
+	tail := block[len(block)-int(NDB_BlobTailSize):]
+	binary.LittleEndian.PutUint32(tail[0:], adler32.Checksum(block[:len(block)-int(NDB_BlobTailSize)]))
+	binary.LittleEndian.PutUint32(tail[4:], uint32(len(b.blob)))
+	binary.LittleEndian.PutUint32(tail[8:], NDB_BlobTailMagic)
+	return block
+}
+
+// blobBlocks returns the number of blocks a blob of n bytes takes.
+func blobBlocks(n int) int64 {
+	return (NDB_BlobHeaderSize + int64(n) + NDB_BlobTailSize + NDB_BlkSize - 1) / NDB_BlkSize
+}
@@ -0,0 +1,130 @@
+package ndb
+
+import (
+	"encoding/binary"
+	"io"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* Next to Packages.db, the ndb backend keeps its indexes in Index.db, a
+   container of blobs in the xdb format:
+
+   https://github.com/rpm-software-management/rpm/blob/rpm-4.17.0-release/lib/backend/ndb/rpmxdb.c
+
+   The 32 byte xdb header is followed by the rest of SlotNPages slot pages. Every
+   16 byte slot describes a blob, identified by a tag and a subtag, that takes
+   PageCount pages starting at StartPage. Free slots have no StartPage.
+*/
+
+// XDBHeader is the header at the start of Index.db.
+type XDBHeader struct {
+	Magic      uint32
+	Version    uint32
+	Generation uint32
+	SlotNPages uint32
+	PageSize   uint32
+	// UserGeneration is the NDBGeneration of Packages.db the indexes were
+	// last synchronized with.
+	UserGeneration uint32
+	_              [2]uint32
+}
+
+type xdbSlot struct {
+	Magic     uint32 // the subtag in the highest byte
+	BlobTag   uint32
+	StartPage uint32
+	PageCount uint32
+}
+
+const (
+	XDB_Magic      = 'R' | 'p'<<8 | 'm'<<16 | 'X'<<24
+	XDB_Version    = 0
+	XDB_SlotMagic  = 'S' | 'l'<<8 | 'o'<<16
+	XDB_HeaderSize = 32
+	XDB_SlotSize   = 16
+)
+
+type xdbBlobID struct {
+	tag    uint32
+	subtag uint8
+}
+
+// xdb is a read-only Index.db.
+type xdb struct {
+	file   io.ReaderAt
+	closer io.Closer
+	header XDBHeader
+	blobs  map[xdbBlobID]xdbSlot
+}
+
+func openXDB(r io.ReaderAt, size int64) (*xdb, error) {
+	file := io.NewSectionReader(r, 0, size)
+
+	var header XDBHeader
+	if err := binary.Read(file, binary.LittleEndian, &header); err != nil {
+		return nil, xerrors.Errorf("failed to read xdb header: %w", err)
+	}
+	if header.Magic != XDB_Magic || header.Version != XDB_Version {
+		return nil, xerrors.Errorf("invalid or unsupported xdb format: magic %x, version %d", header.Magic, header.Version)
+	}
+	if header.PageSize < XDB_HeaderSize || header.PageSize%XDB_SlotSize != 0 || header.PageSize > 1<<20 {
+		return nil, xerrors.Errorf("unexpected xdb page size: %d", header.PageSize)
+	}
+	// Sanity check against excessive memory usage
+	if header.SlotNPages == 0 || uint64(header.SlotNPages)*uint64(header.PageSize) > uint64(size) {
+		return nil, xerrors.Errorf("unexpected xdb slot page count: %d", header.SlotNPages)
+	}
+
+	slotBuff, err := dbi.ReadSlice(r, XDB_HeaderSize, int(header.SlotNPages*header.PageSize)-XDB_HeaderSize)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read xdb slot pages: %w", err)
+	}
+
+	lastPage := uint64(size) / uint64(header.PageSize)
+	blobs := make(map[xdbBlobID]xdbSlot)
+	for off := 0; off < len(slotBuff); off += XDB_SlotSize {
+		slot := xdbSlot{
+			Magic:     binary.LittleEndian.Uint32(slotBuff[off:]),
+			BlobTag:   binary.LittleEndian.Uint32(slotBuff[off+4:]),
+			StartPage: binary.LittleEndian.Uint32(slotBuff[off+8:]),
+			PageCount: binary.LittleEndian.Uint32(slotBuff[off+12:]),
+		}
+		if slot.Magic&0x00ffffff != XDB_SlotMagic {
+			return nil, xerrors.Errorf("bad xdb slot magic at offset %d: %x", XDB_HeaderSize+off, slot.Magic)
+		}
+		// free slot, or one without pages
+		if slot.StartPage == 0 || slot.PageCount == 0 {
+			continue
+		}
+		if slot.StartPage < header.SlotNPages || uint64(slot.StartPage)+uint64(slot.PageCount) > lastPage {
+			return nil, xerrors.Errorf("xdb blob %d out of bounds: pages %d+%d", slot.BlobTag, slot.StartPage, slot.PageCount)
+		}
+		blobs[xdbBlobID{tag: slot.BlobTag, subtag: uint8(slot.Magic >> 24)}] = slot
+	}
+
+	return &xdb{
+		file:   r,
+		header: header,
+		blobs:  blobs,
+	}, nil
+}
+
+// blob returns the offset and size of the pages of the blob with the given
+// tag and subtag.
+func (x *xdb) blob(tag uint32, subtag uint8) (int64, int64, bool) {
+	slot, ok := x.blobs[xdbBlobID{tag: tag, subtag: subtag}]
+	if !ok {
+		return 0, 0, false
+	}
+	pageSize := int64(x.header.PageSize)
+	return int64(slot.StartPage) * pageSize, int64(slot.PageCount) * pageSize, true
+}
+
+func (x *xdb) Close() error {
+	if x.closer == nil {
+		return nil
+	}
+	return x.closer.Close()
+}
@@ -0,0 +1,463 @@
+package rpmdb
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+)
+
+func TestNDBValidation(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	db, err := Open(file)
+	require.NoError(t, err)
+	want := listPackages(t, db)
+
+	orig, err := os.ReadFile(file)
+	require.NoError(t, err)
+
+	// the first slot follows the NDB Header, which takes two slots
+	const slotNo = 2
+	le := binary.LittleEndian
+	slot := orig[slotNo*16:]
+	pkgIndex := le.Uint32(slot[4:])
+	blkOffset := le.Uint32(slot[8:])
+	blkCount := le.Uint32(slot[12:])
+	blob := int(blkOffset) * ndb.NDB_BlkSize
+	tail := blob + int(blkCount)*ndb.NDB_BlkSize - int(ndb.NDB_BlobTailSize)
+
+	tests := []struct {
+		name    string
+		corrupt func(b []byte)
+		reason  string
+		// the package can still be decoded in lenient mode
+		lenient bool
+	}{
+		{
+			name: "checksum",
+			corrupt: func(b []byte) {
+				le.PutUint32(b[tail:], le.Uint32(b[tail:])+1)
+			},
+			reason:  "Adler32 checksum",
+			lenient: true,
+		},
+		{
+			name: "blob content",
+			corrupt: func(b []byte) {
+				// the index count of the header, which no longer decodes
+				b[blob+int(ndb.NDB_BlobHeaderSize)] ^= 0xff
+			},
+			reason: "Adler32 checksum",
+		},
+		{
+			name: "tail magic",
+			corrupt: func(b []byte) {
+				copy(b[tail+8:], "XXXX")
+			},
+			reason:  "unexpected blob tail magic",
+			lenient: true,
+		},
+		{
+			name: "tail length",
+			corrupt: func(b []byte) {
+				le.PutUint32(b[tail+4:], 1)
+			},
+			reason:  "blob length 1 in the tail",
+			lenient: true,
+		},
+		{
+			name: "block count",
+			corrupt: func(b []byte) {
+				le.PutUint32(b[slotNo*16+12:], blkCount+1)
+			},
+			reason:  "blocks, but a blob of",
+			lenient: true,
+		},
+		{
+			name: "blob magic",
+			corrupt: func(b []byte) {
+				copy(b[blob:], "XXXX")
+			},
+			reason:  "unexpected blob magic",
+			lenient: true,
+		},
+		{
+			name: "package index",
+			corrupt: func(b []byte) {
+				le.PutUint32(b[blob+4:], pkgIndex+1000)
+			},
+			reason:  "blob belongs to pkg",
+			lenient: true,
+		},
+		{
+			name: "out of bounds",
+			corrupt: func(b []byte) {
+				le.PutUint32(b[slotNo*16+8:], uint32(len(b)/ndb.NDB_BlkSize))
+			},
+			reason: "failed to read the blob header",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte(nil), orig...)
+			tt.corrupt(b)
+			path := filepath.Join(t.TempDir(), "Packages.db")
+			require.NoError(t, os.WriteFile(path, b, 0o644))
+
+			db, err := Open(path)
+			require.NoError(t, err)
+			defer db.Close()
+			_, err = db.ListPackages()
+			require.Error(t, err)
+			var corruption *ndb.CorruptionError
+			require.True(t, xerrors.As(err, &corruption), err)
+			assert.Equal(t, slotNo, corruption.Slot)
+			assert.Equal(t, pkgIndex, corruption.PkgIndex)
+			assert.Equal(t, le.Uint32(b[slotNo*16+8:]), corruption.BlkOffset)
+			assert.Contains(t, corruption.Reason, tt.reason)
+			assert.Contains(t, err.Error(), "in slot 2 at block")
+
+			db, err = OpenWithOptions(path, OpenOptions{NDBValidation: ndb.ValidationLenient})
+			require.NoError(t, err)
+			defer db.Close()
+			pkgs, err := db.ListPackages()
+			if !tt.lenient {
+				require.Error(t, err)
+				assert.True(t, xerrors.As(err, &corruption), err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, pkgs, len(want))
+			for i, pkg := range pkgs {
+				pkg.IndexEntries = nil
+				if pkg.Instance != pkgIndex {
+					assert.Equal(t, want[i], pkg)
+					continue
+				}
+				require.True(t, xerrors.As(pkg.Corruption, &corruption), pkg.Corruption)
+				assert.Contains(t, corruption.Reason, tt.reason)
+				pkg.Corruption = nil
+				assert.Equal(t, want[i], pkg)
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		db, err := OpenWithOptions(file, OpenOptions{NDBValidation: ndb.ValidationLenient})
+		require.NoError(t, err)
+		for _, pkg := range listPackages(t, db) {
+			assert.NoError(t, pkg.Corruption)
+		}
+	})
+}
+
+type idxEntry struct {
+	key   string
+	match dbi.IndexMatch
+}
+
+// murmurHash is the murmurhash of rpmidx.c.
+func murmurHash(s []byte) uint32 {
+	const m = 0x5bd1e995
+	h := uint32(len(s)) * m
+	for ; len(s) >= 4; s = s[4:] {
+		h = (h + binary.LittleEndian.Uint32(s)) * m
+		h ^= h >> 16
+	}
+	switch len(s) {
+	case 3:
+		h += uint32(s[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(s[1]) << 8
+		fallthrough
+	case 1:
+		h = (h + uint32(s[0])) * m
+		h ^= h >> 16
+	}
+	h *= m
+	h ^= h >> 10
+	h *= m
+	return h ^ h>>17
+}
+
+// ndbIdx builds an index blob in the idx format of rpmidx.c.
+func ndbIdx(entries []idxEntry) []byte {
+	le := binary.LittleEndian
+
+	// keys are stored once, prefixed by their length
+	keys := []byte{0}
+	keyOffsets := make(map[string]uint32)
+	for _, e := range entries {
+		if _, ok := keyOffsets[e.key]; ok {
+			continue
+		}
+		keyOffsets[e.key] = uint32(len(keys))
+		switch n := len(e.key); {
+		case n < 255:
+			keys = append(keys, byte(n))
+		case n < 65535:
+			keys = append(keys, 255, byte(n), byte(n>>8))
+		default:
+			keys = append(keys, 255, 255, 255)
+			keys = le.AppendUint32(keys, uint32(n))
+		}
+		keys = append(keys, e.key...)
+	}
+	// like rpm, keep the bits above the key offsets, but at least 16 bits
+	// for them, for the key hash
+	xmask := ^uint32(0xffff)
+	for ^xmask < uint32(len(keys)) {
+		xmask <<= 1
+	}
+
+	nslots := uint32(256)
+	for nslots < 2*uint32(len(entries)) {
+		nslots *= 2
+	}
+	b := make([]byte, ndb.IDX_HeaderSize+ndb.IDX_SlotSize*int(nslots)+len(keys))
+	slots := b[ndb.IDX_HeaderSize:]
+	ovl := slots[8*nslots:]
+	copy(b[ndb.IDX_HeaderSize+ndb.IDX_SlotSize*int(nslots):], keys)
+
+	for _, e := range entries {
+		keyh := murmurHash([]byte(e.key))
+		h, hh := keyh&(nslots-1), uint32(7)
+		for le.Uint32(slots[8*h:]) != 0 {
+			h, hh = (h+hh)&(nslots-1), hh+1
+		}
+		le.PutUint32(slots[8*h:], keyOffsets[e.key]|keyh&xmask)
+
+		// see encodedata
+		pkgIdx, datIdx := e.match.Instance, e.match.TagIndex
+		switch {
+		case pkgIdx < 0x100000 && datIdx < 0x400:
+			le.PutUint32(slots[8*h+4:], pkgIdx|datIdx<<20)
+		case pkgIdx < 0x1000000 && datIdx < 0x40000:
+			le.PutUint32(slots[8*h+4:], 0x80000000|datIdx>>8)
+			le.PutUint32(ovl[4*h:], pkgIdx|(datIdx&0xff)<<24)
+		default:
+			le.PutUint32(slots[8*h+4:], 0xc0000000|datIdx)
+			le.PutUint32(ovl[4*h:], pkgIdx)
+		}
+	}
+
+	for i, v := range []uint32{ndb.IDX_Magic, ndb.IDX_Version, 1, nslots, uint32(len(entries)), 0, xmask, uint32(len(keys))} {
+		le.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+// ndbXDB builds an Index.db in the xdb format of rpmxdb.c, holding the
+// index blobs by tag.
+func ndbXDB(userGeneration uint32, blobs map[uint32][]byte) []byte {
+	const pageSize = 4096
+	le := binary.LittleEndian
+
+	b := make([]byte, pageSize)
+	for i, v := range []uint32{ndb.XDB_Magic, ndb.XDB_Version, 1, 1, pageSize, userGeneration} {
+		le.PutUint32(b[4*i:], v)
+	}
+	for off := ndb.XDB_HeaderSize; off < pageSize; off += ndb.XDB_SlotSize {
+		le.PutUint32(b[off:], ndb.XDB_SlotMagic)
+	}
+
+	off := ndb.XDB_HeaderSize
+	for _, tag := range lo.Keys(blobs) {
+		blob := blobs[tag]
+		pages := (len(blob) + pageSize - 1) / pageSize
+		le.PutUint32(b[off:], ndb.XDB_SlotMagic|ndb.IDX_XDBSubtag<<24)
+		le.PutUint32(b[off+4:], tag)
+		le.PutUint32(b[off+8:], uint32(len(b)/pageSize))
+		le.PutUint32(b[off+12:], uint32(pages))
+		b = append(b, blob...)
+		b = append(b, make([]byte, pages*pageSize-len(blob))...)
+		off += ndb.XDB_SlotSize
+	}
+	return b
+}
+
+func TestNDBIndexes(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	db, err := Open(file)
+	require.NoError(t, err)
+	all := listPackages(t, db)
+
+	orig, err := os.ReadFile(file)
+	require.NoError(t, err)
+	generation := binary.LittleEndian.Uint32(orig[8:])
+
+	var names, provides, basenames []idxEntry
+	for _, pkg := range all {
+		names = append(names, idxEntry{key: pkg.Name, match: dbi.IndexMatch{Instance: pkg.Instance}})
+		for i, p := range pkg.Provides {
+			provides = append(provides, idxEntry{key: p, match: dbi.IndexMatch{Instance: pkg.Instance, TagIndex: uint32(i)}})
+		}
+		for i, base := range pkg.BaseNames {
+			basenames = append(basenames, idxEntry{key: base, match: dbi.IndexMatch{Instance: pkg.Instance, TagIndex: uint32(i)}})
+		}
+	}
+	// every encoding of the slot data, and a long key
+	long := strings.Repeat("long-capability-", 30)
+	synthetic := []idxEntry{
+		{key: "synthetic", match: dbi.IndexMatch{Instance: 7, TagIndex: 3}},
+		{key: "synthetic", match: dbi.IndexMatch{Instance: 3, TagIndex: 0x1234}},
+		{key: "synthetic", match: dbi.IndexMatch{Instance: 0x2000000, TagIndex: 0x50000}},
+		{key: long, match: dbi.IndexMatch{Instance: 9, TagIndex: 1}},
+	}
+	provides = append(provides, synthetic...)
+
+	indexDB := func(generation uint32) []byte {
+		return ndbXDB(generation, map[uint32][]byte{
+			1000: ndbIdx(names),
+			1047: ndbIdx(provides),
+			1117: ndbIdx(basenames),
+		})
+	}
+	dir := func(t *testing.T, index []byte) string {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "Packages.db"), orig, 0o644))
+		if index != nil {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "Index.db"), index, 0o644))
+		}
+		return dir
+	}
+	open := func(t *testing.T, dir string) (*RpmDB, *RpmDB) {
+		db, err := Open(filepath.Join(dir, "Packages.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		return db, &RpmDB{Db: indexOnlyDB{db.Db.(*ndb.RpmNDB)}}
+	}
+	pkgNames := func(pkgs []*PackageInfo) []string {
+		return lo.Map(pkgs, func(pkg *PackageInfo, _ int) string {
+			return pkg.Name
+		})
+	}
+	filter := func(match func(pkg *PackageInfo) bool) []string {
+		return lo.FilterMap(all, func(pkg *PackageInfo, _ int) (string, bool) {
+			return pkg.Name, match(pkg)
+		})
+	}
+
+	t.Run("murmurhash", func(t *testing.T) {
+		// the hashes of the murmurhash of rpmidx.c built with gcc
+		for key, want := range map[string]uint32{
+			"":             0x00000000,
+			"a":            0x8bca2515,
+			"ab":           0x8f5090d8,
+			"abc":          0x55575fdc,
+			"bash":         0xab2313af,
+			"glibc":        0x449ee479,
+			"libzstd1":     0x877fbd16,
+			"/usr/lib64/":  0x573b3002,
+			"\xff\xfe\x80": 0x5a7e478a,
+		} {
+			assert.Equal(t, want, murmurHash([]byte(key)), key)
+		}
+	})
+
+	t.Run("indexed", func(t *testing.T) {
+		_, db := open(t, dir(t, indexDB(generation)))
+
+		want := all[5]
+		pkg, err := db.Package(want.Name)
+		require.NoError(t, err)
+		pkg.IndexEntries = nil
+		assert.Equal(t, want, pkg)
+
+		capability := want.Provides[len(want.Provides)-1]
+		pkgs, err := db.WhatProvides(capability)
+		require.NoError(t, err)
+		assert.Equal(t, filter(func(pkg *PackageInfo) bool {
+			return lo.Contains(pkg.Provides, capability)
+		}), pkgNames(pkgs))
+
+		files, err := want.InstalledFileNames()
+		require.NoError(t, err)
+		pkgs, err = db.FileOwner(files[0])
+		require.NoError(t, err)
+		assert.Contains(t, pkgNames(pkgs), want.Name)
+
+		pkgs, err = db.WhatProvides("no-such-capability")
+		require.NoError(t, err)
+		assert.Empty(t, pkgs)
+
+		_, err = db.Package("no-such-package")
+		assert.ErrorContains(t, err, "no-such-package is not installed")
+
+		pkg, err = db.PackageByInstance(want.Instance)
+		require.NoError(t, err)
+		assert.Equal(t, want.Name, pkg.Name)
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		db, _ := open(t, dir(t, indexDB(generation)))
+		lookup := db.Db.(dbi.IndexLookup)
+
+		matches, err := lookup.LookupIndex(context.Background(), dbi.IndexProvidename, "synthetic")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, lo.Map(synthetic[:3], func(e idxEntry, _ int) dbi.IndexMatch {
+			return e.match
+		}), matches)
+
+		matches, err = lookup.LookupIndex(context.Background(), dbi.IndexProvidename, long)
+		require.NoError(t, err)
+		assert.Equal(t, []dbi.IndexMatch{{Instance: 9, TagIndex: 1}}, matches)
+
+		_, err = lookup.LookupIndex(context.Background(), dbi.IndexRequirename, "libc.so.6()(64bit)")
+		assert.ErrorIs(t, err, dbi.ErrNoIndex)
+
+		_, err = lookup.ReadInstance(context.Background(), 0x2000000)
+		assert.ErrorIs(t, err, dbi.ErrNotFound)
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		for name, index := range map[string][]byte{
+			"stale":   indexDB(generation + 1),
+			"missing": nil,
+		} {
+			t.Run(name, func(t *testing.T) {
+				db, _ := open(t, dir(t, index))
+
+				_, err := db.Db.(dbi.IndexLookup).LookupIndex(context.Background(), dbi.IndexName, all[0].Name)
+				assert.ErrorIs(t, err, dbi.ErrNoIndex)
+
+				pkg, err := db.Package(all[0].Name)
+				require.NoError(t, err)
+				assert.Equal(t, all[0].Instance, pkg.Instance)
+			})
+		}
+	})
+
+	t.Run("symlinked", func(t *testing.T) {
+		target := filepath.Join(dir(t, indexDB(generation)), "Index.db")
+		linked := dir(t, nil)
+		if err := os.Symlink(target, filepath.Join(linked, "Index.db")); err != nil {
+			t.Skipf("symlinks are not supported: %s", err)
+		}
+		db, _ := open(t, linked)
+
+		_, err := db.Db.(dbi.IndexLookup).LookupIndex(context.Background(), dbi.IndexName, all[0].Name)
+		assert.ErrorIs(t, err, dbi.ErrNoIndex)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		index := indexDB(generation)
+		copy(index[ndb.XDB_HeaderSize:], "XXXX")
+		db, _ := open(t, dir(t, index))
+
+		_, err := db.Package(all[0].Name)
+		assert.ErrorContains(t, err, "bad xdb slot magic")
+	})
+}
@@ -0,0 +1,54 @@
+package rpmdb
+
+// Fields is a set of PackageInfo fields to decode. Tags of fields that are not
+// selected are skipped without being parsed.
+type Fields uint
+
+const (
+	// FieldNEVRA selects Epoch, Name, Version, Release and Arch.
+	FieldNEVRA Fields = 1 << iota
+	// FieldMetadata selects SourceRpm, Size, License, Vendor, Modularitylabel,
+	// Summary and InstallTime.
+	FieldMetadata
+	// FieldSignatures selects PGP, SigMD5 and RSAHeader.
+	FieldSignatures
+	// FieldDependencies selects Provides and Requires.
+	FieldDependencies
+	// FieldFiles selects the file arrays, BaseNames to GroupNames, and
+	// DigestAlgorithm.
+	FieldFiles
+	// FieldRawHeader keeps the undecoded header in RawHeader.
+	FieldRawHeader
+	// FieldIndexEntries keeps the header index in IndexEntries.
+	FieldIndexEntries
+
+	// FieldAll selects every field, which is what ListPackages decodes.
+	FieldAll = FieldNEVRA | FieldMetadata | FieldSignatures | FieldDependencies |
+		FieldFiles | FieldRawHeader | FieldIndexEntries
+)
+
+// ListOptions controls how packages are decoded.
+type ListOptions struct {
+	// Fields selects the fields to decode, for example FieldNEVRA for an
+	// inventory or FieldNEVRA|FieldDependencies for dependency analysis. Zero
+	// means FieldAll.
+	Fields Fields
+
+	// Concurrency is the number of headers decoded in parallel. Packages are
+	// still returned in database order, and the first error in that order is
+	// the one reported. Values below 2 decode serially.
+	Concurrency int
+
+	// Salvage keeps going past the pages, slots and rows the backend cannot
+	// read and the headers that cannot be decoded, recording a Diagnostic for
+	// each instead of stopping, see SalvagePackages. Backends that cannot skip
+	// damage still end at the first error, which is recorded too.
+	Salvage bool
+}
+
+func (o ListOptions) fields() Fields {
+	if o.Fields == 0 {
+		return FieldAll
+	}
+	return o.Fields
+}
@@ -0,0 +1,199 @@
+package rpmdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+func TestListPackagesWithOptions(t *testing.T) {
+	nevra := func(p *PackageInfo) *PackageInfo {
+		return &PackageInfo{
+			Epoch:   p.Epoch,
+			Name:    p.Name,
+			Version: p.Version,
+			Release: p.Release,
+			Arch:    p.Arch,
+
+			Instance:             p.Instance,
+			BdbFirstOverflowPgNo: p.BdbFirstOverflowPgNo,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		fields Fields
+		want   func(p *PackageInfo) *PackageInfo
+	}{
+		{
+			name:   "default",
+			fields: 0,
+			want: func(p *PackageInfo) *PackageInfo {
+				return p
+			},
+		},
+		{
+			name:   "NEVRA",
+			fields: FieldNEVRA,
+			want:   nevra,
+		},
+		{
+			name:   "NEVRA and dependencies",
+			fields: FieldNEVRA | FieldDependencies,
+			want: func(p *PackageInfo) *PackageInfo {
+				want := nevra(p)
+				want.Provides = p.Provides
+				want.Requires = p.Requires
+				return want
+			},
+		},
+		{
+			name:   "NEVRA with raw header",
+			fields: FieldNEVRA | FieldRawHeader,
+			want: func(p *PackageInfo) *PackageInfo {
+				want := nevra(p)
+				want.RawHeader = p.RawHeader
+				return want
+			},
+		},
+		{
+			name:   "everything but files",
+			fields: FieldAll &^ (FieldFiles | FieldRawHeader | FieldIndexEntries),
+			want: func(p *PackageInfo) *PackageInfo {
+				want := *p
+				want.BaseNames = nil
+				want.DirIndexes = nil
+				want.DirNames = nil
+				want.FileSizes = nil
+				want.FileDigests = nil
+				want.FileModes = nil
+				want.FileFlags = nil
+				want.UserNames = nil
+				want.GroupNames = nil
+				want.DigestAlgorithm = 0
+				want.RawHeader = nil
+				return &want
+			},
+		},
+	}
+	for _, file := range readerTests {
+		db, err := Open(file.file)
+		require.NoError(t, err)
+		all := listPackages(t, db)
+
+		for _, tt := range tests {
+			t.Run(file.name+"/"+tt.name, func(t *testing.T) {
+				db, err := Open(file.file)
+				require.NoError(t, err)
+				defer db.Close()
+
+				got, err := db.ListPackagesWithOptions(context.Background(), ListOptions{Fields: tt.fields})
+				require.NoError(t, err)
+				require.Len(t, got, len(all))
+
+				for i, pkg := range got {
+					// the order of IndexEntries is not stable, see listPackages
+					if tt.fields == 0 {
+						assert.NotEmpty(t, pkg.IndexEntries)
+					} else {
+						assert.Empty(t, pkg.IndexEntries)
+					}
+					pkg.IndexEntries = nil
+
+					assert.Equal(t, tt.want(all[i]), pkg)
+				}
+			})
+		}
+	}
+}
+
+func TestListPackagesWithOptions_Concurrency(t *testing.T) {
+	for _, tt := range readerTests {
+		db, err := Open(tt.file)
+		require.NoError(t, err)
+		want := listPackages(t, db)
+
+		for _, n := range []int{2, 3, 16} {
+			t.Run(fmt.Sprintf("%s/%d", tt.name, n), func(t *testing.T) {
+				db, err := Open(tt.file)
+				require.NoError(t, err)
+				defer db.Close()
+
+				got, err := db.ListPackagesWithOptions(context.Background(), ListOptions{Concurrency: n})
+				require.NoError(t, err)
+				for _, pkg := range got {
+					pkg.IndexEntries = nil
+				}
+				assert.Equal(t, want, got)
+			})
+		}
+	}
+}
+
+func TestListPackagesWithOptions_ConcurrencyFirstError(t *testing.T) {
+	b, err := os.ReadFile("testdata/blob.bin")
+	require.NoError(t, err)
+
+	// the invalid header takes longer to reach than the later backend error
+	var entries []dbi.Entry
+	for i := 0; i < 50; i++ {
+		entries = append(entries, dbi.Entry{Value: b})
+	}
+	entries = append(entries, dbi.Entry{Value: []byte{1, 2, 3}})
+	for i := 0; i < 50; i++ {
+		entries = append(entries, dbi.Entry{Value: b}, dbi.Entry{Err: xerrors.New("broken")})
+	}
+
+	for i := 0; i < 20; i++ {
+		fake := &fakeDB{entries: entries, done: make(chan struct{})}
+		db := &RpmDB{Db: fake}
+
+		_, err := db.ListPackagesWithOptions(context.Background(), ListOptions{Concurrency: 8})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "error during importing header")
+
+		select {
+		case <-fake.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("reader goroutine leaked")
+		}
+	}
+}
+
+func BenchmarkListPackagesWithOptions(b *testing.B) {
+	options := []struct {
+		name string
+		opts ListOptions
+	}{
+		{name: "all", opts: ListOptions{Fields: FieldAll}},
+		{name: "NEVRA", opts: ListOptions{Fields: FieldNEVRA}},
+		{name: "NEVRA and dependencies", opts: ListOptions{Fields: FieldNEVRA | FieldDependencies}},
+		{name: "all with 4 workers", opts: ListOptions{Fields: FieldAll, Concurrency: 4}},
+	}
+	for _, tt := range readerTests {
+		for _, opt := range options {
+			b.Run(tt.name+"/"+opt.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					db, err := Open(tt.file)
+					if err != nil {
+						b.Fatal(err)
+					}
+					_, err = db.ListPackagesWithOptions(context.Background(), opt.opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+					db.Close()
+				}
+				b.ReportAllocs()
+			})
+		}
+	}
+}
@@ -43,9 +43,16 @@ type PackageInfo struct {
 	Provides []string
 	Requires []string
 
+	// Instance is rpm's header number of the package, which rpm uses to refer
+	// to it from its index tables.
+	Instance             uint32
 	BdbFirstOverflowPgNo uint32
 	RawHeader            []byte
 	IndexEntries         []IndexEntry
+	// Corruption is set if the header was read from a record that failed
+	// validation, e.g. the checksum of an NDB blob, which the backend was
+	// asked to tolerate.
+	Corruption error
 }
 
 type FileInfo struct {
@@ -58,10 +65,50 @@ type FileInfo struct {
 	Flags     FileFlags
 }
 
+// tagFields maps the tags decoded by decodePackage to the Fields they fill.
+var tagFields = map[int32]Fields{
+	RPMTAG_NAME:            FieldNEVRA,
+	RPMTAG_EPOCH:           FieldNEVRA,
+	RPMTAG_VERSION:         FieldNEVRA,
+	RPMTAG_RELEASE:         FieldNEVRA,
+	RPMTAG_ARCH:            FieldNEVRA,
+	RPMTAG_SOURCERPM:       FieldMetadata,
+	RPMTAG_SIZE:            FieldMetadata,
+	RPMTAG_LICENSE:         FieldMetadata,
+	RPMTAG_VENDOR:          FieldMetadata,
+	RPMTAG_MODULARITYLABEL: FieldMetadata,
+	RPMTAG_SUMMARY:         FieldMetadata,
+	RPMTAG_INSTALLTIME:     FieldMetadata,
+	RPMTAG_SIGMD5:          FieldSignatures,
+	RPMTAG_RSAHEADER:       FieldSignatures,
+	RPMTAG_PGP:             FieldSignatures,
+	RPMTAG_PROVIDENAME:     FieldDependencies,
+	RPMTAG_REQUIRENAME:     FieldDependencies,
+	RPMTAG_DIRINDEXES:      FieldFiles,
+	RPMTAG_DIRNAMES:        FieldFiles,
+	RPMTAG_BASENAMES:       FieldFiles,
+	RPMTAG_FILEDIGESTALGO:  FieldFiles,
+	RPMTAG_FILESIZES:       FieldFiles,
+	RPMTAG_FILEDIGESTS:     FieldFiles,
+	RPMTAG_FILEMODES:       FieldFiles,
+	RPMTAG_FILEFLAGS:       FieldFiles,
+	RPMTAG_FILEUSERNAME:    FieldFiles,
+	RPMTAG_FILEGROUPNAME:   FieldFiles,
+}
+
 // ref. https://github.com/rpm-software-management/rpm/blob/rpm-4.14.3-release/lib/tagexts.c#L752
 func getNEVRA(indexEntries []IndexEntry) (*PackageInfo, error) {
+	return decodePackage(indexEntries, FieldAll)
+}
+
+// decodePackage is getNEVRA restricted to the tags of fields.
+func decodePackage(indexEntries []IndexEntry, fields Fields) (*PackageInfo, error) {
 	pkgInfo := &PackageInfo{}
 	for _, ie := range indexEntries {
+		if tagFields[ie.Info.Tag]&fields == 0 {
+			continue
+		}
+
 		switch ie.Info.Tag {
 		case RPMTAG_DIRINDEXES:
 			if ie.Info.Type != RPM_INT32_TYPE {
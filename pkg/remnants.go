@@ -0,0 +1,120 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+// Remnant is a package header found in a part of the database that no live
+// package refers to, typically left behind when the package was erased.
+type Remnant struct {
+	// Package is the decoded header. Its Instance is unknown and left zero.
+	Package *PackageInfo
+	// Offset is the position of the header in the database file.
+	Offset int64
+	// Extents are the byte ranges of the file the header was carved from, one
+	// per page it spans.
+	Extents []dbi.Extent
+}
+
+var ErrRemnantsUnsupported = xerrors.New("forensic scan not supported for this database format")
+
+// Remnants carves the headers that HdrblobInit accepts out of the parts of the
+// database that are not reachable from the live packages: free and orphaned
+// overflow pages in Berkeley DB, and blocks that no slot refers to in NDB.
+// Other formats return ErrRemnantsUnsupported.
+//
+// Headers are found by their content alone, so a remnant may also be an older
+// copy of a package that is still installed.
+func (d *RpmDB) Remnants(ctx context.Context) ([]*Remnant, error) {
+	source, ok := d.Db.(dbi.RemnantSource)
+	if !ok {
+		return nil, xerrors.Errorf("%T: %w", d.Db, ErrRemnantsUnsupported)
+	}
+
+	regions, err := source.UnreferencedRegions(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to find unreferenced regions: %w", err)
+	}
+
+	var remnants []*Remnant
+	for _, region := range regions {
+		found, err := carveHeaders(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		remnants = append(remnants, found...)
+	}
+	return remnants, nil
+}
+
+// carveHeaders tries every offset of the region as the start of a header, and
+// skips over the headers it finds.
+func carveHeaders(ctx context.Context, region dbi.Region) ([]*Remnant, error) {
+	var remnants []*Remnant
+	data := region.Data
+	for off := 0; off+8 <= len(data); off++ {
+		if off%65536 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		size, ok := carveSize(data[off:])
+		if !ok {
+			continue
+		}
+		pkg, err := parseEntry(dbi.Entry{Value: bytes.Clone(data[off : off+size])}, FieldAll, dbi.Limits{})
+		if err != nil || pkg.Name == "" {
+			continue
+		}
+
+		extents := regionExtents(region, int64(off), int64(size))
+		remnants = append(remnants, &Remnant{
+			Package: pkg,
+			Offset:  extents[0].Offset,
+			Extents: extents,
+		})
+		off += size - 1
+	}
+	return remnants, nil
+}
+
+// carveSize returns the size of the header that data would start with, if it
+// is plausible and fits.
+func carveSize(data []byte) (int, bool) {
+	il := binary.BigEndian.Uint32(data)
+	dl := binary.BigEndian.Uint32(data[4:])
+	// see hdrchkTags and hdrchkData
+	if il < 1 || il > 0xffff || dl > headerMaxbytes {
+		return 0, false
+	}
+	size := 8 + 16*int(il) + int(dl)
+	if size > len(data) {
+		return 0, false
+	}
+	return size, true
+}
+
+// regionExtents maps the n bytes at off of the data of a region to the byte
+// ranges of the file they came from.
+func regionExtents(region dbi.Region, off, n int64) []dbi.Extent {
+	var extents []dbi.Extent
+	var pos int64
+	for _, e := range region.Extents {
+		start := max(off, pos)
+		end := min(off+n, pos+e.Length)
+		if start < end {
+			extents = append(extents, dbi.Extent{
+				Offset: e.Offset + start - pos,
+				Length: end - start,
+			})
+		}
+		pos += e.Length
+	}
+	return extents
+}
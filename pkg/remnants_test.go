@@ -0,0 +1,181 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ZafranSecurity/go-rpmdb/pkg/bdb"
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+)
+
+// appendPages stores data on new pages of type typ at the end of a Berkeley
+// DB database, without linking them, like the pages of an erased package.
+func appendPages(db []byte, pageSize int, order binary.ByteOrder, typ byte, data []byte) ([]byte, uint32) {
+	first := uint32(len(db) / pageSize)
+	pgNo := first
+	for len(data) > 0 {
+		page := make([]byte, pageSize)
+		order.PutUint32(page[8:], pgNo)
+		page[25] = typ
+		n := copy(page[bdb.PageHeaderSize:], data)
+		order.PutUint16(page[22:], uint16(n))
+		data = data[n:]
+		db = append(db, page...)
+		pgNo++
+	}
+	order.PutUint32(db[32:], pgNo-1) // last page
+	return db, first
+}
+
+func TestRemnants(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	source, err := ndb.Open(file)
+	require.NoError(t, err)
+	defer source.Close()
+	var headers []dbi.Entry
+	for entry := range source.Read() {
+		require.NoError(t, entry.Err)
+		headers = append(headers, dbi.Entry{Value: bytes.Clone(entry.Value), Instance: entry.Instance})
+	}
+	erased := headers[3]
+	erasedPkg, err := parseEntry(dbi.Entry{Value: erased.Value}, FieldAll, dbi.Limits{})
+	require.NoError(t, err)
+	erasedPkg.IndexEntries = nil
+
+	t.Run("ndb", func(t *testing.T) {
+		orig, err := os.ReadFile(file)
+		require.NoError(t, err)
+
+		// free the slot of the package, leaving its blob behind
+		var blkOffset uint32
+		for off := 32; off < len(orig); off += 16 {
+			if binary.LittleEndian.Uint32(orig[off+4:]) == erased.Instance {
+				blkOffset = binary.LittleEndian.Uint32(orig[off+8:])
+				copy(orig[off+4:off+16], make([]byte, 12))
+				break
+			}
+		}
+		require.NotZero(t, blkOffset)
+
+		db, err := OpenReaderAt(bytes.NewReader(orig), int64(len(orig)))
+		require.NoError(t, err)
+		pkgs, err := db.ListPackages()
+		require.NoError(t, err)
+		assert.Len(t, pkgs, len(headers)-1)
+
+		remnants, err := db.Remnants(context.Background())
+		require.NoError(t, err)
+		require.Len(t, remnants, 1)
+		// the header follows the blob header
+		offset := int64(blkOffset)*ndb.NDB_BlkSize + ndb.NDB_BlobHeaderSize
+		assert.Equal(t, offset, remnants[0].Offset)
+		assert.Equal(t, []dbi.Extent{{Offset: offset, Length: int64(len(erased.Value))}}, remnants[0].Extents)
+		remnants[0].Package.IndexEntries = nil
+		assert.Equal(t, erasedPkg, remnants[0].Package)
+	})
+
+	bdbTests := []struct {
+		name string
+		db   func(t *testing.T) ([]byte, int, binary.ByteOrder)
+		// the type the pages of the erased package are left with
+		typ byte
+	}{
+		{
+			name: "freed hash pages",
+			db: func(t *testing.T) ([]byte, int, binary.ByteOrder) {
+				db, err := os.ReadFile("testdata/libuuid/Packages")
+				require.NoError(t, err)
+				return db, 4096, binary.LittleEndian
+			},
+			typ: 0, // P_INVALID
+		},
+		{
+			name: "orphaned overflow pages",
+			db: func(t *testing.T) ([]byte, int, binary.ByteOrder) {
+				db, err := os.ReadFile("testdata/libuuid/Packages")
+				require.NoError(t, err)
+				return db, 4096, binary.LittleEndian
+			},
+			typ: bdb.OverflowPageType,
+		},
+		{
+			name: "freed btree pages",
+			db: func(t *testing.T) ([]byte, int, binary.ByteOrder) {
+				var pairs []bdbPair
+				for _, header := range headers {
+					if header.Instance != erased.Instance {
+						pairs = append(pairs, bdbPair{key: binary.BigEndian.AppendUint32(nil, header.Instance), value: header.Value})
+					}
+				}
+				return bdbBtree(t, 1024, binary.BigEndian, pairs), 1024, binary.BigEndian
+			},
+			typ: 0,
+		},
+	}
+	for _, tt := range bdbTests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig, pageSize, order := tt.db(t)
+			live, err := OpenReaderAt(bytes.NewReader(orig), int64(len(orig)))
+			require.NoError(t, err)
+			want, err := live.ListPackages()
+			require.NoError(t, err)
+
+			data, first := appendPages(bytes.Clone(orig), pageSize, order, tt.typ, erased.Value)
+			db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+			require.NoError(t, err)
+			got, err := db.ListPackages()
+			require.NoError(t, err)
+			// the order of the IndexEntries of headers with dribble entries is
+			// not stable
+			for _, pkg := range append(want, got...) {
+				pkg.IndexEntries = nil
+			}
+			assert.Equal(t, want, got)
+
+			remnants, err := db.Remnants(context.Background())
+			require.NoError(t, err)
+			require.Len(t, remnants, 1)
+			remnants[0].Package.IndexEntries = nil
+			assert.Equal(t, erasedPkg, remnants[0].Package)
+
+			// every page contributes its body
+			body := pageSize - bdb.PageHeaderSize
+			pages := (len(erased.Value) + body - 1) / body
+			assert.Equal(t, int64(first)*int64(pageSize)+bdb.PageHeaderSize, remnants[0].Offset)
+			require.Len(t, remnants[0].Extents, pages)
+			assert.Equal(t, int64(len(erased.Value)), lo.SumBy(remnants[0].Extents, func(e dbi.Extent) int64 {
+				return e.Length
+			}))
+			for i, e := range remnants[0].Extents {
+				assert.Equal(t, int64(first+uint32(i))*int64(pageSize)+bdb.PageHeaderSize, e.Offset)
+			}
+		})
+	}
+
+	t.Run("live", func(t *testing.T) {
+		for _, file := range []string{"testdata/sle15-bci/Packages.db", "testdata/libuuid/Packages"} {
+			db, err := Open(file)
+			require.NoError(t, err)
+			remnants, err := db.Remnants(context.Background())
+			require.NoError(t, err)
+			assert.Empty(t, remnants, file)
+			require.NoError(t, db.Close())
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		db, err := Open("testdata/cbl-mariner-2.0/rpmdb.sqlite")
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Remnants(context.Background())
+		assert.ErrorIs(t, err, ErrRemnantsUnsupported)
+	})
+}
@@ -0,0 +1,238 @@
+package rpmdb
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	multierror "github.com/hashicorp/go-multierror"
+	"golang.org/x/xerrors"
+)
+
+// DBPaths lists the locations rpm keeps its database at, in order of
+// precedence. The paths are relative to the root of the filesystem.
+var DBPaths = []string{
+	// rpm >= 4.16 with the sqlite backend (Fedora 36+, RHEL 9)
+	"usr/lib/sysimage/rpm/rpmdb.sqlite",
+	"var/lib/rpm/rpmdb.sqlite",
+	// ndb backend (SUSE), which also moved to /usr/lib/sysimage
+	"usr/lib/sysimage/rpm/Packages.db",
+	"var/lib/rpm/Packages.db",
+	// Berkeley DB backend (RHEL <= 8, CentOS, Amazon Linux 2)
+	"var/lib/rpm/Packages",
+	// LMDB backend (rpm 4.15 to 4.17, rarely enabled)
+	"usr/lib/sysimage/rpm/data.mdb",
+	"var/lib/rpm/data.mdb",
+	// rpm-ostree keeps the database of the deployment in /usr/share/rpm
+	"usr/share/rpm/rpmdb.sqlite",
+	"usr/share/rpm/Packages.db",
+	"usr/share/rpm/Packages",
+}
+
+// maxSymlinks bounds how many symlinks are followed while resolving one path,
+// the same limit Linux applies before failing with ELOOP.
+const maxSymlinks = 40
+
+// Candidate is one location probed while looking for the database of a root.
+type Candidate struct {
+	// Path is the probed location, relative to the root.
+	Path string
+	// Resolved is Path after resolving symlinks within the root.
+	Resolved string
+	// Err tells why the candidate was not used, nil for the chosen one.
+	Err error
+}
+
+// Discovery explains which database OpenRoot chose and why.
+type Discovery struct {
+	// Path is the location of the chosen database, relative to the root.
+	Path string
+	// Resolved is Path after resolving symlinks within the root.
+	Resolved string
+	// Reason is a human readable explanation of the choice.
+	Reason string
+	// Candidates lists every location probed, in order.
+	Candidates []Candidate
+}
+
+// OpenRoot finds and opens the rpm database of the filesystem tree at root,
+// for example an extracted container image or a mounted disk. The locations
+// in DBPaths are probed in order and the first database that can be opened is
+// used. Symlinks are resolved as if root were the filesystem root, so they can
+// never point outside of it.
+func OpenRoot(root string) (*RpmDB, *Discovery, error) {
+	return openRoot(hostRoot(root), func(name string) (*RpmDB, error) {
+		// name is resolved already; open it once, without following a symlink
+		// that may have been swapped in since
+		file, err := dbi.OpenNoFollow(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, xerrors.Errorf("failed to stat %s: %w", name, err)
+		}
+		if !info.Mode().IsRegular() {
+			_ = file.Close()
+			return nil, xerrors.Errorf("%s: not a regular file", name)
+		}
+
+		src := dbi.MapFile(file, info.Size())
+		format, err := DetectFormatReaderAt(src, src.Size())
+		if err != nil {
+			_ = src.Close()
+			return nil, err
+		}
+		db, err := openReaderAtWithFormat(src, src.Size(), format.Kind)
+		if err != nil {
+			_ = src.Close()
+			return nil, err
+		}
+		db.closer = src
+
+		// the index files next to the database are resolved within root too
+		db.setOpenIndexFile(func(file string) (*os.File, error) {
+			resolved, err := resolveInRoot(hostRoot(root), path.Join(path.Dir(name), file))
+			if err != nil {
+				return nil, err
+			}
+			return dbi.OpenNoFollow(filepath.Join(root, filepath.FromSlash(resolved)))
+		})
+		return db, nil
+	})
+}
+
+// linkFS is a filesystem tree that exposes symlinks.
+type linkFS interface {
+	Lstat(name string) (fs.FileInfo, error)
+	Readlink(name string) (string, error)
+}
+
+// hostRoot is a directory of the host filesystem.
+type hostRoot string
+
+func (r hostRoot) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(filepath.Join(string(r), filepath.FromSlash(name)))
+}
+
+func (r hostRoot) Readlink(name string) (string, error) {
+	target, err := os.Readlink(filepath.Join(string(r), filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(target), nil
+}
+
+func openRoot(fsys linkFS, open func(name string) (*RpmDB, error)) (*RpmDB, *Discovery, error) {
+	var discovery Discovery
+	var result error
+
+	for _, name := range DBPaths {
+		candidate := Candidate{Path: name}
+
+		resolved, err := resolveInRoot(fsys, name)
+		if err != nil {
+			candidate.Err = err
+			discovery.Candidates = append(discovery.Candidates, candidate)
+			if !xerrors.Is(err, fs.ErrNotExist) {
+				result = multierror.Append(result, xerrors.Errorf("%s: %w", name, err))
+			}
+			continue
+		}
+		candidate.Resolved = resolved
+
+		db, err := open(resolved)
+		if err != nil {
+			candidate.Err = err
+			discovery.Candidates = append(discovery.Candidates, candidate)
+			result = multierror.Append(result, xerrors.Errorf("%s: %w", name, err))
+			continue
+		}
+		discovery.Candidates = append(discovery.Candidates, candidate)
+
+		discovery.Path = name
+		discovery.Resolved = resolved
+		discovery.Reason = discoveryReason(discovery.Candidates)
+
+		return db, &discovery, nil
+	}
+
+	if result == nil {
+		return nil, &discovery, xerrors.Errorf("no rpm database found: %w", fs.ErrNotExist)
+	}
+	return nil, &discovery, xerrors.Errorf("no usable rpm database found: %w", result)
+}
+
+func discoveryReason(candidates []Candidate) string {
+	chosen := candidates[len(candidates)-1]
+
+	var skipped []string
+	for _, c := range candidates[:len(candidates)-1] {
+		if !xerrors.Is(c.Err, fs.ErrNotExist) {
+			skipped = append(skipped, c.Path)
+		}
+	}
+
+	reason := "first existing location in order of precedence"
+	if len(skipped) > 0 {
+		reason = "first usable location in order of precedence, could not open " + strings.Join(skipped, ", ")
+	}
+	if chosen.Resolved != chosen.Path {
+		reason += ", resolved through symlinks to " + chosen.Resolved
+	}
+	return reason
+}
+
+// resolveInRoot resolves every symlink in name as if the root of fsys were the
+// filesystem root: absolute targets are relative to the root and ".." never
+// leaves it. The result is a clean path relative to the root.
+func resolveInRoot(fsys linkFS, name string) (string, error) {
+	var resolved []string
+	remaining := strings.Split(name, "/")
+
+	for links := 0; len(remaining) > 0; {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		current := path.Join(path.Join(resolved...), part)
+		info, err := fsys.Lstat(current)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", xerrors.Errorf("too many levels of symbolic links: %s", name)
+		}
+		target, err := fsys.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = nil
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	if len(resolved) == 0 {
+		return ".", nil
+	}
+	return path.Join(resolved...), nil
+}
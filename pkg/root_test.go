@@ -0,0 +1,179 @@
+package rpmdb
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+func TestOpenRoot(t *testing.T) {
+	sqlite, err := os.ReadFile("testdata/cbl-mariner-2.0/rpmdb.sqlite")
+	require.NoError(t, err)
+	bdb, err := os.ReadFile("testdata/libuuid/Packages")
+	require.NoError(t, err)
+	outside, err := filepath.Abs("testdata/sle15-bci/Packages.db")
+	require.NoError(t, err)
+
+	type file struct {
+		data    []byte
+		symlink string
+	}
+	tests := []struct {
+		name         string
+		files        map[string]file
+		wantPath     string
+		wantResolved string
+		wantReason   string
+		wantErr      string
+	}{
+		{
+			name: "sqlite in sysimage",
+			files: map[string]file{
+				"usr/lib/sysimage/rpm/rpmdb.sqlite": {data: sqlite},
+				"var/lib/rpm/Packages":              {data: bdb},
+			},
+			wantPath:     "usr/lib/sysimage/rpm/rpmdb.sqlite",
+			wantResolved: "usr/lib/sysimage/rpm/rpmdb.sqlite",
+			wantReason:   "first existing location in order of precedence",
+		},
+		{
+			name: "var/lib/rpm symlinked to sysimage",
+			files: map[string]file{
+				"usr/lib/sysimage/rpm/Packages": {data: bdb},
+				"var/lib/rpm":                   {symlink: "../../usr/lib/sysimage/rpm"},
+			},
+			wantPath:     "var/lib/rpm/Packages",
+			wantResolved: "usr/lib/sysimage/rpm/Packages",
+			wantReason:   "first existing location in order of precedence, resolved through symlinks to usr/lib/sysimage/rpm/Packages",
+		},
+		{
+			name: "rpm-ostree",
+			files: map[string]file{
+				"usr/share/rpm/rpmdb.sqlite": {data: sqlite},
+				"var/lib/rpm":                {symlink: "/usr/share/rpm"},
+			},
+			wantPath:     "var/lib/rpm/rpmdb.sqlite",
+			wantResolved: "usr/share/rpm/rpmdb.sqlite",
+			wantReason:   "first existing location in order of precedence, resolved through symlinks to usr/share/rpm/rpmdb.sqlite",
+		},
+		{
+			name: "empty sqlite file is skipped",
+			files: map[string]file{
+				"var/lib/rpm/rpmdb.sqlite": {data: []byte{}},
+				"var/lib/rpm/Packages":     {data: bdb},
+			},
+			wantPath:     "var/lib/rpm/Packages",
+			wantResolved: "var/lib/rpm/Packages",
+			wantReason:   "first usable location in order of precedence, could not open var/lib/rpm/rpmdb.sqlite",
+		},
+		{
+			name: "symlinks do not escape the root",
+			files: map[string]file{
+				"var/lib/rpm/Packages.db": {symlink: outside},
+				"var/lib/rpm/Packages":    {symlink: "../../../../../../../../../../../../" + outside},
+			},
+			wantErr: "no rpm database found",
+		},
+		{
+			name: "symlink loop",
+			files: map[string]file{
+				"var/lib/rpm": {symlink: "/var/lib/rpm"},
+			},
+			wantErr: "too many levels of symbolic links",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, f := range tt.files {
+				p := filepath.Join(root, filepath.FromSlash(name))
+				require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+				if f.symlink != "" {
+					if err := os.Symlink(f.symlink, p); err != nil {
+						t.Skipf("symlinks are not supported: %s", err)
+					}
+					continue
+				}
+				require.NoError(t, os.WriteFile(p, f.data, 0o644))
+			}
+
+			db, discovery, err := OpenRoot(root)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer db.Close()
+
+			assert.Equal(t, tt.wantPath, discovery.Path)
+			assert.Equal(t, tt.wantResolved, discovery.Resolved)
+			assert.Equal(t, tt.wantReason, discovery.Reason)
+			assert.Len(t, discovery.Candidates, indexOf(DBPaths, tt.wantPath)+1)
+
+			pkgList, err := db.ListPackages()
+			require.NoError(t, err)
+			assert.NotEmpty(t, pkgList)
+		})
+	}
+}
+
+func TestOpenRootIndexes(t *testing.T) {
+	packages, err := os.ReadFile("testdata/libuuid/Packages")
+	require.NoError(t, err)
+	le := binary.LittleEndian
+	index := bdbHash(t, 4096, le, []bdbPair{
+		{key: []byte("libuuid"), value: indexValue(le, dbi.IndexMatch{Instance: 1})},
+	})
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	for dir, files := range map[string]map[string][]byte{
+		filepath.Join(root, "var/lib/rpm"): {"Packages": packages},
+		filepath.Join(root, "indexes"):     {"Name": index},
+		outside:                            {"Providename": index},
+	} {
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		for name, data := range files {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o644))
+		}
+	}
+	for name, target := range map[string]string{
+		// absolute within the root
+		"Name": "/indexes/Name",
+		// resolves to a missing file within the root
+		"Providename": filepath.Join(outside, "Providename"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, "var/lib/rpm", name)); err != nil {
+			t.Skipf("symlinks are not supported: %s", err)
+		}
+	}
+
+	db, _, err := OpenRoot(root)
+	require.NoError(t, err)
+	defer db.Close()
+	lookup := db.Db.(dbi.IndexLookup)
+
+	matches, err := lookup.LookupIndex(context.Background(), dbi.IndexName, "libuuid")
+	require.NoError(t, err)
+	assert.Equal(t, []dbi.IndexMatch{{Instance: 1}}, matches)
+
+	_, err = lookup.LookupIndex(context.Background(), dbi.IndexProvidename, "libuuid")
+	assert.ErrorIs(t, err, dbi.ErrNoIndex)
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
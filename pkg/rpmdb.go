@@ -1,8 +1,15 @@
 package rpmdb
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+
 	"github.com/ZafranSecurity/go-rpmdb/pkg/bdb"
 	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/lmdb"
 	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
 	"github.com/ZafranSecurity/go-rpmdb/pkg/sqlite3"
 	"github.com/samber/lo"
@@ -11,81 +18,231 @@ import (
 
 type RpmDB struct {
 	Db dbi.RpmDBInterface
+
+	// set by SetLimits
+	limits dbi.Limits
+
+	// closes the underlying file when it was opened on behalf of the caller
+	closer io.Closer
 }
 
+// Open opens the database at path, detecting its format with DetectFormat.
 func Open(path string) (*RpmDB, error) {
-	// SQLite3 Open() returns nil, nil in case of DB format other than SQLite3
-	sqldb, err := sqlite3.Open(path)
-	if err != nil && !xerrors.Is(err, sqlite3.ErrorInvalidSQLite3) {
+	format, err := DetectFormat(path)
+	if err != nil {
 		return nil, err
 	}
-	if sqldb != nil {
-		return &RpmDB{Db: sqldb}, nil
-	}
 
-	// NDB Open() returns nil, nil in case of DB format other than NDB
-	ndbh, err := ndb.Open(path)
-	if err != nil && !xerrors.Is(err, ndb.ErrorInvalidNDB) {
+	return OpenWithFormat(path, format.Kind)
+}
+
+// OpenFS opens the database at path within fsys, detecting its format the
+// same way Open does.
+func OpenFS(fsys fs.FS, path string) (*RpmDB, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
 		return nil, err
 	}
-	if ndbh != nil {
-		return &RpmDB{Db: ndbh}, nil
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, xerrors.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	// not every fs.File supports random access, e.g. files in a zip archive
+	r, ok := file.(io.ReaderAt)
+	if !ok {
+		b, err := io.ReadAll(file)
+		if err != nil {
+			_ = file.Close()
+			return nil, xerrors.Errorf("failed to read %s: %w", path, err)
+		}
+		r = bytes.NewReader(b)
 	}
 
-	odb, err := bdb.Open(path)
+	db, err := OpenReaderAt(r, info.Size())
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
+	db.closer = file
 
-	return &RpmDB{
-		Db: odb,
-	}, nil
+	return db, nil
+}
+
+// OpenReaderAt opens a database of the given size held by r, for example an
+// in-memory copy wrapped in a bytes.Reader. The format is detected the same way
+// Open does. Closing the returned database does not close r.
+func OpenReaderAt(r io.ReaderAt, size int64) (*RpmDB, error) {
+	format, err := DetectFormatReaderAt(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return openReaderAtWithFormat(r, size, format.Kind)
+}
+
+// SetLimits bounds what reading the database may cost from now on. Reads
+// that go over a limit fail with a *dbi.LimitError, even when salvaging.
+func (d *RpmDB) SetLimits(limits dbi.Limits) {
+	switch backend := d.Db.(type) {
+	case *ndb.RpmNDB:
+		backend.Limits = limits
+	case *bdb.BerkeleyDB:
+		backend.Limits = limits
+	case *sqlite3.SQLite3:
+		backend.Limits = limits
+	case *lmdb.LMDB:
+		backend.Limits = limits
+	}
+	d.limits = limits
+}
+
+// setOpenIndexFile sets how the backends open the files next to the
+// database.
+func (d *RpmDB) setOpenIndexFile(open func(name string) (*os.File, error)) {
+	switch backend := d.Db.(type) {
+	case *ndb.RpmNDB:
+		backend.OpenIndexFile = open
+	case *bdb.BerkeleyDB:
+		backend.OpenIndexFile = open
+	}
 }
 
 func (d *RpmDB) Close() error {
-	return d.Db.Close()
+	err := d.Db.Close()
+	if d.closer != nil {
+		if cerr := d.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (d *RpmDB) Package(name string) (*PackageInfo, error) {
-	pkgs, err := d.ListPackages()
+	return d.PackageContext(context.Background(), name)
+}
+
+// PackageContext returns the first installed package called name. It uses
+// the Name index if the backend has one, and otherwise stops reading the
+// database as soon as the package is found or ctx is done.
+func (d *RpmDB) PackageContext(ctx context.Context, name string) (*PackageInfo, error) {
+	pkgs, err := d.find(ctx, dbi.IndexName, name, true, func(pkg *PackageInfo) bool {
+		return pkg.Name == name
+	})
 	if err != nil {
-		return nil, xerrors.Errorf("unable to list packages: %w", err)
+		return nil, err
+	}
+	if len(pkgs) == 0 {
+		return nil, xerrors.Errorf("%s is not installed", name)
 	}
 
-	for _, pkg := range pkgs {
-		if pkg.Name == name {
+	return pkgs[0], nil
+}
+
+// PackageByInstance returns the package with rpm's header number n, as found
+// in PackageInfo.Instance.
+func (d *RpmDB) PackageByInstance(n uint32) (*PackageInfo, error) {
+	return d.PackageByInstanceContext(context.Background(), n)
+}
+
+// PackageByInstanceContext is like PackageByInstance, but gives up with
+// ctx.Err() once ctx is done.
+func (d *RpmDB) PackageByInstanceContext(ctx context.Context, n uint32) (*PackageInfo, error) {
+	if lookup, ok := d.Db.(dbi.IndexLookup); ok {
+		pkg, err := d.readInstance(ctx, lookup, n)
+		if xerrors.Is(err, dbi.ErrNotFound) {
+			return nil, xerrors.Errorf("no package with instance %d", n)
+		}
+		return pkg, err
+	}
+
+	it := d.Packages(ctx)
+	defer it.Close()
+
+	for it.Next() {
+		if pkg := it.Package(); pkg.Instance == n {
 			return pkg, nil
 		}
 	}
-	return nil, xerrors.Errorf("%s is not installed", name)
+	if err := it.Err(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, xerrors.Errorf("unable to list packages: %w", err)
+	}
+
+	return nil, xerrors.Errorf("no package with instance %d", n)
 }
 
 func (d *RpmDB) ListPackages() ([]*PackageInfo, error) {
+	return d.ListPackagesContext(context.Background())
+}
+
+// ListPackagesContext is like ListPackages, but gives up with ctx.Err() once
+// ctx is done. The backend reader is always released before it returns. Use
+// Packages to avoid holding every package in memory at once.
+func (d *RpmDB) ListPackagesContext(ctx context.Context) ([]*PackageInfo, error) {
+	return d.ListPackagesWithOptions(ctx, ListOptions{})
+}
+
+// ListPackagesWithOptions is like ListPackagesContext, but only decodes the
+// fields selected by opts.
+func (d *RpmDB) ListPackagesWithOptions(ctx context.Context, opts ListOptions) ([]*PackageInfo, error) {
+	it := d.PackagesWithOptions(ctx, opts)
+	defer it.Close()
+
 	var pkgList []*PackageInfo
+	for it.Next() {
+		pkgList = append(pkgList, it.Package())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
 
-	for entry := range d.Db.Read() {
-		if entry.Err != nil {
-			return nil, entry.Err
-		}
+	return pkgList, nil
+}
 
-		indexEntries, err := headerImport(entry.Value)
-		if err != nil {
-			return nil, xerrors.Errorf("error during importing header: %w", err)
+func parseEntry(entry dbi.Entry, fields Fields, limits dbi.Limits) (*PackageInfo, error) {
+	if entry.Err != nil {
+		return nil, entry.Err
+	}
+	if limits.MaxHeaderSize > 0 && int64(len(entry.Value)) > limits.MaxHeaderSize {
+		return nil, &dbi.LimitError{Limit: "MaxHeaderSize", Max: limits.MaxHeaderSize}
+	}
+
+	indexEntries, err := headerImport(entry.Value)
+	if err != nil {
+		if entry.Corruption != nil {
+			return nil, xerrors.Errorf("error during importing header (%v): %w", err, entry.Corruption)
 		}
-		pkg, err := getNEVRA(indexEntries)
-		if err != nil {
-			return nil, xerrors.Errorf("invalid package info: %w", err)
+		return nil, xerrors.Errorf("error during importing header: %w", err)
+	}
+	if limits.MaxFilesPerPackage > 0 {
+		for _, ie := range indexEntries {
+			if ie.Info.Tag == RPMTAG_BASENAMES && ie.Info.Count > uint32(limits.MaxFilesPerPackage) {
+				return nil, &dbi.LimitError{Limit: "MaxFilesPerPackage", Max: int64(limits.MaxFilesPerPackage)}
+			}
 		}
+	}
+	pkg, err := decodePackage(indexEntries, fields)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid package info: %w", err)
+	}
 
-		pkg.BdbFirstOverflowPgNo = entry.BdbFirstOverflowPgNo
+	pkg.Instance = entry.Instance
+	pkg.BdbFirstOverflowPgNo = entry.BdbFirstOverflowPgNo
+	pkg.Corruption = entry.Corruption
+	if fields&FieldRawHeader != 0 {
 		pkg.RawHeader = entry.Value
+	}
+	if fields&FieldIndexEntries != 0 {
 		pkg.IndexEntries = lo.Map(indexEntries, func(x IndexEntry, _ int) IndexEntry {
 			x.Data = nil
 			return x
 		})
-
-		pkgList = append(pkgList, pkg)
 	}
 
-	return pkgList, nil
+	return pkg, nil
 }
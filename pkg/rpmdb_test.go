@@ -1,12 +1,21 @@
 package rpmdb
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
 	"encoding/hex"
 	"os"
+	"path"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
 
 	_ "github.com/glebarez/go-sqlite"
 )
@@ -128,6 +137,282 @@ func TestPackageList(t *testing.T) {
 	}
 }
 
+// in-tree databases, one per backend
+var readerTests = []struct {
+	name string
+	file string
+}{
+	{
+		name: "SQLite3",
+		file: "testdata/cbl-mariner-2.0/rpmdb.sqlite",
+	},
+	{
+		name: "BerkeleyDB",
+		file: "testdata/libuuid/Packages",
+	},
+	{
+		name: "NDB",
+		file: "testdata/sle15-bci/Packages.db",
+	},
+}
+
+func listPackages(t *testing.T, db *RpmDB) []*PackageInfo {
+	t.Helper()
+
+	pkgList, err := db.ListPackages()
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.NotEmpty(t, pkgList)
+
+	// the order of IndexEntries is not stable for headers with dribble entries
+	for _, pkg := range pkgList {
+		pkg.IndexEntries = nil
+	}
+
+	return pkgList
+}
+
+func TestOpenReaderAt(t *testing.T) {
+	for _, tt := range readerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(tt.file)
+			require.NoError(t, err)
+			want := listPackages(t, db)
+
+			b, err := os.ReadFile(tt.file)
+			require.NoError(t, err)
+
+			db, err = OpenReaderAt(bytes.NewReader(b), int64(len(b)))
+			require.NoError(t, err)
+			assert.Equal(t, want, listPackages(t, db))
+		})
+	}
+
+	t.Run("not an rpmdb", func(t *testing.T) {
+		b := bytes.Repeat([]byte{0xff}, 4096)
+		_, err := OpenReaderAt(bytes.NewReader(b), int64(len(b)))
+		require.Error(t, err)
+	})
+}
+
+func TestOpenFS(t *testing.T) {
+	for _, tt := range readerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(tt.file)
+			require.NoError(t, err)
+			want := listPackages(t, db)
+
+			db, err = OpenFS(os.DirFS(path.Dir(tt.file)), path.Base(tt.file))
+			require.NoError(t, err)
+			assert.Equal(t, want, listPackages(t, db))
+
+			b, err := os.ReadFile(tt.file)
+			require.NoError(t, err)
+			fsys := fstest.MapFS{
+				"var/lib/rpm/db": &fstest.MapFile{Data: b},
+			}
+
+			db, err = OpenFS(fsys, "var/lib/rpm/db")
+			require.NoError(t, err)
+			assert.Equal(t, want, listPackages(t, db))
+		})
+	}
+}
+
+func TestListPackagesContext(t *testing.T) {
+	for _, tt := range readerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			db, err := Open(tt.file)
+			require.NoError(t, err)
+			_, err = db.ListPackagesContext(ctx)
+			assert.ErrorIs(t, err, context.Canceled)
+			require.NoError(t, db.Close())
+
+			db, err = Open(tt.file)
+			require.NoError(t, err)
+			_, err = db.PackageContext(ctx, "no-such-package")
+			assert.ErrorIs(t, err, context.Canceled)
+			require.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestReadContext_Cancel(t *testing.T) {
+	for _, tt := range readerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(tt.file)
+			require.NoError(t, err)
+			defer db.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			entries := db.Db.(dbi.ContextReader).ReadContext(ctx)
+			entry := <-entries
+			require.NoError(t, entry.Err)
+			cancel()
+
+			// the producer must close the channel without anyone draining it
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case _, ok := <-entries:
+					if !ok {
+						return
+					}
+				case <-timeout:
+					t.Fatal("reader did not stop after cancellation")
+				}
+			}
+		})
+	}
+}
+
+// fakeDB sends entries until the consumer goes away and reports when its
+// producer goroutine has exited.
+type fakeDB struct {
+	entries []dbi.Entry
+	done    chan struct{}
+	// reads started, of which only the first sends entries
+	reads int
+}
+
+func (f *fakeDB) Read() <-chan dbi.Entry {
+	return f.ReadContext(context.Background())
+}
+
+func (f *fakeDB) ReadContext(ctx context.Context) <-chan dbi.Entry {
+	entries := make(chan dbi.Entry)
+	if f.reads++; f.reads > 1 {
+		close(entries)
+		return entries
+	}
+	go func() {
+		// done is closed first, so it is closed once entries is drained
+		defer close(entries)
+		defer close(f.done)
+		for _, entry := range f.entries {
+			if !dbi.Send(ctx, entries, entry) {
+				return
+			}
+		}
+	}()
+	return entries
+}
+
+// SalvageContext reads like ReadContext.
+func (f *fakeDB) SalvageContext(ctx context.Context) <-chan dbi.Entry {
+	return f.ReadContext(ctx)
+}
+
+func (f *fakeDB) Close() error {
+	return nil
+}
+
+func (f *fakeDB) GetPgSize() uint32 {
+	return 0
+}
+
+func (f *fakeDB) GetLastPgNo() uint32 {
+	return 0
+}
+
+// readOnlyDB is a backend without ReadContext.
+type readOnlyDB struct {
+	f *fakeDB
+}
+
+func (db readOnlyDB) Read() <-chan dbi.Entry {
+	return db.f.Read()
+}
+
+func (db readOnlyDB) Close() error {
+	return nil
+}
+
+func (db readOnlyDB) GetPgSize() uint32 {
+	return 0
+}
+
+func (db readOnlyDB) GetLastPgNo() uint32 {
+	return 0
+}
+
+func TestListPackages_ReleasesReader(t *testing.T) {
+	b, err := os.ReadFile("testdata/blob.bin")
+	require.NoError(t, err)
+	pkg, err := parseEntry(dbi.Entry{Value: b}, FieldAll, dbi.Limits{})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		entries []dbi.Entry
+		// readOnly hides ReadContext from the iterator
+		readOnly bool
+		call     func(db *RpmDB) error
+	}{
+		{
+			name:    "ListPackages stops at the first error",
+			entries: []dbi.Entry{{Err: xerrors.New("broken")}, {Value: b}, {Value: b}},
+			call: func(db *RpmDB) error {
+				_, err := db.ListPackages()
+				return err
+			},
+		},
+		{
+			name:    "workers stop at the first error",
+			entries: []dbi.Entry{{Value: b}, {Err: xerrors.New("broken")}, {Value: b}, {Value: b}},
+			call: func(db *RpmDB) error {
+				_, err := db.ListPackagesWithOptions(context.Background(), ListOptions{Concurrency: 4})
+				return err
+			},
+		},
+		{
+			name:    "Package stops at the first match",
+			entries: []dbi.Entry{{Value: b}, {Value: b}, {Value: b}},
+			call: func(db *RpmDB) error {
+				_, err := db.Package(pkg.Name)
+				return err
+			},
+		},
+		{
+			name:     "Read is drained without ReadContext",
+			entries:  []dbi.Entry{{Value: b}, {Value: b}, {Value: b}},
+			readOnly: true,
+			call: func(db *RpmDB) error {
+				_, err := db.Package(pkg.Name)
+				return err
+			},
+		},
+		{
+			name:    "salvage reads once",
+			entries: []dbi.Entry{{Value: b}, {Value: b}},
+			call: func(db *RpmDB) error {
+				_, _, err := db.SalvagePackages(context.Background(), ListOptions{})
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDB{entries: tt.entries, done: make(chan struct{})}
+			var db dbi.RpmDBInterface = fake
+			if tt.readOnly {
+				db = readOnlyDB{fake}
+			}
+			_ = tt.call(&RpmDB{Db: db})
+			assert.Equal(t, 1, fake.reads)
+
+			select {
+			case <-fake.done:
+			default:
+				t.Fatal("reader goroutine still running")
+			}
+		})
+	}
+}
+
 func BenchmarkRpmDB_Package(b *testing.B) {
 	for _, tt := range packageTests {
 		b.Run(tt.name, func(b *testing.B) {
@@ -146,6 +431,60 @@ func BenchmarkRpmDB_Package(b *testing.B) {
 	}
 }
 
+func BenchmarkRead(b *testing.B) {
+	sources := []struct {
+		name string
+		open func(file string) (*RpmDB, error)
+	}{
+		{
+			name: "mmap",
+			open: Open,
+		},
+		{
+			name: "ReadAt",
+			open: func(file string) (*RpmDB, error) {
+				f, err := os.Open(file)
+				if err != nil {
+					return nil, err
+				}
+				info, err := f.Stat()
+				if err != nil {
+					return nil, err
+				}
+				db, err := OpenReaderAt(f, info.Size())
+				if err != nil {
+					return nil, err
+				}
+				db.closer = f
+				return db, nil
+			},
+		},
+	}
+	for _, tt := range readerTests {
+		// page sources back the Berkeley DB and NDB backends
+		if tt.name == "SQLite3" {
+			continue
+		}
+		for _, source := range sources {
+			b.Run(tt.name+"/"+source.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					db, err := source.open(tt.file)
+					if err != nil {
+						b.Fatal(err)
+					}
+					for entry := range db.Db.Read() {
+						if entry.Err != nil {
+							b.Fatal(entry.Err)
+						}
+					}
+					db.Close()
+				}
+				b.ReportAllocs()
+			})
+		}
+	}
+}
+
 func Test_parseRSA(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -964,3 +1303,68 @@ func TestNevra(t *testing.T) {
 	_, err = pkg.InstalledFiles()
 	require.Error(t, err)
 }
+
+func TestPackageByInstance(t *testing.T) {
+	for _, tt := range readerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Open(tt.file)
+			require.NoError(t, err)
+			pkgs := listPackages(t, db)
+
+			instances := make(map[uint32]bool)
+			for _, pkg := range pkgs {
+				assert.NotZero(t, pkg.Instance, pkg.Name)
+				assert.False(t, instances[pkg.Instance], "duplicate instance %d", pkg.Instance)
+				instances[pkg.Instance] = true
+			}
+
+			// the SQL driver only reads the database once, so reopen it
+			last := pkgs[len(pkgs)-1]
+			db, err = Open(tt.file)
+			require.NoError(t, err)
+			got, err := db.PackageByInstance(last.Instance)
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+			got.IndexEntries = nil
+			assert.Equal(t, last, got)
+
+			db, err = Open(tt.file)
+			require.NoError(t, err)
+			_, err = db.PackageByInstance(0)
+			assert.ErrorContains(t, err, "no package with instance 0")
+			require.NoError(t, db.Close())
+		})
+	}
+
+	t.Run("SQLite3 hnum", func(t *testing.T) {
+		db, err := sql.Open("sqlite", "file:testdata/cbl-mariner-2.0/rpmdb.sqlite?mode=ro&immutable=1")
+		require.NoError(t, err)
+		defer db.Close()
+
+		rows, err := db.Query("SELECT hnum, blob FROM Packages")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		want := make(map[uint32]string)
+		for rows.Next() {
+			var hnum uint32
+			var blob []byte
+			require.NoError(t, rows.Scan(&hnum, &blob))
+			pkg, err := parseEntry(dbi.Entry{Value: blob}, FieldNEVRA, dbi.Limits{})
+			require.NoError(t, err)
+			want[hnum] = pkg.Name
+		}
+		require.NoError(t, rows.Err())
+
+		b, err := os.ReadFile("testdata/cbl-mariner-2.0/rpmdb.sqlite")
+		require.NoError(t, err)
+		rdb, err := OpenReaderAt(bytes.NewReader(b), int64(len(b)))
+		require.NoError(t, err)
+
+		got := make(map[uint32]string)
+		for _, pkg := range listPackages(t, rdb) {
+			got[pkg.Instance] = pkg.Name
+		}
+		assert.Equal(t, want, got)
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package rpmdb
+
+import (
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+func tryLockShared(file *os.File) (bool, error) {
+	return false, xerrors.New("rpm transaction locks are not supported on this platform")
+}
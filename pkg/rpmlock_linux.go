@@ -0,0 +1,19 @@
+//go:build linux
+
+package rpmdb
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockShared takes a shared lock on file, like rpm's rpmlockAcquire does
+// for readers. It reports false if a writer holds the lock.
+func tryLockShared(file *os.File) (bool, error) {
+	lock := syscall.Flock_t{Type: syscall.F_RDLCK}
+	err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return false, nil
+	}
+	return err == nil, err
+}
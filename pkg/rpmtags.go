@@ -39,6 +39,21 @@ const (
 	RPMTAG_FILEDIGESTALGO = 5011 /* i  */
 	RPMTAG_SUMMARY        = 1004 /* s */
 
+	// tags of the indexes that are not decoded
+	// ref. https://github.com/rpm-software-management/rpm/blob/rpm-4.16.0-release/lib/rpmtag.h
+	RPMTAG_GROUP                = 1016 /* s{} */
+	RPMTAG_REQUIREFLAGS         = 1048 /* i[] */
+	RPMTAG_CONFLICTNAME         = 1054 /* s[] */
+	RPMTAG_TRIGGERNAME          = 1066 /* s[] */
+	RPMTAG_OBSOLETENAME         = 1090 /* s[] */
+	RPMTAG_INSTALLTID           = 1128 /* i */
+	RPMTAG_RECOMMENDNAME        = 5046 /* s[] */
+	RPMTAG_SUGGESTNAME          = 5049 /* s[] */
+	RPMTAG_SUPPLEMENTNAME       = 5052 /* s[] */
+	RPMTAG_ENHANCENAME          = 5055 /* s[] */
+	RPMTAG_FILETRIGGERNAME      = 5069 /* s[] */
+	RPMTAG_TRANSFILETRIGGERNAME = 5079 /* s[] */
+
 	// rpmTag_enhances
 	// https://github.com/rpm-software-management/rpm/blob/rpm-4.16.0-release/lib/rpmtag.h#L375
 	RPMTAG_MODULARITYLABEL = 5096
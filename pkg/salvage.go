@@ -0,0 +1,51 @@
+package rpmdb
+
+import (
+	"context"
+	"fmt"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+// Diagnostic is a part of the database that salvage mode skipped.
+type Diagnostic struct {
+	// Location is where the damage is, such as "page 12" or "slot 40", or
+	// "instance 7" for a header that could not be decoded. It is empty if the
+	// backend could not tell.
+	Location string
+	Err      error
+}
+
+func (d Diagnostic) String() string {
+	if d.Location == "" {
+		return d.Err.Error()
+	}
+	return d.Location + ": " + d.Err.Error()
+}
+
+// SalvagePackages reads a damaged database as far as it can. It returns every
+// package it could decode, in database order, and a diagnostic for each page,
+// slot, row or header it had to skip. The error is only set if ctx is done
+// first.
+func (d *RpmDB) SalvagePackages(ctx context.Context, opts ListOptions) ([]*PackageInfo, []Diagnostic, error) {
+	opts.Salvage = true
+	it := d.PackagesWithOptions(ctx, opts)
+	defer it.Close()
+
+	var pkgList []*PackageInfo
+	for it.Next() {
+		pkgList = append(pkgList, it.Package())
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+	return pkgList, it.Diagnostics(), nil
+}
+
+// entryLocation is the location of the diagnostic of an entry.
+func entryLocation(entry dbi.Entry) string {
+	if entry.Location == "" && entry.Instance != 0 {
+		return fmt.Sprintf("instance %d", entry.Instance)
+	}
+	return entry.Location
+}
@@ -0,0 +1,248 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/ZafranSecurity/go-rpmdb/pkg/bdb"
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+)
+
+func TestSalvagePackages(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	headers := ndbHeaders(t, file)
+	pairs := func(order binary.ByteOrder) []bdbPair {
+		return instancePairs(headers, order)
+	}
+	// damageBDBPage claims that the first page of type typ with entries holds
+	// more of them than fit, and returns it with the number of pairs it held
+	damageBDBPage := func(t *testing.T, db []byte, pageSize int, order binary.ByteOrder, typ byte) (uint32, int) {
+		for off := pageSize; off < len(db); off += pageSize {
+			page := db[off : off+pageSize]
+			if page[25] == typ && order.Uint16(page[20:]) > 0 {
+				pairs := int(order.Uint16(page[20:])) / 2
+				order.PutUint16(page[20:], 0xfffe)
+				return uint32(off / pageSize), pairs
+			}
+		}
+		t.Fatalf("no page of type %d", typ)
+		return 0, 0
+	}
+
+	tests := []struct {
+		name string
+		// damage returns a damaged database, the number of packages lost and
+		// the location of the damage
+		damage func(t *testing.T) (db []byte, lost int, location string)
+	}{
+		{
+			name: "ndb slot magic",
+			damage: func(t *testing.T) ([]byte, int, string) {
+				db, err := os.ReadFile(file)
+				require.NoError(t, err)
+				for off := 32; off < len(db); off += 16 {
+					if binary.LittleEndian.Uint32(db[off+4:]) == headers[3].Instance {
+						copy(db[off:], "Bad!")
+						return db, 1, fmt.Sprintf("slot %d", off/16)
+					}
+				}
+				t.Fatal("no slot")
+				return nil, 0, ""
+			},
+		},
+		{
+			name: "ndb blob checksum",
+			damage: func(t *testing.T) ([]byte, int, string) {
+				db, err := os.ReadFile(file)
+				require.NoError(t, err)
+				for off := 32; off < len(db); off += 16 {
+					if binary.LittleEndian.Uint32(db[off+4:]) == headers[5].Instance {
+						blob := int64(binary.LittleEndian.Uint32(db[off+8:]))*ndb.NDB_BlkSize + ndb.NDB_BlobHeaderSize
+						db[blob+100] ^= 0xff
+						return db, 1, fmt.Sprintf("slot %d", off/16)
+					}
+				}
+				t.Fatal("no slot")
+				return nil, 0, ""
+			},
+		},
+		{
+			name: "bdb hash page",
+			damage: func(t *testing.T) ([]byte, int, string) {
+				db := bdbHash(t, 1024, binary.LittleEndian, pairs(binary.LittleEndian))
+				pgNo, lost := damageBDBPage(t, db, 1024, binary.LittleEndian, bdb.HashPageType)
+				return db, lost, fmt.Sprintf("page %d", pgNo)
+			},
+		},
+		{
+			name: "bdb btree leaf page",
+			damage: func(t *testing.T) ([]byte, int, string) {
+				db := bdbBtree(t, 1024, binary.BigEndian, pairs(binary.BigEndian))
+				pgNo, lost := damageBDBPage(t, db, 1024, binary.BigEndian, bdb.BtreeLeafPageType)
+				return db, lost, fmt.Sprintf("page %d", pgNo)
+			},
+		},
+		{
+			name: "lmdb leaf page",
+			damage: func(t *testing.T) ([]byte, int, string) {
+				const pageSize, hdr = 512, 16
+				order := binary.LittleEndian
+				db := lmdbEnv(pageSize, order, 8, pairs(order))
+				for pgNo := 2; pgNo < len(db)/pageSize; pgNo++ {
+					page := db[pgNo*pageSize : (pgNo+1)*pageSize]
+					lower := int(order.Uint16(page[12:]))
+					// a leaf page of the Packages database, whose keys are
+					// instances
+					if order.Uint16(page[10:]) == 0x02 && lower > hdr &&
+						order.Uint16(page[order.Uint16(page[hdr:])+6:]) == 4 {
+						order.PutUint64(page, 1)
+						return db, (lower - hdr) / 2, fmt.Sprintf("page %d", pgNo)
+					}
+				}
+				t.Fatal("no leaf page")
+				return nil, 0, ""
+			},
+		},
+		{
+			name: "sqlite leaf page",
+			damage: func(t *testing.T) ([]byte, int, string) {
+				p, root := sqlitePackages(t, 512, headers)
+				b, err := os.ReadFile(p)
+				require.NoError(t, err)
+				page := func(pgNo int) []byte {
+					return b[(pgNo-1)*512 : pgNo*512]
+				}
+				// the left-most child of the interior root page
+				require.Equal(t, byte(0x05), page(root)[0])
+				cell := binary.BigEndian.Uint16(page(root)[12:])
+				child := int(binary.BigEndian.Uint32(page(root)[cell:]))
+				leaf := page(child)
+				require.Equal(t, byte(0x0d), leaf[0])
+				leaf[0] = 0
+				return b, int(binary.BigEndian.Uint16(leaf[3:])), fmt.Sprintf("page %d", child)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, lost, location := tt.damage(t)
+			require.NotZero(t, lost)
+
+			db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+			require.NoError(t, err)
+			_, err = db.ListPackages()
+			require.Error(t, err)
+
+			for _, concurrency := range []int{1, 4} {
+				pkgs, diagnostics, err := db.SalvagePackages(context.Background(), ListOptions{
+					Fields:      FieldNEVRA,
+					Concurrency: concurrency,
+				})
+				require.NoError(t, err)
+				require.Len(t, diagnostics, 1, "%v", diagnostics)
+				assert.Equal(t, location, diagnostics[0].Location)
+				assert.Error(t, diagnostics[0].Err)
+
+				assert.Len(t, pkgs, len(headers)-lost)
+				instances := lo.Map(pkgs, func(pkg *PackageInfo, _ int) uint32 {
+					assert.NotEmpty(t, pkg.Name)
+					return pkg.Instance
+				})
+				assert.Len(t, lo.Uniq(instances), len(pkgs))
+			}
+		})
+	}
+
+	t.Run("decode", func(t *testing.T) {
+		good := dbi.Entry{Value: headers[0].Value, Instance: headers[0].Instance}
+		fake := &fakeDB{
+			entries: []dbi.Entry{
+				good,
+				{Value: []byte("not a header"), Instance: 7},
+				{Err: xerrors.New("unreadable"), Location: "page 3"},
+				good,
+			},
+			done: make(chan struct{}),
+		}
+		db := &RpmDB{Db: fake}
+
+		pkgs, diagnostics, err := db.SalvagePackages(context.Background(), ListOptions{})
+		require.NoError(t, err)
+		assert.Len(t, pkgs, 2)
+		require.Len(t, diagnostics, 2)
+		assert.Equal(t, "instance 7", diagnostics[0].Location)
+		assert.Equal(t, "page 3", diagnostics[1].Location)
+		assert.Equal(t, "page 3: unreadable", diagnostics[1].String())
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		db, err := Open(file)
+		require.NoError(t, err)
+		defer db.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err = db.SalvagePackages(ctx, ListOptions{})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+// ndbHeaders returns copies of the headers in the NDB database at path
+func ndbHeaders(t *testing.T, path string) []dbi.Entry {
+	t.Helper()
+	source, err := ndb.Open(path)
+	require.NoError(t, err)
+	defer source.Close()
+	var headers []dbi.Entry
+	for entry := range source.Read() {
+		require.NoError(t, entry.Err)
+		headers = append(headers, dbi.Entry{Value: bytes.Clone(entry.Value), Instance: entry.Instance})
+	}
+	return headers
+}
+
+// instancePairs keys headers by their instance, like the Packages database of
+// Berkeley DB and LMDB
+func instancePairs(headers []dbi.Entry, order binary.ByteOrder) []bdbPair {
+	return lo.Map(headers, func(h dbi.Entry, _ int) bdbPair {
+		key := make([]byte, 4)
+		order.PutUint32(key, h.Instance)
+		return bdbPair{key: key, value: h.Value}
+	})
+}
+
+// sqlitePackages writes headers to the Packages table of a new SQLite
+// database with the given page size, and returns its path and the root page
+// of the table
+func sqlitePackages(t *testing.T, pageSize int, headers []dbi.Entry) (string, int) {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "rpmdb.sqlite")
+	db, err := sql.Open("sqlite", p)
+	require.NoError(t, err)
+	for _, stmt := range []string{
+		fmt.Sprintf("PRAGMA page_size=%d", pageSize),
+		"CREATE TABLE Packages (hnum INTEGER PRIMARY KEY AUTOINCREMENT, blob BLOB NOT NULL)",
+	} {
+		_, err := db.Exec(stmt)
+		require.NoError(t, err)
+	}
+	for _, h := range headers {
+		_, err := db.Exec("INSERT INTO Packages (hnum, blob) VALUES (?, ?)", h.Instance, h.Value)
+		require.NoError(t, err)
+	}
+	var root int
+	require.NoError(t, db.QueryRow("SELECT rootpage FROM sqlite_schema WHERE name = 'Packages'").Scan(&root))
+	require.NoError(t, db.Close())
+	return p, root
+}
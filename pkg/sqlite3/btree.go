@@ -0,0 +1,644 @@
+package sqlite3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* A minimal, read-only decoder of the SQLite3 file format. It only knows
+   enough to walk the table b-trees of an rpmdb.sqlite, which lets us read a
+   database from any io.ReaderAt without going through a SQL driver.
+
+   https://www.sqlite.org/fileformat.html
+*/
+
+const (
+	fileHeaderSize = 100
+
+	// https://www.sqlite.org/fileformat.html#b_tree_pages
+	pageTypeInteriorIndex = 0x02
+	pageTypeInteriorTable = 0x05
+	pageTypeLeafIndex     = 0x0a
+	pageTypeLeafTable     = 0x0d
+
+	// b-trees deeper than this are considered corrupt
+	maxTreeDepth = 64
+)
+
+// Header is the 100 byte database header at the start of a SQLite3 file.
+// ref. https://www.sqlite.org/fileformat.html#the_database_header
+type Header struct {
+	PageSize      uint32
+	WriteVersion  uint8 // 1 for rollback journal, 2 for WAL
+	ReadVersion   uint8
+	ReservedSpace uint8
+	ChangeCounter uint32
+	Pages         uint32 // only valid if VersionValid is set
+	SchemaCookie  uint32
+	SchemaFormat  uint32
+	TextEncoding  uint32
+	UserVersion   uint32
+	ApplicationID uint32
+	VersionValid  bool
+	SQLiteVersion uint32 // SQLITE_VERSION_NUMBER of the last writer
+}
+
+// ParseHeader parses the database header of a SQLite3 file.
+func ParseHeader(data []byte) (*Header, error) {
+	if !bytes.HasPrefix(data, SQLite3_HeaderMagic) {
+		if len(data) > 0 && bytes.HasPrefix(SQLite3_HeaderMagic, data) {
+			return nil, xerrors.Errorf("truncated sqlite3 header: %d bytes", len(data))
+		}
+		return nil, ErrorInvalidSQLite3
+	}
+	if len(data) < fileHeaderSize {
+		return nil, xerrors.Errorf("truncated sqlite3 header: %d bytes", len(data))
+	}
+
+	be := binary.BigEndian
+	hdr := &Header{
+		PageSize:      uint32(be.Uint16(data[16:18])),
+		WriteVersion:  data[18],
+		ReadVersion:   data[19],
+		ReservedSpace: data[20],
+		ChangeCounter: be.Uint32(data[24:28]),
+		Pages:         be.Uint32(data[28:32]),
+		SchemaCookie:  be.Uint32(data[40:44]),
+		SchemaFormat:  be.Uint32(data[44:48]),
+		TextEncoding:  be.Uint32(data[56:60]),
+		UserVersion:   be.Uint32(data[60:64]),
+		ApplicationID: be.Uint32(data[68:72]),
+		SQLiteVersion: be.Uint32(data[96:100]),
+	}
+	// the in-header database size is only trustworthy if it was written by a
+	// version of SQLite that also bumped the change counter
+	hdr.VersionValid = hdr.ChangeCounter == be.Uint32(data[92:96])
+
+	if hdr.PageSize == 1 {
+		hdr.PageSize = 65536
+	}
+	if hdr.PageSize < 512 || hdr.PageSize&(hdr.PageSize-1) != 0 {
+		return nil, xerrors.Errorf("unexpected page size: %d", hdr.PageSize)
+	}
+	if hdr.PageSize-uint32(hdr.ReservedSpace) < 480 {
+		return nil, xerrors.Errorf("unexpected reserved space: %d", hdr.ReservedSpace)
+	}
+
+	return hdr, nil
+}
+
+type pager struct {
+	r        io.ReaderAt
+	pageSize uint32
+	usable   uint32
+	nPages   uint32
+	// committed pages that are newer than the database file, if any
+	wal *wal
+	// set on the copy of the pager made for a read of Packages
+	budget *dbi.Budget
+}
+
+func newPager(r io.ReaderAt, size int64, w *wal) (*pager, error) {
+	buf := make([]byte, fileHeaderSize)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("failed to read sqlite3 header: %w", err)
+	}
+	if w != nil {
+		// the header is part of page 1, which the log may have changed
+		if page, ok, err := w.page(1); err != nil {
+			return nil, err
+		} else if ok {
+			n = copy(buf, page)
+		}
+	}
+
+	hdr, err := ParseHeader(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	nPages := hdr.Pages
+	if nPages == 0 || !hdr.VersionValid {
+		nPages = uint32(size / int64(hdr.PageSize))
+	}
+	if w != nil {
+		if w.pageSize != hdr.PageSize {
+			return nil, xerrors.Errorf("WAL page size %d does not match database page size %d", w.pageSize, hdr.PageSize)
+		}
+		nPages = w.dbSize
+	}
+
+	return &pager{
+		r:        r,
+		pageSize: hdr.PageSize,
+		usable:   hdr.PageSize - uint32(hdr.ReservedSpace),
+		nPages:   nPages,
+		wal:      w,
+	}, nil
+}
+
+func (p *pager) page(pgno uint32) ([]byte, error) {
+	if pgno < 1 || pgno > p.nPages {
+		return nil, xerrors.Errorf("page %d out of range (1-%d)", pgno, p.nPages)
+	}
+	if err := p.budget.Page(); err != nil {
+		return nil, err
+	}
+
+	if p.wal != nil {
+		if buf, ok, err := p.wal.page(pgno); err != nil || ok {
+			return buf, err
+		}
+	}
+
+	buf := make([]byte, p.pageSize)
+	n, err := p.r.ReadAt(buf, int64(pgno-1)*int64(p.pageSize))
+	if n != len(buf) {
+		return nil, xerrors.Errorf("failed to read page %d: %w", pgno, err)
+	}
+	return buf, nil
+}
+
+// tableRoot looks up the root page of the named table in sqlite_schema.
+func (p *pager) tableRoot(name string) (uint32, error) {
+	root, err := p.schemaRoot("table", name)
+	if err != nil {
+		return 0, err
+	}
+	if root == 0 {
+		return 0, xerrors.Errorf("no such table: %s", name)
+	}
+	return root, nil
+}
+
+// schemaRoot looks up the root page of the named table or index in
+// sqlite_schema. It returns 0 if there is no such object.
+func (p *pager) schemaRoot(typ, name string) (uint32, error) {
+	var root uint32
+	err := p.walkTable(1, func(_ int64, payload []byte) error {
+		record, err := parseRecord(payload)
+		if err != nil {
+			return err
+		}
+		if len(record) < 4 {
+			return xerrors.Errorf("invalid sqlite_schema record: %d columns", len(record))
+		}
+
+		// columns: type, name, tbl_name, rootpage, sql
+		recordType, _ := record[0].(string)
+		recordName, _ := record[1].(string)
+		if recordType != typ || recordName != name {
+			return nil
+		}
+		pgno, ok := record[3].(int64)
+		if !ok || pgno < 1 || pgno > math.MaxUint32 {
+			return xerrors.Errorf("invalid root page for %s %s: %v", typ, name, record[3])
+		}
+		root = uint32(pgno)
+		return errStopWalk
+	})
+	if err != nil && err != errStopWalk {
+		return 0, xerrors.Errorf("failed to read sqlite_schema: %w", err)
+	}
+	return root, nil
+}
+
+var errStopWalk = xerrors.New("stop walk")
+
+// btreePage is a decoded b-tree page header.
+// ref. https://www.sqlite.org/fileformat.html#b_tree_pages
+type btreePage struct {
+	pgno  uint32
+	data  []byte
+	typ   byte
+	cells []int  // offsets of the cells in data
+	right uint32 // right-most child of interior pages
+}
+
+func (p *pager) btreePage(pgno uint32, depth int) (*btreePage, error) {
+	if depth > maxTreeDepth {
+		return nil, xerrors.Errorf("b-tree too deep at page %d", pgno)
+	}
+
+	page, err := p.page(pgno)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first page also holds the database header
+	hdrOffset := 0
+	if pgno == 1 {
+		hdrOffset = fileHeaderSize
+	}
+	if len(page) < hdrOffset+8 {
+		return nil, xerrors.Errorf("short b-tree page %d", pgno)
+	}
+
+	bp := &btreePage{pgno: pgno, data: page, typ: page[hdrOffset]}
+	numCells := int(binary.BigEndian.Uint16(page[hdrOffset+3:]))
+
+	cellPtrs := hdrOffset + 8
+	switch bp.typ {
+	case pageTypeLeafTable, pageTypeLeafIndex:
+	case pageTypeInteriorTable, pageTypeInteriorIndex:
+		bp.right = binary.BigEndian.Uint32(page[hdrOffset+8:])
+		cellPtrs += 4
+	default:
+		return nil, xerrors.Errorf("unexpected page type %x for b-tree page %d", bp.typ, pgno)
+	}
+	if cellPtrs+2*numCells > len(page) {
+		return nil, xerrors.Errorf("invalid cell count %d on page %d", numCells, pgno)
+	}
+
+	bp.cells = make([]int, numCells)
+	for i := range bp.cells {
+		cell := int(binary.BigEndian.Uint16(page[cellPtrs+2*i:]))
+		if cell >= int(p.usable) {
+			return nil, xerrors.Errorf("invalid cell offset %d on page %d", cell, pgno)
+		}
+		// interior cells start with the 4 byte page number of their child,
+		// which must not run into the reserved space either
+		if (bp.typ == pageTypeInteriorTable || bp.typ == pageTypeInteriorIndex) && cell+4 > int(p.usable) {
+			return nil, xerrors.Errorf("invalid cell offset %d on page %d", cell, pgno)
+		}
+		bp.cells[i] = cell
+	}
+	return bp, nil
+}
+
+// child returns the left child of interior cell i.
+func (bp *btreePage) child(i int) uint32 {
+	return binary.BigEndian.Uint32(bp.data[bp.cells[i]:])
+}
+
+// tableCell decodes the rowid and payload of cell i of a table leaf page.
+func (p *pager) tableCell(bp *btreePage, i int) (int64, []byte, error) {
+	cell := bp.cells[i]
+	payloadLen, n := varint(bp.data[cell:p.usable])
+	if n == 0 {
+		return 0, nil, xerrors.Errorf("invalid payload length on page %d", bp.pgno)
+	}
+	cell += n
+	rowid, n := varint(bp.data[cell:p.usable])
+	if n == 0 {
+		return 0, nil, xerrors.Errorf("invalid rowid on page %d", bp.pgno)
+	}
+	cell += n
+
+	payload, err := p.payload(bp.data, cell, payloadLen, p.usable-35)
+	if err != nil {
+		return 0, nil, xerrors.Errorf("failed to read cell %d on page %d: %w", i, bp.pgno, err)
+	}
+	return int64(rowid), payload, nil
+}
+
+// indexCell decodes the payload of cell i of an index page.
+func (p *pager) indexCell(bp *btreePage, i int) ([]byte, error) {
+	cell := bp.cells[i]
+	if bp.typ == pageTypeInteriorIndex {
+		cell += 4
+	}
+	payloadLen, n := varint(bp.data[cell:p.usable])
+	if n == 0 {
+		return nil, xerrors.Errorf("invalid payload length on page %d", bp.pgno)
+	}
+
+	maxLocal := (p.usable-12)*64/255 - 23
+	payload, err := p.payload(bp.data, cell+n, payloadLen, maxLocal)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read cell %d on page %d: %w", i, bp.pgno, err)
+	}
+	return payload, nil
+}
+
+// walkTable calls fn for every row of the table b-tree rooted at root, in
+// rowid order.
+func (p *pager) walkTable(root uint32, fn func(rowid int64, payload []byte) error) error {
+	return p.walkTablePage(root, 0, visitedPages{}, fn, nil)
+}
+
+// salvageTable is like walkTable, but calls damaged with the pages and cells
+// that cannot be read and skips them, unless damaged returns an error.
+func (p *pager) salvageTable(root uint32, fn func(rowid int64, payload []byte) error, damaged func(pgno uint32, err error) error) error {
+	return p.walkTablePage(root, 0, visitedPages{}, fn, damaged)
+}
+
+// visitedPages are the pages of a b-tree walked so far. Each page is in one
+// place of a b-tree, so a page seen twice means the tree is corrupt, and as
+// pages are seen at most once, a walk reads at most nPages pages.
+type visitedPages map[uint32]bool
+
+func (v visitedPages) visit(pgno uint32) error {
+	if v[pgno] {
+		return xerrors.Errorf("b-tree page %d is referenced twice", pgno)
+	}
+	v[pgno] = true
+	return nil
+}
+
+func (p *pager) walkTablePage(pgno uint32, depth int, visited visitedPages, fn func(rowid int64, payload []byte) error, damaged func(pgno uint32, err error) error) error {
+	fail := func(err error) error {
+		if damaged == nil {
+			return err
+		}
+		return damaged(pgno, err)
+	}
+
+	if err := visited.visit(pgno); err != nil {
+		return fail(err)
+	}
+	bp, err := p.btreePage(pgno, depth)
+	if err != nil {
+		return fail(err)
+	}
+
+	switch bp.typ {
+	case pageTypeInteriorTable:
+		for i := range bp.cells {
+			if err := p.walkTablePage(bp.child(i), depth+1, visited, fn, damaged); err != nil {
+				return err
+			}
+		}
+		return p.walkTablePage(bp.right, depth+1, visited, fn, damaged)
+	case pageTypeLeafTable:
+		for i := range bp.cells {
+			rowid, payload, err := p.tableCell(bp, i)
+			if err != nil {
+				if err := fail(err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(rowid, payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fail(xerrors.Errorf("unexpected page type %x for table b-tree page %d", bp.typ, pgno))
+}
+
+// findRow returns the payload of the row with the given rowid in the table
+// b-tree rooted at root, or nil if there is no such row.
+func (p *pager) findRow(root uint32, rowid int64) ([]byte, error) {
+	pgno := root
+	for depth := 0; ; depth++ {
+		bp, err := p.btreePage(pgno, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		switch bp.typ {
+		case pageTypeInteriorTable:
+			// the left child of a cell holds the rowids up to its key
+			pgno = bp.right
+			for i, cell := range bp.cells {
+				key, n := varint(bp.data[cell+4 : p.usable])
+				if n == 0 {
+					return nil, xerrors.Errorf("invalid rowid on page %d", bp.pgno)
+				}
+				if rowid <= int64(key) {
+					pgno = bp.child(i)
+					break
+				}
+			}
+		case pageTypeLeafTable:
+			for i := range bp.cells {
+				id, payload, err := p.tableCell(bp, i)
+				if err != nil {
+					return nil, err
+				}
+				if id == rowid {
+					return payload, nil
+				}
+			}
+			return nil, nil
+		default:
+			return nil, xerrors.Errorf("unexpected page type %x for table b-tree page %d", bp.typ, pgno)
+		}
+	}
+}
+
+// searchIndex calls fn with the rowid of every entry of the index b-tree
+// rooted at root whose first column matches the key compare compares with,
+// such as compareText, in index order.
+func (p *pager) searchIndex(root uint32, compare func(v any) int, fn func(rowid int64) error) error {
+	return p.searchIndexPage(root, 0, visitedPages{}, compare, fn)
+}
+
+func (p *pager) searchIndexPage(pgno uint32, depth int, visited visitedPages, compare func(v any) int, fn func(rowid int64) error) error {
+	if err := visited.visit(pgno); err != nil {
+		return err
+	}
+	bp, err := p.btreePage(pgno, depth)
+	if err != nil {
+		return err
+	}
+	if bp.typ != pageTypeInteriorIndex && bp.typ != pageTypeLeafIndex {
+		return xerrors.Errorf("unexpected page type %x for index b-tree page %d", bp.typ, pgno)
+	}
+
+	for i := range bp.cells {
+		payload, err := p.indexCell(bp, i)
+		if err != nil {
+			return err
+		}
+		record, err := parseRecord(payload)
+		if err != nil {
+			return xerrors.Errorf("invalid index record on page %d: %w", pgno, err)
+		}
+		if len(record) < 2 {
+			return xerrors.Errorf("unexpected index columns on page %d: %d", pgno, len(record))
+		}
+
+		cmp := compare(record[0])
+		if cmp <= 0 && bp.typ == pageTypeInteriorIndex {
+			// the left child holds the entries before this one
+			if err := p.searchIndexPage(bp.child(i), depth+1, visited, compare, fn); err != nil {
+				return err
+			}
+		}
+		if cmp < 0 {
+			return nil
+		}
+		if cmp == 0 {
+			// the last column of an index entry is the rowid of the table row
+			rowid, ok := record[len(record)-1].(int64)
+			if !ok {
+				return xerrors.Errorf("invalid rowid in index on page %d: %v", pgno, record[len(record)-1])
+			}
+			if err := fn(rowid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if bp.typ == pageTypeInteriorIndex {
+		return p.searchIndexPage(bp.right, depth+1, visited, compare, fn)
+	}
+	return nil
+}
+
+// compareText compares the text key to a column value with the BINARY
+// collation. NULL and numbers sort before text, and blobs after it.
+func compareText(key string, v any) int {
+	switch v := v.(type) {
+	case string:
+		return strings.Compare(key, v)
+	case []byte:
+		return -1
+	}
+	return 1
+}
+
+// compareBlob is like compareText for a blob key. NULL, numbers and text sort
+// before blobs.
+func compareBlob(key []byte, v any) int {
+	if v, ok := v.([]byte); ok {
+		return bytes.Compare(key, v)
+	}
+	return 1
+}
+
+// payload assembles a cell payload of the given total length starting at
+// offset off of page, following the overflow chain if the payload does not fit
+// into maxLocal bytes.
+// ref. https://www.sqlite.org/fileformat.html#cell_payload_overflow_pages
+func (p *pager) payload(page []byte, off int, total uint64, maxLocal uint32) ([]byte, error) {
+	if total > math.MaxInt64 {
+		return nil, xerrors.Errorf("payload of %d bytes", total)
+	}
+	if err := p.budget.Header(int64(total)); err != nil {
+		return nil, err
+	}
+	usable := uint64(p.usable)
+	if total <= uint64(maxLocal) {
+		if uint64(off)+total > usable {
+			return nil, xerrors.Errorf("payload of %d bytes exceeds page", total)
+		}
+		return page[off : off+int(total)], nil
+	}
+
+	minLocal := (usable-12)*32/255 - 23
+	local := minLocal + (total-minLocal)%(usable-4)
+	if local > uint64(maxLocal) {
+		local = minLocal
+	}
+	if uint64(off)+local+4 > usable {
+		return nil, xerrors.Errorf("payload of %d bytes exceeds page", local)
+	}
+	if total > uint64(p.nPages)*usable {
+		return nil, xerrors.Errorf("payload of %d bytes exceeds database", total)
+	}
+
+	buf := make([]byte, 0, total)
+	buf = append(buf, page[off:off+int(local)]...)
+	next := binary.BigEndian.Uint32(page[off+int(local):])
+	for visited := uint32(0); uint64(len(buf)) < total; visited++ {
+		if next == 0 || visited >= p.nPages {
+			return nil, xerrors.Errorf("truncated overflow chain (%d of %d bytes)", len(buf), total)
+		}
+		overflow, err := p.page(next)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read overflow page: %w", err)
+		}
+		next = binary.BigEndian.Uint32(overflow)
+		n := min(total-uint64(len(buf)), usable-4)
+		buf = append(buf, overflow[4:4+n]...)
+	}
+	return buf, nil
+}
+
+// parseRecord decodes a record into its column values, which are nil, int64,
+// float64, []byte or string.
+// ref. https://www.sqlite.org/fileformat.html#record_format
+func parseRecord(payload []byte) ([]any, error) {
+	hdrLen, n := varint(payload)
+	if n == 0 || hdrLen < uint64(n) || hdrLen > uint64(len(payload)) {
+		return nil, xerrors.New("invalid record header")
+	}
+
+	var values []any
+	body := payload[hdrLen:]
+	for hdr := payload[n:hdrLen]; len(hdr) > 0; {
+		serialType, n := varint(hdr)
+		if n == 0 {
+			return nil, xerrors.New("invalid record serial type")
+		}
+		hdr = hdr[n:]
+
+		var size uint64
+		switch {
+		case serialType <= 4:
+			size = serialType
+		case serialType == 5:
+			size = 6
+		case serialType == 6 || serialType == 7:
+			size = 8
+		case serialType == 8 || serialType == 9:
+			size = 0
+		case serialType >= 12:
+			size = (serialType - 12) / 2
+		default:
+			return nil, xerrors.Errorf("reserved record serial type %d", serialType)
+		}
+		if size > uint64(len(body)) {
+			return nil, xerrors.New("record body too short")
+		}
+		data := body[:size]
+		body = body[size:]
+
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType <= 6:
+			// big-endian two's complement integer of 1-8 bytes
+			var v int64
+			if size > 0 && data[0]&0x80 != 0 {
+				v = -1
+			}
+			for _, b := range data {
+				v = v<<8 | int64(b)
+			}
+			values = append(values, v)
+		case serialType == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(data)))
+		case serialType == 8:
+			values = append(values, int64(0))
+		case serialType == 9:
+			values = append(values, int64(1))
+		case serialType%2 == 0:
+			values = append(values, data)
+		default:
+			values = append(values, string(data))
+		}
+	}
+	return values, nil
+}
+
+// varint decodes a SQLite variable-length integer, returning the value and
+// the number of bytes read, or 0 bytes if buf is too short.
+// ref. https://www.sqlite.org/fileformat.html#varint
+func varint(buf []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(buf) {
+			return 0, 0
+		}
+		if i == 8 {
+			return v<<8 | uint64(buf[i]), 9
+		}
+		v = v<<7 | uint64(buf[i]&0x7f)
+		if buf[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
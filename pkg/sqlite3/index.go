@@ -0,0 +1,170 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* Every rpm index is a table of (key, hnum, idx) rows, where hnum refers to
+   Packages and idx is the position of the key in the indexed tag. rpm also
+   creates an index named <table>_key_idx on the key column, which is used to
+   find the rows of a key without scanning the table.
+*/
+
+var _ dbi.IndexLookup = (*SQLite3)(nil)
+
+// LookupIndex implements dbi.IndexLookup.
+func (db *SQLite3) LookupIndex(ctx context.Context, index dbi.Index, key string) ([]dbi.IndexMatch, error) {
+	if db.pager == nil {
+		return db.queryIndex(ctx, index, key)
+	}
+
+	table, err := db.pager.schemaRoot("table", string(index))
+	if err != nil {
+		return nil, err
+	}
+	if table == 0 {
+		return nil, xerrors.Errorf("%s: %w", index, dbi.ErrNoIndex)
+	}
+
+	// rpm stores the keys of binary indexes as blobs, which never equal text
+	compare := func(v any) int { return compareText(key, v) }
+	if index.Binary() {
+		compare = func(v any) int { return compareBlob([]byte(key), v) }
+	}
+
+	var matches []dbi.IndexMatch
+	collect := func(_ int64, payload []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		match, ok, err := indexRow(payload, compare)
+		if err != nil {
+			return xerrors.Errorf("invalid %s row: %w", index, err)
+		}
+		if ok {
+			matches = append(matches, match)
+		}
+		return nil
+	}
+
+	keyIndex, err := db.pager.schemaRoot("index", string(index)+"_key_idx")
+	if err != nil {
+		return nil, err
+	}
+	if keyIndex == 0 {
+		err = db.pager.walkTable(table, collect)
+	} else {
+		err = db.pager.searchIndex(keyIndex, compare, func(rowid int64) error {
+			payload, err := db.pager.findRow(table, rowid)
+			if err != nil {
+				return err
+			}
+			if payload == nil {
+				return xerrors.Errorf("%s index refers to missing row %d", index, rowid)
+			}
+			return collect(rowid, payload)
+		})
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("failed to look up %s: %w", index, err)
+	}
+
+	return matches, nil
+}
+
+// indexRow decodes a row of an index table if compare finds its key equal.
+func indexRow(payload []byte, compare func(v any) int) (dbi.IndexMatch, bool, error) {
+	record, err := parseRecord(payload)
+	if err != nil {
+		return dbi.IndexMatch{}, false, err
+	}
+	if len(record) < 3 {
+		return dbi.IndexMatch{}, false, xerrors.Errorf("unexpected columns: %d", len(record))
+	}
+
+	// columns: key, hnum, idx
+	if compare(record[0]) != 0 {
+		return dbi.IndexMatch{}, false, nil
+	}
+	hnum, ok1 := record[1].(int64)
+	idx, ok2 := record[2].(int64)
+	if !ok1 || !ok2 {
+		return dbi.IndexMatch{}, false, xerrors.Errorf("unexpected hnum or idx: %v, %v", record[1], record[2])
+	}
+	return dbi.IndexMatch{Instance: uint32(hnum), TagIndex: uint32(idx)}, true, nil
+}
+
+func (db *SQLite3) queryIndex(ctx context.Context, index dbi.Index, key string) ([]dbi.IndexMatch, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", string(index)).Scan(&n)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to query sqlite_master: %w", err)
+	}
+	if n == 0 {
+		return nil, xerrors.Errorf("%s: %w", index, dbi.ErrNoIndex)
+	}
+
+	var value any = key
+	if index.Binary() {
+		value = []byte(key)
+	}
+	table := strings.ReplaceAll(string(index), `"`, `""`)
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT hnum, idx FROM "%s" WHERE key = ?`, table), value)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to look up %s: %w", index, err)
+	}
+	defer rows.Close()
+
+	var matches []dbi.IndexMatch
+	for rows.Next() {
+		var match dbi.IndexMatch
+		if err := rows.Scan(&match.Instance, &match.TagIndex); err != nil {
+			return nil, xerrors.Errorf("failed to Scan Row: %w", err)
+		}
+		matches = append(matches, match)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, xerrors.Errorf("failed to look up %s: %w", index, err)
+	}
+	return matches, nil
+}
+
+// ReadInstance implements dbi.IndexLookup.
+func (db *SQLite3) ReadInstance(ctx context.Context, instance uint32) (dbi.Entry, error) {
+	blob, err := db.readInstance(ctx, instance)
+	if err != nil {
+		return dbi.Entry{}, err
+	}
+	return dbi.Entry{Value: blob, Instance: instance}, nil
+}
+
+func (db *SQLite3) readInstance(ctx context.Context, instance uint32) ([]byte, error) {
+	if db.pager == nil {
+		var blob []byte
+		err := db.QueryRowContext(ctx, "SELECT blob FROM Packages WHERE hnum = ?", instance).Scan(&blob)
+		if xerrors.Is(err, sql.ErrNoRows) {
+			return nil, xerrors.Errorf("%d: %w", instance, dbi.ErrNotFound)
+		} else if err != nil {
+			return nil, xerrors.Errorf("failed to read package %d: %w", instance, err)
+		}
+		return blob, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	payload, err := db.pager.findRow(db.packages, int64(instance))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read package %d: %w", instance, err)
+	}
+	if payload == nil {
+		return nil, xerrors.Errorf("%d: %w", instance, dbi.ErrNotFound)
+	}
+	return packageBlob(payload)
+}
@@ -2,9 +2,12 @@ package sqlite3
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 
 	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
@@ -13,6 +16,18 @@ import (
 
 type SQLite3 struct {
 	*sql.DB
+
+	// set instead of DB when the database is read without a SQL driver
+	pager    *pager
+	packages uint32
+
+	// Limits must be set before the database is read.
+	Limits dbi.Limits
+
+	// set if the write-ahead log was taken into account
+	wal *WALStatus
+	// files opened by OpenWithWAL
+	files []*os.File
 }
 
 var (
@@ -43,7 +58,122 @@ func Open(path string) (*SQLite3, error) {
 		return nil, xerrors.Errorf("failed to open sqlite3: %w", err)
 	}
 
-	return &SQLite3{db}, nil
+	return &SQLite3{DB: db}, nil
+}
+
+// OpenReaderAt reads an rpmdb.sqlite of the given size from r. The pages are
+// decoded in Go, so unlike Open no SQL driver needs to be registered. Closing
+// the returned database does not close r.
+func OpenReaderAt(r io.ReaderAt, size int64) (*SQLite3, error) {
+	p, err := newPager(r, size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return openPager(p)
+}
+
+// OpenReaderAtWithWAL is like OpenReaderAt, but also applies the committed
+// transactions of the write-ahead log of the given size in wal, as SQLite
+// would on its next checkpoint. An empty or invalid log is ignored.
+func OpenReaderAtWithWAL(r io.ReaderAt, size int64, wal io.ReaderAt, walSize int64) (*SQLite3, error) {
+	w, status, err := readWAL(wal, walSize)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newPager(r, size, w)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openPager(p)
+	if err != nil {
+		return nil, err
+	}
+	db.wal = &status
+	return db, nil
+}
+
+// OpenWithWAL reads the rpmdb.sqlite at path together with its write-ahead
+// log, path + "-wal", if there is one. Neither file is written to, unlike
+// when SQLite itself opens a database in WAL mode.
+func OpenWithWAL(path string) (*SQLite3, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	files := []*os.File{file}
+	closeFiles := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+
+	var wal io.ReaderAt = bytes.NewReader(nil)
+	var walSize int64
+	walFile, err := os.Open(path + "-wal")
+	switch {
+	case err == nil:
+		files = append(files, walFile)
+		walInfo, err := walFile.Stat()
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+		wal, walSize = walFile, walInfo.Size()
+	case !xerrors.Is(err, fs.ErrNotExist):
+		closeFiles()
+		return nil, xerrors.Errorf("failed to open WAL: %w", err)
+	}
+
+	db, err := OpenReaderAtWithWAL(file, info.Size(), wal, walSize)
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
+	db.files = files
+	return db, nil
+}
+
+func openPager(p *pager) (*SQLite3, error) {
+	root, err := p.tableRoot("Packages")
+	if err != nil {
+		return nil, xerrors.Errorf("failed to find Packages table: %w", err)
+	}
+
+	return &SQLite3{
+		pager:    p,
+		packages: root,
+	}, nil
+}
+
+// WAL reports how the write-ahead log was applied. ok is false if the
+// database was opened without looking at the log.
+func (db *SQLite3) WAL() (status WALStatus, ok bool) {
+	if db.wal == nil {
+		return WALStatus{}, false
+	}
+	return *db.wal, true
+}
+
+func (db *SQLite3) Close() error {
+	if db.DB != nil {
+		return db.DB.Close()
+	}
+
+	var err error
+	for _, f := range db.files {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	db.files = nil
+	return err
 }
 
 func (db *SQLite3) GetPgSize() uint32 {
@@ -55,44 +185,176 @@ func (db *SQLite3) GetLastPgNo() uint32 {
 }
 
 func (db *SQLite3) Read() <-chan dbi.Entry {
+	return db.ReadContext(context.Background())
+}
+
+func (db *SQLite3) ReadContext(ctx context.Context) <-chan dbi.Entry {
+	return db.read(ctx, false)
+}
+
+var _ dbi.Salvager = (*SQLite3)(nil)
+
+// SalvageContext implements dbi.Salvager. Without a SQL driver, pages and
+// rows that cannot be decoded are reported and skipped. Through the driver,
+// only rows that fail to scan can be skipped, as SQLite gives up on the query
+// at the first damaged page.
+func (db *SQLite3) SalvageContext(ctx context.Context) <-chan dbi.Entry {
+	return db.read(ctx, true)
+}
+
+// packagesLocation is the location of errors that are not tied to a row.
+const packagesLocation = "Packages table"
+
+func (db *SQLite3) read(ctx context.Context, salvage bool) <-chan dbi.Entry {
+	if db.pager != nil {
+		return db.readPages(ctx, salvage)
+	}
+
 	entries := make(chan dbi.Entry)
 
 	go func() {
 		defer close(entries)
 
-		rows, err := db.Query("SELECT blob FROM Packages")
+		rows, err := db.QueryContext(ctx, "SELECT hnum, blob FROM Packages")
 		if err != nil {
-			entries <- dbi.Entry{
-				Err: xerrors.Errorf("failed to SELECT query: %w", err),
+			if !dbi.Send(ctx, entries, dbi.Entry{
+				Err:      xerrors.Errorf("failed to SELECT query: %w", err),
+				Location: packagesLocation,
+			}) {
+				return
 			}
 		}
-		if err := db.Close(); err != nil {
-			entries <- dbi.Entry{
+		if err := db.DB.Close(); err != nil {
+			if !dbi.Send(ctx, entries, dbi.Entry{
 				Err: xerrors.Errorf("failed to close DB: %w", err),
+			}) {
+				return
 			}
 		}
 
 		if rows == nil {
-			entries <- dbi.Entry{
-				Err: xerrors.Errorf("query failed to return rows: %w", err),
-			}
+			dbi.Send(ctx, entries, dbi.Entry{
+				Err:      xerrors.Errorf("query failed to return rows: %w", err),
+				Location: packagesLocation,
+			})
 			return
 		}
+		// release the statement even if the reader stops early
+		defer rows.Close()
 
+		budget := dbi.NewBudget(db.Limits)
 		for rows.Next() {
+			var hnum uint32
 			var blob string
-			if err := rows.Scan(&blob); err != nil {
-				entries <- dbi.Entry{
-					Err: xerrors.Errorf("failed to Scan Row: %w", err),
+			if err := rows.Scan(&hnum, &blob); err != nil {
+				if !dbi.Send(ctx, entries, dbi.Entry{
+					Err:      xerrors.Errorf("failed to Scan Row: %w", err),
+					Location: packagesLocation,
+				}) || !salvage {
+					return
 				}
+				continue
+			}
+			if err := budget.Header(int64(len(blob))); err != nil {
+				dbi.Send(ctx, entries, dbi.Entry{Err: err})
+				return
 			}
 
-			entries <- dbi.Entry{
-				Value: []byte(blob),
-				Err:   nil,
+			if !dbi.Send(ctx, entries, dbi.Entry{
+				Value:    []byte(blob),
+				Err:      nil,
+				Instance: hnum,
+			}) {
+				return
 			}
 		}
+		if err := rows.Err(); err != nil && salvage && ctx.Err() == nil {
+			dbi.Send(ctx, entries, dbi.Entry{
+				Err:      xerrors.Errorf("failed to read Packages: %w", err),
+				Location: packagesLocation,
+			})
+		}
 	}()
 
 	return entries
 }
+
+func (db *SQLite3) readPages(ctx context.Context, salvage bool) <-chan dbi.Entry {
+	entries := make(chan dbi.Entry)
+
+	go func() {
+		defer close(entries)
+
+		// the pages and payloads of this read are charged to its own budget
+		p := *db.pager
+		p.budget = dbi.NewBudget(db.Limits)
+
+		// damaged reports a page, cell or row that cannot be read, and lets the
+		// walk go on with the next one
+		damaged := func(location string, err error) error {
+			if dbi.LimitExceeded(err) {
+				return err
+			}
+			if !dbi.Send(ctx, entries, dbi.Entry{Err: err, Location: location}) {
+				return ctx.Err()
+			}
+			return nil
+		}
+
+		// hnum is the INTEGER PRIMARY KEY, so it is stored as the rowid
+		fn := func(rowid int64, payload []byte) error {
+			blob, err := packageBlob(payload)
+			if err != nil {
+				if salvage {
+					return damaged(fmt.Sprintf("row %d", rowid), err)
+				}
+				return err
+			}
+
+			if !dbi.Send(ctx, entries, dbi.Entry{
+				Value:    blob,
+				Instance: uint32(rowid),
+			}) {
+				return ctx.Err()
+			}
+			return nil
+		}
+
+		var err error
+		if salvage {
+			err = p.salvageTable(db.packages, fn, func(pgno uint32, err error) error {
+				return damaged(fmt.Sprintf("page %d", pgno), err)
+			})
+		} else {
+			err = p.walkTable(db.packages, fn)
+		}
+		if err != nil && ctx.Err() == nil {
+			dbi.Send(ctx, entries, dbi.Entry{
+				Err: xerrors.Errorf("failed to read Packages: %w", err),
+			})
+		}
+	}()
+
+	return entries
+}
+
+// packageBlob decodes the header blob of a Packages row.
+func packageBlob(payload []byte) ([]byte, error) {
+	record, err := parseRecord(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(record) < 2 {
+		return nil, xerrors.Errorf("unexpected Packages columns: %d", len(record))
+	}
+
+	// columns: hnum, blob
+	switch v := record[1].(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, xerrors.Errorf("unexpected Packages blob type: %T", v)
+	}
+}
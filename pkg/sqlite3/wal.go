@@ -0,0 +1,160 @@
+package sqlite3
+
+import (
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+/* The write-ahead log, rpmdb.sqlite-wal, holds the pages of transactions
+   that have not been checkpointed into the database file yet. It is a
+   32 byte header followed by frames of a 24 byte frame header and one page.
+   A frame is valid if its salts match the header and its checksum, which is
+   cumulative over the header and all previous frames, matches. Only frames up
+   to the last valid commit frame, one with a non-zero database size, belong
+   to committed transactions.
+
+   https://www.sqlite.org/fileformat.html#the_write_ahead_log
+*/
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+
+	walMagicLE = 0x377f0682 // checksums of little-endian words
+	walMagicBE = 0x377f0683 // checksums of big-endian words
+
+	walFormatVersion = 3007000
+)
+
+// WALStatus tells whether a write-ahead log was found next to a database and
+// how much of it was applied.
+type WALStatus struct {
+	// Present is set if a non-empty write-ahead log was found.
+	Present bool
+	// Applied is the number of frames of committed transactions that were
+	// read from the log instead of the database file.
+	Applied int
+	// Ignored is the number of frames that were not applied, because their
+	// transaction did not commit or they failed validation.
+	Ignored int
+}
+
+type wal struct {
+	r        io.ReaderAt
+	pageSize uint32
+	// offset of the latest committed version of every page in the log
+	frames map[uint32]int64
+	// database size in pages after the last commit, 0 without commits
+	dbSize uint32
+}
+
+// readWAL indexes the committed frames of the write-ahead log of the given
+// size held by r. An invalid log is ignored, as SQLite does.
+func readWAL(r io.ReaderAt, size int64) (*wal, WALStatus, error) {
+	var status WALStatus
+	if size == 0 {
+		return nil, status, nil
+	}
+	status.Present = true
+
+	hdr := make([]byte, walHeaderSize)
+	if n, err := r.ReadAt(hdr, 0); n != len(hdr) {
+		if err != nil && err != io.EOF {
+			return nil, status, xerrors.Errorf("failed to read WAL header: %w", err)
+		}
+		// a log without a complete header is empty
+		return nil, status, nil
+	}
+
+	be := binary.BigEndian
+	var order binary.ByteOrder
+	switch be.Uint32(hdr[0:4]) {
+	case walMagicLE:
+		order = binary.LittleEndian
+	case walMagicBE:
+		order = binary.BigEndian
+	default:
+		return nil, status, nil
+	}
+
+	pageSize := be.Uint32(hdr[8:12])
+	frameSize := int64(walFrameHeaderSize) + int64(pageSize)
+	if pageSize >= 512 && pageSize <= 65536 && pageSize&(pageSize-1) == 0 {
+		status.Ignored = int((size - walHeaderSize) / frameSize)
+	}
+
+	s0, s1 := walChecksum(order, 0, 0, hdr[:24])
+	if be.Uint32(hdr[4:8]) != walFormatVersion || status.Ignored == 0 ||
+		s0 != be.Uint32(hdr[24:28]) || s1 != be.Uint32(hdr[28:32]) {
+		return nil, status, nil
+	}
+
+	w := &wal{
+		r:        r,
+		pageSize: pageSize,
+		frames:   make(map[uint32]int64),
+	}
+
+	pending := make(map[uint32]int64)
+	frame := make([]byte, frameSize)
+	for off := int64(walHeaderSize); off+frameSize <= size; off += frameSize {
+		if n, err := r.ReadAt(frame, off); n != len(frame) {
+			return nil, status, xerrors.Errorf("failed to read WAL frame at %d: %w", off, err)
+		}
+
+		pgno, commit := be.Uint32(frame[0:4]), be.Uint32(frame[4:8])
+		if pgno == 0 || be.Uint32(frame[8:12]) != be.Uint32(hdr[16:20]) || be.Uint32(frame[12:16]) != be.Uint32(hdr[20:24]) {
+			break
+		}
+		s0, s1 = walChecksum(order, s0, s1, frame[:8])
+		s0, s1 = walChecksum(order, s0, s1, frame[walFrameHeaderSize:])
+		if s0 != be.Uint32(frame[16:20]) || s1 != be.Uint32(frame[20:24]) {
+			break
+		}
+
+		pending[pgno] = off + walFrameHeaderSize
+		if commit == 0 {
+			continue
+		}
+
+		// the transaction committed, so its pages are part of the database
+		for p, o := range pending {
+			w.frames[p] = o
+		}
+		status.Applied = int((off-walHeaderSize)/frameSize) + 1
+		w.dbSize = commit
+		clear(pending)
+	}
+	status.Ignored -= status.Applied
+
+	if w.dbSize == 0 {
+		return nil, status, nil
+	}
+	return w, status, nil
+}
+
+// walChecksum continues the checksum s0, s1 over b.
+// ref. https://www.sqlite.org/fileformat.html#checksum_algorithm
+func walChecksum(order binary.ByteOrder, s0, s1 uint32, b []byte) (uint32, uint32) {
+	for i := 0; i+8 <= len(b); i += 8 {
+		s0 += order.Uint32(b[i:]) + s1
+		s1 += order.Uint32(b[i+4:]) + s0
+	}
+	return s0, s1
+}
+
+// page returns the committed version of page pgno from the log, if any.
+func (w *wal) page(pgno uint32) ([]byte, bool, error) {
+	off, ok := w.frames[pgno]
+	if !ok {
+		return nil, false, nil
+	}
+
+	buf := make([]byte, w.pageSize)
+	if n, err := w.r.ReadAt(buf, off); n != len(buf) {
+		return nil, false, xerrors.Errorf("failed to read page %d from WAL: %w", pgno, err)
+	}
+	return buf, true, nil
+}
@@ -0,0 +1,185 @@
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"os"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"golang.org/x/xerrors"
+)
+
+/* Create lays out the tables the way rpm 4.16 does on rpmdb --initdb. The
+   keys of the index tables are TEXT, except for the binary indexes, whose
+   keys are BLOBs and which rpm creates no key index for. rpm binds the keys
+   with the same type when it looks them up, so a key stored with another type
+   is never found. The tables of array tags also get an index on hnum, which
+   rpm uses to remove the keys of an erased package.
+
+   https://github.com/rpm-software-management/rpm/blob/rpm-4.16.0-release/lib/backend/sqlite.c
+*/
+
+// Writer creates an rpmdb.sqlite. It implements dbi.Writer.
+type Writer struct {
+	db       *sql.DB
+	tx       *sql.Tx
+	packages *sql.Stmt
+	indexes  map[dbi.Index]*sql.Stmt
+}
+
+var _ dbi.Writer = (*Writer)(nil)
+
+// Create creates an rpmdb.sqlite at path, which must not exist yet, with
+// Packages and every index table of dbi.Indexes. Like Open, it needs the
+// "sqlite" SQL driver. Everything is written in one transaction, which Close
+// commits.
+func Create(path string) (*Writer, error) {
+	if _, err := os.Lstat(path); err == nil {
+		return nil, xerrors.Errorf("%s: %w", path, fs.ErrExist)
+	} else if !xerrors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=rwc", path))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open sqlite3: %w", err)
+	}
+	// the transaction holds the only connection
+	db.SetMaxOpenConns(1)
+
+	w := &Writer{db: db, indexes: map[dbi.Index]*sql.Stmt{}}
+	if err := w.init(); err != nil {
+		_ = w.abort()
+		_ = os.Remove(path)
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) init() error {
+	var err error
+	if w.tx, err = w.db.Begin(); err != nil {
+		return xerrors.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if _, err := w.tx.Exec("CREATE TABLE 'Packages' (hnum INTEGER PRIMARY KEY AUTOINCREMENT,blob BLOB NOT NULL)"); err != nil {
+		return xerrors.Errorf("failed to create Packages: %w", err)
+	}
+	if w.packages, err = w.tx.Prepare("INSERT INTO 'Packages' (hnum, blob) VALUES (?, ?)"); err != nil {
+		return xerrors.Errorf("failed to prepare Packages insert: %w", err)
+	}
+
+	for _, index := range dbi.Indexes {
+		keyType := "TEXT"
+		if index.Binary() {
+			keyType = "BLOB"
+		}
+		stmts := []string{fmt.Sprintf("CREATE TABLE '%s' (key '%s' NOT NULL, hnum INTEGER NOT NULL, idx INTEGER NOT NULL, "+
+			"FOREIGN KEY (hnum) REFERENCES 'Packages'(hnum))", index, keyType)}
+		if !index.Binary() {
+			stmts = append(stmts, fmt.Sprintf("CREATE INDEX '%s_key_idx' ON '%s'(key ASC)", index, index))
+		}
+		if index.Array() {
+			stmts = append(stmts, fmt.Sprintf("CREATE INDEX '%s_hnum_idx' ON '%s'(hnum ASC)", index, index))
+		}
+		for _, stmt := range stmts {
+			if _, err := w.tx.Exec(stmt); err != nil {
+				return xerrors.Errorf("failed to create %s: %w", index, err)
+			}
+		}
+
+		insert, err := w.tx.Prepare(fmt.Sprintf("INSERT INTO '%s' (key, hnum, idx) VALUES (?, ?, ?)", index))
+		if err != nil {
+			return xerrors.Errorf("failed to prepare %s insert: %w", index, err)
+		}
+		w.indexes[index] = insert
+	}
+	return nil
+}
+
+// Put implements dbi.Writer. If it fails, nothing of the header is written.
+func (w *Writer) Put(instance uint32, blob []byte, keys map[dbi.Index][]dbi.IndexKey) error {
+	if instance == 0 {
+		return xerrors.New("instance 0 is reserved")
+	}
+	for index := range keys {
+		if w.indexes[index] == nil {
+			return xerrors.Errorf("%s: %w", index, dbi.ErrNoIndex)
+		}
+	}
+
+	if _, err := w.tx.Exec("SAVEPOINT put"); err != nil {
+		return xerrors.Errorf("failed to write package %d: %w", instance, err)
+	}
+	if err := w.put(instance, blob, keys); err != nil {
+		_, _ = w.tx.Exec("ROLLBACK TO put")
+		_, _ = w.tx.Exec("RELEASE put")
+		return xerrors.Errorf("failed to write package %d: %w", instance, err)
+	}
+	if _, err := w.tx.Exec("RELEASE put"); err != nil {
+		return xerrors.Errorf("failed to write package %d: %w", instance, err)
+	}
+	return nil
+}
+
+func (w *Writer) put(instance uint32, blob []byte, keys map[dbi.Index][]dbi.IndexKey) error {
+	if _, err := w.packages.Exec(instance, blob); err != nil {
+		return err
+	}
+
+	for _, index := range dbi.Indexes {
+		for _, key := range keys[index] {
+			var value any = string(key.Key)
+			if index.Binary() {
+				value = key.Key
+			}
+			if _, err := w.indexes[index].Exec(value, instance, key.TagIndex); err != nil {
+				return xerrors.Errorf("%s: %w", index, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close implements dbi.Writer. It commits what was put and closes the
+// database.
+func (w *Writer) Close() error {
+	if err := w.closeStmts(); err != nil {
+		_ = w.abort()
+		return err
+	}
+	if err := w.tx.Commit(); err != nil {
+		_ = w.db.Close()
+		return xerrors.Errorf("failed to commit: %w", err)
+	}
+	return w.db.Close()
+}
+
+// abort gives up on the transaction and closes the database.
+func (w *Writer) abort() error {
+	_ = w.closeStmts()
+	if w.tx != nil {
+		_ = w.tx.Rollback()
+	}
+	return w.db.Close()
+}
+
+func (w *Writer) closeStmts() error {
+	stmts := []*sql.Stmt{w.packages}
+	for _, stmt := range w.indexes {
+		stmts = append(stmts, stmt)
+	}
+
+	var err error
+	for _, stmt := range stmts {
+		if stmt == nil {
+			continue
+		}
+		if cerr := stmt.Close(); cerr != nil && err == nil {
+			err = xerrors.Errorf("failed to close statement: %w", cerr)
+		}
+	}
+	w.packages, w.indexes = nil, nil
+	return err
+}
@@ -0,0 +1,217 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+)
+
+// sqliteVarint appends v as a SQLite varint of at most 8 bytes
+func sqliteVarint(b []byte, v uint64) []byte {
+	var groups []byte
+	for {
+		groups = append([]byte{byte(v & 0x7f)}, groups...)
+		v >>= 7
+		if v == 0 {
+			break
+		}
+	}
+	for i := range groups[:len(groups)-1] {
+		groups[i] |= 0x80
+	}
+	return append(b, groups...)
+}
+
+// sqliteRecord encodes a record of nil, string, []byte and int64 values
+func sqliteRecord(values ...any) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = sqliteVarint(types, 0)
+		case string:
+			types = sqliteVarint(types, uint64(13+2*len(v)))
+			body = append(body, v...)
+		case []byte:
+			types = sqliteVarint(types, uint64(12+2*len(v)))
+			body = append(body, v...)
+		case int64:
+			types = sqliteVarint(types, 6)
+			body = binary.BigEndian.AppendUint64(body, uint64(v))
+		}
+	}
+	// the header length counts itself, which is one byte for these tests
+	return append(append([]byte{byte(len(types) + 1)}, types...), body...)
+}
+
+// sqliteTableCell is a cell of a table leaf page
+func sqliteTableCell(rowid int64, payload []byte) []byte {
+	cell := sqliteVarint(nil, uint64(len(payload)))
+	cell = sqliteVarint(cell, uint64(rowid))
+	return append(cell, payload...)
+}
+
+// sqliteInteriorCell is a cell of an interior table page
+func sqliteInteriorCell(child uint32, key int64) []byte {
+	return sqliteVarint(binary.BigEndian.AppendUint32(nil, child), uint64(key))
+}
+
+// sqliteIndexCell is a cell of an interior index page
+func sqliteIndexCell(child uint32, payload []byte) []byte {
+	cell := sqliteVarint(binary.BigEndian.AppendUint32(nil, child), uint64(len(payload)))
+	return append(cell, payload...)
+}
+
+type sqliteObject struct {
+	typ, name string
+	root      uint32
+}
+
+// sqliteSchema is the leaf page 1 of a database with the given tables and
+// indexes
+func sqliteSchema(pageSize, reserved int, objects ...sqliteObject) []byte {
+	var cells [][]byte
+	for i, o := range objects {
+		cells = append(cells, sqliteTableCell(int64(i+1),
+			sqliteRecord(o.typ, o.name, o.name, int64(o.root), "")))
+	}
+	return sqliteBtreePage(pageSize, reserved, 1, 0x0d, 0, cells...)
+}
+
+// sqliteBtreePage lays out a b-tree page of type typ with the cells at the end
+// of its usable space
+func sqliteBtreePage(pageSize, reserved int, pgno uint32, typ byte, right uint32, cells ...[]byte) []byte {
+	page := make([]byte, pageSize)
+	hdr := 0
+	if pgno == 1 {
+		hdr = 100
+	}
+	page[hdr] = typ
+	binary.BigEndian.PutUint16(page[hdr+3:], uint16(len(cells)))
+	ptrs := hdr + 8
+	if typ == 0x02 || typ == 0x05 {
+		binary.BigEndian.PutUint32(page[hdr+8:], right)
+		ptrs += 4
+	}
+	off := pageSize - reserved
+	for i, cell := range cells {
+		off -= len(cell)
+		copy(page[off:], cell)
+		binary.BigEndian.PutUint16(page[ptrs+2*i:], uint16(off))
+	}
+	binary.BigEndian.PutUint16(page[hdr+5:], uint16(off))
+	return page
+}
+
+// sqliteFile puts the database header on the first of pages and joins them
+func sqliteFile(pageSize, reserved int, pages ...[]byte) []byte {
+	hdr := pages[0]
+	copy(hdr, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(hdr[16:], uint16(pageSize))
+	hdr[18], hdr[19], hdr[20] = 1, 1, byte(reserved)
+	hdr[21], hdr[22], hdr[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(hdr[24:], 1)
+	binary.BigEndian.PutUint32(hdr[28:], uint32(len(pages)))
+	binary.BigEndian.PutUint32(hdr[44:], 4)
+	binary.BigEndian.PutUint32(hdr[56:], 1)
+	binary.BigEndian.PutUint32(hdr[92:], 1)
+	return bytes.Join(pages, nil)
+}
+
+func TestSQLiteCorruptPages(t *testing.T) {
+	const pageSize = 512
+
+	t.Run("record header shorter than its length", func(t *testing.T) {
+		data := sqliteFile(pageSize, 0, sqliteBtreePage(pageSize, 0, 1, 0x0d, 0,
+			sqliteTableCell(1, []byte{0x00, 0x01})))
+		_, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		assert.ErrorContains(t, err, "invalid record header")
+	})
+
+	t.Run("shared schema pages", func(t *testing.T) {
+		// every page refers to the next one with all of its pointers, which
+		// walks the last page 3^38 times
+		const n = 40
+		var pages [][]byte
+		for pgno := uint32(1); pgno < n; pgno++ {
+			next := pgno + 1
+			pages = append(pages, sqliteBtreePage(pageSize, 0, pgno, 0x05, next,
+				sqliteInteriorCell(next, 1), sqliteInteriorCell(next, 2)))
+		}
+		pages = append(pages, sqliteBtreePage(pageSize, 0, n, 0x0d, 0))
+		data := sqliteFile(pageSize, 0, pages...)
+		_, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		assert.ErrorContains(t, err, "referenced twice")
+	})
+
+	t.Run("shared index pages", func(t *testing.T) {
+		const n = 40
+		pages := [][]byte{
+			sqliteSchema(pageSize, 0,
+				sqliteObject{"table", "Packages", 2},
+				sqliteObject{"table", "Name", 3},
+				sqliteObject{"index", "Name_key_idx", 4}),
+			sqliteBtreePage(pageSize, 0, 2, 0x0d, 0),
+			sqliteBtreePage(pageSize, 0, 3, 0x0d, 0,
+				sqliteTableCell(1, sqliteRecord("a", int64(1), int64(0)))),
+		}
+		entry := sqliteRecord("a", int64(1))
+		for pgno := uint32(4); pgno < 4+n-1; pgno++ {
+			next := pgno + 1
+			pages = append(pages, sqliteBtreePage(pageSize, 0, pgno, 0x02, next,
+				sqliteIndexCell(next, entry), sqliteIndexCell(next, entry)))
+		}
+		pages = append(pages, sqliteBtreePage(pageSize, 0, 4+n-1, 0x0a, 0))
+		data := sqliteFile(pageSize, 0, pages...)
+		db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		defer db.Close()
+		_, err = db.Db.(dbi.IndexLookup).LookupIndex(context.Background(), dbi.IndexName, "a")
+		assert.ErrorContains(t, err, "referenced twice")
+	})
+
+	t.Run("interior cell in reserved space", func(t *testing.T) {
+		const reserved = 8
+		// interior pages whose only cell starts 2 bytes before the reserved
+		// space, so its child page number runs into it
+		interior := func(pgno uint32, typ byte) []byte {
+			page := sqliteBtreePage(pageSize, reserved, pgno, typ, 4)
+			binary.BigEndian.PutUint16(page[3:], 1)
+			binary.BigEndian.PutUint16(page[12:], pageSize-reserved-2)
+			return page
+		}
+		data := sqliteFile(pageSize, reserved,
+			sqliteSchema(pageSize, reserved,
+				sqliteObject{"table", "Packages", 2},
+				sqliteObject{"table", "Name", 4},
+				sqliteObject{"index", "Name_key_idx", 3}),
+			interior(2, 0x05),
+			interior(3, 0x02),
+			sqliteBtreePage(pageSize, reserved, 4, 0x0d, 0))
+		db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		defer db.Close()
+
+		_, err = db.PackageByInstance(1)
+		assert.ErrorContains(t, err, "invalid cell offset")
+		_, err = db.Db.(dbi.IndexLookup).LookupIndex(context.Background(), dbi.IndexName, "a")
+		assert.ErrorContains(t, err, "invalid cell offset")
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		data := sqliteFile(pageSize, 0,
+			sqliteSchema(pageSize, 0, sqliteObject{"table", "Packages", 2}),
+			sqliteBtreePage(pageSize, 0, 2, 0x0d, 0))
+		db, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		pkgs, err := db.ListPackages()
+		require.NoError(t, err)
+		assert.Empty(t, pkgs)
+	})
+}
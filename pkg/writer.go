@@ -0,0 +1,210 @@
+package rpmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/sqlite3"
+	"github.com/samber/lo"
+	"golang.org/x/xerrors"
+)
+
+// indexTags are the tags whose values rpm adds to each index.
+// ref. https://github.com/rpm-software-management/rpm/blob/rpm-4.16.0-release/lib/rpmdb.c
+var indexTags = map[dbi.Index]int32{
+	dbi.IndexName:                 RPMTAG_NAME,
+	dbi.IndexBasenames:            RPMTAG_BASENAMES,
+	dbi.IndexGroup:                RPMTAG_GROUP,
+	dbi.IndexRequirename:          RPMTAG_REQUIRENAME,
+	dbi.IndexProvidename:          RPMTAG_PROVIDENAME,
+	dbi.IndexConflictname:         RPMTAG_CONFLICTNAME,
+	dbi.IndexObsoletename:         RPMTAG_OBSOLETENAME,
+	dbi.IndexTriggername:          RPMTAG_TRIGGERNAME,
+	dbi.IndexDirnames:             RPMTAG_DIRNAMES,
+	dbi.IndexInstalltid:           RPMTAG_INSTALLTID,
+	dbi.IndexSigmd5:               RPMTAG_SIGMD5,
+	dbi.IndexSha1header:           RPMTAG_SHA1HEADER,
+	dbi.IndexFiletriggername:      RPMTAG_FILETRIGGERNAME,
+	dbi.IndexTransfiletriggername: RPMTAG_TRANSFILETRIGGERNAME,
+	dbi.IndexRecommendname:        RPMTAG_RECOMMENDNAME,
+	dbi.IndexSuggestname:          RPMTAG_SUGGESTNAME,
+	dbi.IndexSupplementname:       RPMTAG_SUPPLEMENTNAME,
+	dbi.IndexEnhancename:          RPMTAG_ENHANCENAME,
+}
+
+// rpmsenseFlags_e of the requirements that rpm leaves out of Requirename
+// ref. https://github.com/rpm-software-management/rpm/blob/rpm-4.16.0-release/lib/rpmds.h
+const (
+	rpmsensePosttrans  = 1 << 5
+	rpmsensePretrans   = 1 << 7
+	rpmsenseScriptPre  = 1 << 9
+	rpmsenseScriptPost = 1 << 10
+	rpmsenseRpmlib     = 1 << 24
+	rpmsenseKeyring    = 1 << 26
+
+	rpmsenseScriptPreun  = 1 << 11
+	rpmsenseScriptPostun = 1 << 12
+
+	installOnlyMask = rpmsenseScriptPre | rpmsenseScriptPost | rpmsenseRpmlib |
+		rpmsenseKeyring | rpmsensePretrans | rpmsensePosttrans
+	eraseOnlyMask = rpmsenseScriptPreun | rpmsenseScriptPostun
+)
+
+// Writer creates a database from header blobs, and fills rpm's indexes with
+// the keys rpm would add for each header.
+type Writer struct {
+	db dbi.Writer
+	// the highest instance so far
+	last uint32
+}
+
+// CreateSQLite creates an rpmdb.sqlite at path, which must not exist yet,
+// that rpm 4.16 and later can use. Like Open, it needs the "sqlite" SQL
+// driver. The packages are committed by Close. Like rpm, it stores the
+// Installtid keys in the byte order of the host, so the database is for hosts
+// of the same byte order.
+func CreateSQLite(path string) (*Writer, error) {
+	db, err := sqlite3.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{db: db}, nil
+}
+
+// CreateNDB creates an NDB Packages.db at path, which must not exist yet, as
+// used by rpm on SUSE. Index.db is not written; rpm builds it from
+// Packages.db when it is missing. Nothing is written before Close.
+func CreateNDB(path string) (*Writer, error) {
+	db, err := ndb.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{db: db}, nil
+}
+
+// Add stores header, a header blob such as PackageInfo.RawHeader, with the
+// next instance number, which it returns.
+func (w *Writer) Add(header []byte) (uint32, error) {
+	instance := w.last + 1
+	if instance == 0 {
+		return 0, xerrors.New("no instance numbers left")
+	}
+	if err := w.AddInstance(instance, header); err != nil {
+		return 0, err
+	}
+	return instance, nil
+}
+
+// AddInstance is like Add, but stores header with the given instance number,
+// for example to keep the numbers of the database it was read from.
+func (w *Writer) AddInstance(instance uint32, header []byte) error {
+	indexEntries, err := headerImport(header)
+	if err != nil {
+		return xerrors.Errorf("invalid header: %w", err)
+	}
+	keys, err := indexKeys(indexEntries)
+	if err != nil {
+		return xerrors.Errorf("invalid header: %w", err)
+	}
+
+	if err := w.db.Put(instance, header, keys); err != nil {
+		return err
+	}
+	w.last = max(w.last, instance)
+	return nil
+}
+
+// Close finishes the database.
+func (w *Writer) Close() error {
+	return w.db.Close()
+}
+
+// indexKeys returns the keys a header adds to each index, one per element of
+// the indexed tag.
+// ref. https://github.com/rpm-software-management/rpm/blob/rpm-4.16.0-release/lib/rpmdb.c
+func indexKeys(indexEntries []IndexEntry) (map[dbi.Index][]dbi.IndexKey, error) {
+	entries := map[int32]IndexEntry{}
+	for _, ie := range indexEntries {
+		entries[ie.Info.Tag] = ie
+	}
+
+	// install-only requirements are not in Requirename
+	var requireFlags []int32
+	if ie, ok := entries[RPMTAG_REQUIREFLAGS]; ok && ie.Info.Type == RPM_INT32_TYPE {
+		flags, err := parseInt32Array(ie.Data, ie.Length)
+		if err != nil {
+			return nil, xerrors.Errorf("unable to read require flags: %w", err)
+		}
+		requireFlags = flags
+	}
+
+	keys := map[dbi.Index][]dbi.IndexKey{}
+	for _, index := range dbi.Indexes {
+		ie, ok := entries[indexTags[index]]
+		if !ok {
+			continue
+		}
+		values, err := tagValues(ie)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid %s: %w", index, err)
+		}
+
+		for i, value := range values {
+			switch {
+			case index == dbi.IndexRequirename && i < len(requireFlags) &&
+				requireFlags[i]&installOnlyMask != 0 && requireFlags[i]&eraseOnlyMask == 0:
+				continue
+			// a package has a trigger name for every condition of a trigger,
+			// and only the first is added
+			case index == dbi.IndexTriggername && lo.ContainsBy(values[:i], func(v []byte) bool {
+				return bytes.Equal(v, value)
+			}):
+				continue
+			}
+			keys[index] = append(keys[index], dbi.IndexKey{Key: value, TagIndex: uint32(i)})
+		}
+	}
+	return keys, nil
+}
+
+// tagValues returns the elements of a tag as index keys: strings without
+// their NUL, integers in the byte order of the host, as rpm stores them, and
+// binary data as is. Like headerGet, it takes only the first string of an
+// I18N string.
+func tagValues(ie IndexEntry) ([][]byte, error) {
+	switch ie.Info.Type {
+	case RPM_STRING_TYPE, RPM_I18NSTRING_TYPE, RPM_STRING_ARRAY_TYPE:
+		count := int(ie.Info.Count)
+		if ie.Info.Type != RPM_STRING_ARRAY_TYPE {
+			count = 1
+		}
+		values := make([][]byte, 0, count)
+		data := ie.Data
+		for len(values) < count {
+			end := bytes.IndexByte(data, 0)
+			if end < 0 {
+				return nil, xerrors.New("unterminated string")
+			}
+			values = append(values, data[:end])
+			data = data[end+1:]
+		}
+		return values, nil
+	case RPM_INT32_TYPE:
+		ints, err := parseInt32Array(ie.Data, ie.Length)
+		if err != nil {
+			return nil, err
+		}
+		values := make([][]byte, len(ints))
+		for i, v := range ints {
+			values[i] = make([]byte, 4)
+			binary.NativeEndian.PutUint32(values[i], uint32(v))
+		}
+		return values, nil
+	case RPM_BIN_TYPE:
+		return [][]byte{ie.Data}, nil
+	default:
+		return nil, xerrors.Errorf("unexpected type %d", ie.Info.Type)
+	}
+}
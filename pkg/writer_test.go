@@ -0,0 +1,317 @@
+package rpmdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	dbi "github.com/ZafranSecurity/go-rpmdb/pkg/db"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/ndb"
+	"github.com/ZafranSecurity/go-rpmdb/pkg/sqlite3"
+)
+
+// tableRows returns the rows of a table of the SQLite database at path, with
+// the type of every column
+func tableRows(t *testing.T, path, query string) []string {
+	t.Helper()
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=ro&immutable=1", path))
+	require.NoError(t, err)
+	defer db.Close()
+
+	rows, err := db.Query(query)
+	require.NoError(t, err)
+	defer rows.Close()
+	columns, err := rows.Columns()
+	require.NoError(t, err)
+
+	var result []string
+	for rows.Next() {
+		values := make([]any, len(columns))
+		for i := range values {
+			values[i] = new(any)
+		}
+		require.NoError(t, rows.Scan(values...))
+		var row string
+		for _, v := range values {
+			row += fmt.Sprintf("%T:%v ", *v.(*any), *v.(*any))
+		}
+		result = append(result, row)
+	}
+	require.NoError(t, rows.Err())
+	return result
+}
+
+func writeSQLite(t *testing.T, headers []dbi.Entry, keepInstances bool) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rpmdb.sqlite")
+	w, err := CreateSQLite(path)
+	require.NoError(t, err)
+	for i, h := range headers {
+		if keepInstances {
+			require.NoError(t, w.AddInstance(h.Instance, h.Value))
+			continue
+		}
+		instance, err := w.Add(h.Value)
+		require.NoError(t, err)
+		require.Equal(t, uint32(i+1), instance)
+	}
+	require.NoError(t, w.Close())
+	return path
+}
+
+func TestSQLiteWriter(t *testing.T) {
+	t.Run("same tables as rpm", func(t *testing.T) {
+		// rewrite the database rpm wrote from its own headers
+		const file = "testdata/cbl-mariner-2.0/rpmdb.sqlite"
+		source, err := sqlite3.Open(file)
+		require.NoError(t, err)
+		var headers []dbi.Entry
+		for entry := range source.Read() {
+			require.NoError(t, entry.Err)
+			headers = append(headers, entry)
+		}
+		path := writeSQLite(t, headers, true)
+
+		const schema = "SELECT type, name, sql FROM sqlite_master WHERE name != 'sqlite_stat1' ORDER BY name"
+		assert.Equal(t, tableRows(t, file, schema), tableRows(t, path, schema))
+
+		for _, table := range append([]dbi.Index{"Packages"}, dbi.Indexes...) {
+			query := fmt.Sprintf("SELECT * FROM '%s' ORDER BY hnum, idx, key", table)
+			if table == "Packages" {
+				query = "SELECT * FROM Packages ORDER BY hnum"
+			}
+			want := tableRows(t, file, query)
+			got := tableRows(t, path, query)
+			assert.Equal(t, len(want), len(got), table)
+			assert.Equal(t, want, got, table)
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		const file = "testdata/sle15-bci/Packages.db"
+		headers := ndbHeaders(t, file)
+		path := writeSQLite(t, headers, false)
+
+		source, err := Open(file)
+		require.NoError(t, err)
+		want := listPackages(t, source)
+		for i := range want {
+			want[i].Instance = uint32(i + 1)
+		}
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		open := map[string]func() (*RpmDB, error){
+			"sqlite3.Open": func() (*RpmDB, error) {
+				db, err := sqlite3.Open(path)
+				return &RpmDB{Db: db}, err
+			},
+			"OpenReaderAt": func() (*RpmDB, error) {
+				return OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+			},
+		}
+		for name, open := range open {
+			t.Run(name, func(t *testing.T) {
+				db, err := open()
+				require.NoError(t, err)
+				assert.Equal(t, want, listPackages(t, db))
+
+				db, err = open()
+				require.NoError(t, err)
+				defer db.Close()
+
+				pkg, err := db.Package("libzstd1")
+				require.NoError(t, err)
+				assert.Equal(t, "libzstd1", pkg.Name)
+
+				providers, err := db.WhatProvides("libzstd.so.1()(64bit)")
+				require.NoError(t, err)
+				require.Len(t, providers, 1)
+				assert.Equal(t, "libzstd1", providers[0].Name)
+
+				requirers, err := db.WhatRequires("libzstd.so.1()(64bit)")
+				require.NoError(t, err)
+				assert.NotEmpty(t, requirers)
+
+				owners, err := db.FileOwner("/usr/lib64/libzstd.so.1")
+				require.NoError(t, err)
+				require.Len(t, owners, 1)
+				assert.Equal(t, "libzstd1", owners[0].Name)
+
+				lookup := db.Db.(dbi.IndexLookup)
+				matches, err := lookup.LookupIndex(context.Background(), dbi.IndexDirnames, "/usr/lib64/")
+				require.NoError(t, err)
+				assert.NotEmpty(t, matches)
+
+				// the keys of binary indexes are blobs
+				sigmd5, err := hex.DecodeString(pkg.SigMD5)
+				require.NoError(t, err)
+				installtid := binary.NativeEndian.AppendUint32(nil, uint32(pkg.InstallTime))
+				for index, key := range map[dbi.Index][]byte{
+					dbi.IndexSigmd5:     sigmd5,
+					dbi.IndexInstalltid: installtid,
+				} {
+					matches, err := lookup.LookupIndex(context.Background(), index, string(key))
+					require.NoError(t, err)
+					assert.Contains(t, lo.Map(matches, func(m dbi.IndexMatch, _ int) uint32 {
+						return m.Instance
+					}), pkg.Instance, index)
+				}
+			})
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		headers := ndbHeaders(t, "testdata/sle15-bci/Packages.db")
+		path := filepath.Join(t.TempDir(), "rpmdb.sqlite")
+		w, err := CreateSQLite(path)
+		require.NoError(t, err)
+
+		_, err = CreateSQLite(path)
+		assert.ErrorIs(t, err, os.ErrExist)
+
+		_, err = w.Add([]byte("not a header"))
+		assert.ErrorContains(t, err, "invalid header")
+
+		require.NoError(t, w.AddInstance(5, headers[0].Value))
+		// a taken instance leaves nothing behind
+		assert.Error(t, w.AddInstance(5, headers[1].Value))
+		instance, err := w.Add(headers[1].Value)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(6), instance)
+		require.NoError(t, w.Close())
+
+		assert.Equal(t, []string{"int64:5 ", "int64:6 "}, tableRows(t, path, "SELECT hnum FROM Packages ORDER BY hnum"))
+		assert.Equal(t, []string{"int64:5 ", "int64:6 "}, tableRows(t, path, "SELECT DISTINCT hnum FROM Basenames ORDER BY hnum"))
+	})
+}
+
+func TestNDBWriter(t *testing.T) {
+	const file = "testdata/sle15-bci/Packages.db"
+	headers := ndbHeaders(t, file)
+
+	t.Run("round trip", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Packages.db")
+		w, err := CreateNDB(path)
+		require.NoError(t, err)
+		for _, h := range headers {
+			require.NoError(t, w.AddInstance(h.Instance, h.Value))
+		}
+		require.NoError(t, w.Close())
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		header, err := ndb.ReadHeader(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		assert.Equal(t, uint32(1), header.SlotNPages)
+		assert.Equal(t, lo.MaxBy(headers, func(a, b dbi.Entry) bool {
+			return a.Instance > b.Instance
+		}).Instance+1, header.NextPkgIndex)
+
+		db, err := ndb.Open(path)
+		require.NoError(t, err)
+		var got []dbi.Entry
+		for entry := range db.Read() {
+			require.NoError(t, entry.Err)
+			assert.NoError(t, entry.Corruption)
+			got = append(got, dbi.Entry{Value: bytes.Clone(entry.Value), Instance: entry.Instance})
+		}
+		require.NoError(t, db.Close())
+		assert.Equal(t, headers, got)
+
+		source, err := Open(file)
+		require.NoError(t, err)
+		written, err := Open(path)
+		require.NoError(t, err)
+		assert.Equal(t, listPackages(t, source), listPackages(t, written))
+
+		written, err = Open(path)
+		require.NoError(t, err)
+		defer written.Close()
+		pkg, err := written.Package("libzstd1")
+		require.NoError(t, err)
+		assert.Equal(t, "libzstd1", pkg.Name)
+		remnants, err := written.Remnants(context.Background())
+		require.NoError(t, err)
+		assert.Empty(t, remnants)
+	})
+
+	t.Run("slot pages", func(t *testing.T) {
+		// more packages than the slots of one page
+		path := filepath.Join(t.TempDir(), "Packages.db")
+		w, err := CreateNDB(path)
+		require.NoError(t, err)
+		var want []uint32
+		for len(want) < ndb.NDB_SlotEntriesPerPage {
+			for _, h := range headers {
+				instance, err := w.Add(h.Value)
+				require.NoError(t, err)
+				want = append(want, instance)
+			}
+		}
+		require.NoError(t, w.Close())
+
+		db, err := Open(path)
+		require.NoError(t, err)
+		pkgs := listPackages(t, db)
+		assert.Equal(t, want, lo.Map(pkgs, func(pkg *PackageInfo, _ int) uint32 {
+			return pkg.Instance
+		}))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		header, err := ndb.ReadHeader(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, uint32(2), header.SlotNPages)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Packages.db")
+		w, err := CreateNDB(path)
+		require.NoError(t, err)
+
+		_, err = CreateNDB(path)
+		assert.ErrorIs(t, err, os.ErrExist)
+
+		_, err = w.Add([]byte("not a header"))
+		assert.ErrorContains(t, err, "invalid header")
+
+		require.NoError(t, w.AddInstance(5, headers[0].Value))
+		assert.ErrorContains(t, w.AddInstance(5, headers[1].Value), "already taken")
+		instance, err := w.Add(headers[1].Value)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(6), instance)
+		require.NoError(t, w.Close())
+
+		db, err := Open(path)
+		require.NoError(t, err)
+		pkgs := listPackages(t, db)
+		assert.Equal(t, []uint32{5, 6}, lo.Map(pkgs, func(pkg *PackageInfo, _ int) uint32 {
+			return pkg.Instance
+		}))
+	})
+
+	t.Run("failed close", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Packages.db")
+		w, err := ndb.Create(path)
+		require.NoError(t, err)
+		// more packages than the slots of 2048 pages
+		for instance := uint32(1); instance <= 2048*ndb.NDB_SlotEntriesPerPage; instance++ {
+			require.NoError(t, w.Put(instance, []byte{0}, nil))
+		}
+		assert.ErrorContains(t, w.Close(), "too many packages")
+		_, err = os.Stat(path)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}